@@ -0,0 +1,221 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var BadAccessLogError error = errors.New("[tupi-proxy] Bad access log config")
+
+const (
+	accessLogJSON     = "json"
+	accessLogCommon   = "common"
+	accessLogCombined = "combined"
+)
+
+// accessLog writes one line per request.
+type accessLog struct {
+	format string
+	out    io.Writer
+}
+
+// accessLogEntry is what is logged about a request. The json format
+// has all the fields, the common and combined formats only the ones
+// in the apache formats.
+type accessLogEntry struct {
+	Time           time.Time `json:"time"`
+	RequestID      string    `json:"requestId,omitempty"`
+	ClientIP       string    `json:"clientIp"`
+	User           string    `json:"user,omitempty"`
+	Method         string    `json:"method"`
+	URI            string    `json:"uri"`
+	Proto          string    `json:"proto"`
+	Host           string    `json:"host"`
+	Status         int       `json:"status"`
+	BytesReceived  int64     `json:"bytesReceived"`
+	BytesSent      int64     `json:"bytesSent"`
+	Route          string    `json:"route"`
+	Upstream       string    `json:"upstream"`
+	UpstreamAddr   string    `json:"upstreamAddr,omitempty"`
+	UpstreamStatus int       `json:"upstreamStatus,omitempty"`
+	// durations in milliseconds
+	Duration       float64 `json:"durationMs"`
+	UpstreamTTFB   float64 `json:"upstreamTtfbMs,omitempty"`
+	TunnelDuration float64 `json:"tunnelDurationMs,omitempty"`
+	Referer        string  `json:"referer,omitempty"`
+	UserAgent      string  `json:"userAgent,omitempty"`
+}
+
+func newAccessLogEntry(r *http.Request, info *requestInfo,
+	rw *responseWriter, rm *requestMetrics) *accessLogEntry {
+	status := rw.status
+	if info.upgraded {
+		status = http.StatusSwitchingProtocols
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	in := info.wsBytesIn.Load()
+	if rm.body != nil {
+		in += rm.body.n
+	}
+	return &accessLogEntry{
+		Time:           rm.start,
+		RequestID:      info.requestID,
+		ClientIP:       info.clientIP,
+		User:           info.identity,
+		Method:         r.Method,
+		URI:            r.RequestURI,
+		Proto:          r.Proto,
+		Host:           r.Host,
+		Status:         status,
+		BytesReceived:  in,
+		BytesSent:      rw.bytes + info.wsBytesOut.Load(),
+		Route:          info.route,
+		Upstream:       info.upstream,
+		UpstreamAddr:   info.upstreamAddr,
+		UpstreamStatus: info.upstreamStatus,
+		Duration:       milliseconds(time.Since(rm.start)),
+		UpstreamTTFB:   milliseconds(info.upstreamTTFB),
+		TunnelDuration: milliseconds(info.tunnelDuration),
+		Referer:        r.Referer(),
+		UserAgent:      r.UserAgent(),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (al *accessLog) log(r *http.Request, info *requestInfo,
+	rw *responseWriter, rm *requestMetrics) {
+	e := newAccessLogEntry(r, info, rw, rm)
+	var line []byte
+	switch al.format {
+	case accessLogJSON:
+		line, _ = json.Marshal(e)
+	case accessLogCommon:
+		line = []byte(e.common())
+	case accessLogCombined:
+		line = []byte(e.combined())
+	}
+	line = append(line, '\n')
+	// each line is written at once so the outputs don't need locks
+	if _, err := al.out.Write(line); err != nil {
+		requestLogger(info).Error("access log error", "error", err)
+	}
+}
+
+// common returns the entry in the Common Log Format:
+// host ident authuser [date] "request" status bytes
+func (e *accessLogEntry) common() string {
+	size := "-"
+	if e.BytesSent > 0 {
+		size = strconv.FormatInt(e.BytesSent, 10)
+	}
+	user := "-"
+	if e.User != "" {
+		user = clfEscape(e.User, true)
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %d %s",
+		e.ClientIP,
+		user,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		clfQuote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status,
+		size,
+	)
+}
+
+// combined returns the entry in the Combined Log Format, the common
+// format plus referer and user agent.
+func (e *accessLogEntry) combined() string {
+	referer := "-"
+	if e.Referer != "" {
+		referer = e.Referer
+	}
+	ua := "-"
+	if e.UserAgent != "" {
+		ua = e.UserAgent
+	}
+	return e.common() + " " + clfQuote(referer) + " " + clfQuote(ua)
+}
+
+// clfQuote quotes a value escaping quotes, backslashes and control
+// chars so a client can't forge log lines.
+func clfQuote(s string) string {
+	return `"` + clfEscape(s, false) + `"`
+}
+
+// clfEscape escapes quotes, backslashes and control chars. Unquoted
+// fields also have the spaces escaped.
+func clfEscape(s string, space bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f || (space && c == ' '):
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseAccessLog parses the `accessLog` key of the config like:
+// {"format" = "combined", "output" = "file", "path" = "/var/log/access.log"}
+// The format may be json, common or combined. See parseLogOutput for
+// the outputs.
+func parseAccessLog(c map[string]any) (*accessLog, error) {
+	raw, exists, err := getMap(c, "accessLog")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadAccessLogError, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	format, exists, err := getString(raw, "format")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadAccessLogError, err)
+	}
+	if !exists {
+		format = accessLogJSON
+	}
+	switch format {
+	case accessLogJSON, accessLogCommon, accessLogCombined:
+	default:
+		return nil, fmt.Errorf(
+			"%w: format must be json, common or combined", BadAccessLogError)
+	}
+	out, err := parseLogOutput(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadAccessLogError, err)
+	}
+	return &accessLog{format: format, out: out}, nil
+}
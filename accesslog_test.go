@@ -0,0 +1,151 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	e := &accessLogEntry{
+		Time:      time.Date(2024, 3, 10, 13, 55, 36, 0, time.UTC),
+		ClientIP:  "10.0.0.1",
+		Method:    "GET",
+		URI:       `/a"b`,
+		Proto:     "HTTP/1.1",
+		Status:    200,
+		BytesSent: 2326,
+		UserAgent: "curl/8.0\n",
+	}
+	var tests = []struct {
+		name     string
+		got      string
+		expected string
+	}{
+		{"common", e.common(),
+			`10.0.0.1 - - [10/Mar/2024:13:55:36 +0000] "GET /a\"b HTTP/1.1" 200 2326`},
+		{"combined", e.combined(),
+			`10.0.0.1 - - [10/Mar/2024:13:55:36 +0000] "GET /a\"b HTTP/1.1" 200 2326 "-" "curl/8.0\x0a"`},
+		{"authuser", func() string {
+			e := *e
+			e.User = "joe"
+			return e.common()
+		}(),
+			`10.0.0.1 - joe [10/Mar/2024:13:55:36 +0000] "GET /a\"b HTTP/1.1" 200 2326`},
+		{"authuser escaped", func() string {
+			e := *e
+			e.User = "joe \"x\n"
+			return e.common()
+		}(),
+			`10.0.0.1 - joe\x20\"x\x0a [10/Mar/2024:13:55:36 +0000] "GET /a\"b HTTP/1.1" 200 2326`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.got != test.expected {
+				t.Fatalf("bad line %s", test.got)
+			}
+		})
+	}
+}
+
+func TestParseAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	var tests = []struct {
+		name   string
+		conf   map[string]any
+		format string
+		err    error
+	}{
+		{"no access log", map[string]any{}, "", nil},
+		{"not a table", map[string]any{"accessLog": "x"}, "", BadAccessLogError},
+		{"bad format", map[string]any{"accessLog": map[string]any{"format": "xml"}},
+			"", BadAccessLogError},
+		{"bad output", map[string]any{"accessLog": map[string]any{"output": "tcp"}},
+			"", BadLogOutputError},
+		{"file without path", map[string]any{"accessLog": map[string]any{"output": "file"}},
+			"", BadLogOutputError},
+		{"default", map[string]any{"accessLog": map[string]any{}}, "json", nil},
+		{"file", map[string]any{"accessLog": map[string]any{
+			"format": "combined", "output": "file", "path": path}}, "combined", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			al, err := parseAccessLog(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+			if test.format != "" && al.format != test.format {
+				t.Fatalf("bad format %s", al.format)
+			}
+		})
+	}
+}
+
+func TestServeAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("hello"))
+		}))
+	defer upstream.Close()
+	testProxy = nil
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	conf := map[string]any{
+		"host":      upstream.URL,
+		"accessLog": map[string]any{"output": "file", "path": path},
+		"routes": []any{
+			map[string]any{"name": "access-log-test", "pathPrefix": "/a"},
+		},
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/a?x=1", strings.NewReader("the body"))
+	Serve(w, r, &conf)
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("bad read %s", err.Error())
+	}
+	var e accessLogEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		t.Fatalf("bad json %s", string(b))
+	}
+	if e.URI != "/a?x=1" || e.Route != "access-log-test" {
+		t.Fatalf("bad request %+v", e)
+	}
+	if e.Status != 201 || e.UpstreamStatus != 201 {
+		t.Fatalf("bad status %+v", e)
+	}
+	if e.BytesSent != 5 || e.BytesReceived != 8 {
+		t.Fatalf("bad bytes %+v", e)
+	}
+	if e.UpstreamAddr != upstream.Listener.Addr().String() {
+		t.Fatalf("bad upstream addr %s", e.UpstreamAddr)
+	}
+	if e.RequestID != w.Header().Get(defaultRequestIDHeader) {
+		t.Fatalf("bad request id %s", e.RequestID)
+	}
+}
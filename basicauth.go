@@ -0,0 +1,112 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var BadBasicAuthError error = errors.New("[tupi-proxy] Bad basic auth config")
+
+const defaultHtpasswdReload = 5 * time.Second
+
+// basicAuth checks the user and password of the requests with an
+// htpasswd file.
+type basicAuth struct {
+	file  *htpasswdFile
+	realm string
+	// if true the Authorization header is sent to the upstream
+	passthrough bool
+}
+
+// authorize checks the credentials of the request. If the request is
+// allowed it returns true. If not the response was already written.
+func (ba *basicAuth) authorize(w http.ResponseWriter, r *http.Request, info *requestInfo) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok || !ba.file.check(user, password) {
+		if ok {
+			requestLogger(info).Info("basic auth denied", "user", user)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+ba.realm+`", charset="UTF-8"`)
+		writeError(w, r, http.StatusUnauthorized, "bad credentials")
+		return false
+	}
+	info.identity = user
+	if !ba.passthrough {
+		r.Header.Del("Authorization")
+	}
+	return true
+}
+
+// parseBasicAuth parses the `basicAuth` key of the config like:
+// {"file" = "/etc/tupi/htpasswd", "realm" = "admin", "passthrough" = false}
+// If there is no basicAuth key the inherited one is returned.
+func parseBasicAuth(c map[string]any, inherited *basicAuth) (*basicAuth, error) {
+	raw, exists, err := getMap(c, "basicAuth")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadBasicAuthError, err)
+	}
+	if !exists {
+		return inherited, nil
+	}
+	disabled, _, err := getBool(raw, "disabled")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadBasicAuthError, err)
+	}
+	if disabled {
+		return nil, nil
+	}
+
+	ba := &basicAuth{realm: "tupi-proxy"}
+	path, _, err := getString(raw, "file")
+	if err != nil || path == "" {
+		return nil, fmt.Errorf("%w: needs a file", BadBasicAuthError)
+	}
+	realm, exists, err := getString(raw, "realm")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadBasicAuthError, err)
+	}
+	if exists {
+		if strings.Contains(realm, `"`) {
+			return nil, fmt.Errorf("%w: bad realm", BadBasicAuthError)
+		}
+		ba.realm = realm
+	}
+	ba.passthrough, _, err = getBool(raw, "passthrough")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadBasicAuthError, err)
+	}
+
+	reload := defaultHtpasswdReload
+	d, exists, err := getDuration(raw, "reloadInterval")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadBasicAuthError, err)
+	}
+	if exists {
+		reload = d
+	}
+	ba.file, err = loadHtpasswdFile(path, reload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadBasicAuthError, err)
+	}
+	return ba, nil
+}
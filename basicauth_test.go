@@ -0,0 +1,119 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeBasicAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, "joe", "secret")
+	var p *myProxy
+	testProxy = func(rt *route, host string) httpProxy {
+		p = &myProxy{route: rt, host: host}
+		return p
+	}
+	defer func() { testProxy = nil }()
+
+	conf := map[string]any{
+		"host":      "http://v1.bla",
+		"basicAuth": map[string]any{"file": path, "realm": "tools"},
+		"routes": []any{
+			map[string]any{"pathPrefix": "/public", "basicAuth": map[string]any{"disabled": true}},
+			map[string]any{"pathPrefix": "/pass", "basicAuth": map[string]any{
+				"file": path, "passthrough": true}},
+		},
+	}
+
+	var tests = []struct {
+		name     string
+		path     string
+		user     string
+		password string
+		status   int
+		authSent bool
+	}{
+		{"no credentials", "/", "", "", 401, false},
+		{"bad password", "/", "joe", "wrong", 401, false},
+		{"ok", "/", "joe", "secret", 200, false},
+		{"public", "/public", "", "", 200, false},
+		{"passthrough", "/pass", "joe", "secret", 200, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p = nil
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", test.path, nil)
+			if test.user != "" {
+				r.SetBasicAuth(test.user, test.password)
+			}
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+			if test.status == 401 {
+				if w.Header().Get("WWW-Authenticate") != `Basic realm="tools", charset="UTF-8"` {
+					t.Fatalf("bad www-authenticate %s", w.Header().Get("WWW-Authenticate"))
+				}
+				return
+			}
+			if test.user == "" {
+				return
+			}
+			if (p.pr.Out.Header.Get("Authorization") != "") != test.authSent {
+				t.Fatalf("bad authorization header")
+			}
+			if getRequestInfo(p.pr.In).identity != "joe" {
+				t.Fatalf("bad identity")
+			}
+		})
+	}
+}
+
+func TestParseBasicAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, "joe", "secret")
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"not a table", map[string]any{"basicAuth": "x"}, BadBasicAuthError},
+		{"no file", map[string]any{"basicAuth": map[string]any{}}, BadBasicAuthError},
+		{"missing file", map[string]any{"basicAuth": map[string]any{
+			"file": path + ".missing"}}, BadBasicAuthError},
+		{"bad realm", map[string]any{"basicAuth": map[string]any{
+			"file": path, "realm": `a"b`}}, BadBasicAuthError},
+		{"bad passthrough", map[string]any{"basicAuth": map[string]any{
+			"file": path, "passthrough": "yes"}}, BadBasicAuthError},
+		{"ok", map[string]any{"basicAuth": map[string]any{
+			"file": path, "realm": "admin", "reloadInterval": "1s"}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseBasicAuth(test.conf, nil)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
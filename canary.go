@@ -0,0 +1,145 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+)
+
+var BadCanaryError error = errors.New("[tupi-proxy] Bad canary config")
+
+const defaultVariantHeader = "X-Tupi-Variant"
+
+const (
+	variantPrimary = "primary"
+	variantCanary  = "canary"
+)
+
+// canary sends a percentage of the requests of a route to another
+// upstream. If stickyCookie or stickyHeader is set the value of the
+// cookie/header is hashed so the same value always goes to the same
+// variant.
+type canary struct {
+	host *url.URL
+	// percentage of requests sent to the canary. From 0 to 100.
+	weight       float64
+	stickyCookie string
+	stickyHeader string
+	// response header with the chosen variant
+	header string
+}
+
+// isCanary decides if the request goes to the canary upstream
+func (c *canary) isCanary(r *http.Request) bool {
+	if c.weight <= 0 {
+		return false
+	}
+	if c.weight >= 100 {
+		return true
+	}
+	// buckets of 0.01%
+	bucket := rand.Uint32N(10000)
+	if key, ok := c.stickyKey(r); ok {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		bucket = h.Sum32() % 10000
+	}
+	return float64(bucket) < c.weight*100
+}
+
+func (c *canary) stickyKey(r *http.Request) (string, bool) {
+	if c.stickyCookie != "" {
+		ck, err := r.Cookie(c.stickyCookie)
+		if err == nil && ck.Value != "" {
+			return ck.Value, true
+		}
+	}
+	if c.stickyHeader != "" {
+		v := r.Header.Get(c.stickyHeader)
+		if v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// pickVariant returns the route to be used for the request and the
+// name of the variant chosen. For routes without canary the route
+// itself is returned.
+func (rt *route) pickVariant(r *http.Request) (*route, string) {
+	if rt.canary == nil || !rt.canary.isCanary(r) {
+		return rt, variantPrimary
+	}
+	cr := *rt
+	cr.host = rt.canary.host
+	return &cr, variantCanary
+}
+
+func parseCanary(c map[string]any) (*canary, error) {
+	raw, exists, err := getMap(c, "canary")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCanaryError, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	h, _, err := getString(raw, "host")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCanaryError, err)
+	}
+	u, err := url.Parse(h)
+	if err != nil || h == "" {
+		return nil, fmt.Errorf("%w: bad host", BadCanaryError)
+	}
+
+	weight, _, err := getFloat(raw, "weight")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCanaryError, err)
+	}
+	if weight < 0 || weight > 100 {
+		return nil, fmt.Errorf("%w: weight must be between 0 and 100", BadCanaryError)
+	}
+	cn := &canary{
+		host:   u,
+		weight: weight,
+		header: defaultVariantHeader,
+	}
+
+	cn.stickyCookie, _, err = getString(raw, "stickyCookie")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCanaryError, err)
+	}
+	cn.stickyHeader, _, err = getString(raw, "stickyHeader")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCanaryError, err)
+	}
+	header, exists, err := getString(raw, "variantHeader")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCanaryError, err)
+	}
+	if exists {
+		cn.header = header
+	}
+	return cn, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseCanary(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{
+			"no canary",
+			map[string]any{},
+			nil,
+		},
+		{
+			"canary not a table",
+			map[string]any{"canary": "x"},
+			BadCanaryError,
+		},
+		{
+			"missing host",
+			map[string]any{"canary": map[string]any{"weight": 10}},
+			BadCanaryError,
+		},
+		{
+			"bad weight",
+			map[string]any{"canary": map[string]any{
+				"host": "http://canary.bla", "weight": 110}},
+			BadCanaryError,
+		},
+		{
+			"ok",
+			map[string]any{"canary": map[string]any{
+				"host": "http://canary.bla", "weight": 10.5,
+				"stickyCookie": "uid", "variantHeader": "X-Variant"}},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseCanary(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestCanaryPick(t *testing.T) {
+	host, _ := url.Parse("http://primary.bla")
+	canaryHost, _ := url.Parse("http://canary.bla")
+
+	t.Run("weight bounds", func(t *testing.T) {
+		r, _ := http.NewRequest("GET", "/", nil)
+		rt := &route{host: host, canary: &canary{host: canaryHost, weight: 0}}
+		if _, v := rt.pickVariant(r); v != variantPrimary {
+			t.Fatalf("bad variant for 0 %s", v)
+		}
+		rt.canary.weight = 100
+		cr, v := rt.pickVariant(r)
+		if v != variantCanary || cr.host != canaryHost {
+			t.Fatalf("bad variant for 100 %s", v)
+		}
+		if rt.host != host {
+			t.Fatalf("original route changed")
+		}
+	})
+
+	t.Run("sticky", func(t *testing.T) {
+		rt := &route{host: host, canary: &canary{
+			host: canaryHost, weight: 50, stickyCookie: "uid", stickyHeader: "X-User"}}
+		counts := map[string]int{}
+		for i := 0; i < 200; i++ {
+			r, _ := http.NewRequest("GET", "/", nil)
+			if i%2 == 0 {
+				r.AddCookie(&http.Cookie{Name: "uid", Value: fmt.Sprintf("u%d", i)})
+			} else {
+				r.Header.Set("X-User", fmt.Sprintf("u%d", i))
+			}
+			_, first := rt.pickVariant(r)
+			for j := 0; j < 5; j++ {
+				_, v := rt.pickVariant(r)
+				if v != first {
+					t.Fatalf("variant not sticky")
+				}
+			}
+			counts[first]++
+		}
+		if counts[variantCanary] < 50 || counts[variantPrimary] < 50 {
+			t.Fatalf("bad distribution %v", counts)
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		rt := &route{host: host, canary: &canary{host: canaryHost, weight: 10}}
+		n := 0
+		for i := 0; i < 10000; i++ {
+			r, _ := http.NewRequest("GET", "/", nil)
+			if _, v := rt.pickVariant(r); v == variantCanary {
+				n++
+			}
+		}
+		if n < 700 || n > 1300 {
+			t.Fatalf("bad canary count %d", n)
+		}
+	})
+}
+
+func TestServeCanary(t *testing.T) {
+	defer func() {
+		testProxy = nil
+	}()
+	var p *myProxy
+	testProxy = func(rt *route, host string) httpProxy {
+		p = &myProxy{route: rt, host: host}
+		return p
+	}
+
+	conf := map[string]any{
+		"host": "http://v1.bla",
+		"canary": map[string]any{
+			"host":   "http://canary.bla",
+			"weight": 100,
+		},
+	}
+	err := Init("some.domain", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	Serve(w, r, &conf)
+	if p.pr.Out.URL.Host != "canary.bla" {
+		t.Fatalf("bad host %s", p.pr.Out.URL.Host)
+	}
+	if w.Header().Get(defaultVariantHeader) != variantCanary {
+		t.Fatalf("bad variant header %s", w.Header().Get(defaultVariantHeader))
+	}
+
+	// config reload
+	conf["canary"] = map[string]any{"host": "http://canary.bla", "weight": 0}
+	err = Init("some.domain", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if p.pr.Out.URL.Host != "v1.bla" {
+		t.Fatalf("bad host after reload %s", p.pr.Out.URL.Host)
+	}
+	if w.Header().Get(defaultVariantHeader) != variantPrimary {
+		t.Fatalf("bad variant header %s", w.Header().Get(defaultVariantHeader))
+	}
+}
@@ -0,0 +1,447 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var BadCaptureError error = errors.New("[tupi-proxy] Bad capture config")
+
+const (
+	captureHAR    = "har"
+	captureNDJSON = "ndjson"
+
+	defaultCaptureMaxBody = 64 * 1024
+	redactedValue         = "[REDACTED]"
+)
+
+var defaultRedactHeaders = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+}
+
+// capture records the request sent to the upstream and the response
+// sent to the client, for debugging. Requests are captured if they
+// match the predicates or if they are sampled.
+type capture struct {
+	sampleRate float64
+	predicates []predicate
+	maxBody    int64
+	redact     map[string]bool
+	format     string
+	// directory for the har files
+	dir string
+	// output for the ndjson lines
+	out io.Writer
+}
+
+// wants returns true if the request must be captured.
+func (c *capture) wants(r *http.Request) bool {
+	if len(c.predicates) > 0 {
+		matches := true
+		for _, p := range c.predicates {
+			if !p.match(r) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return c.sampleRate > 0 && rand.Float64() < c.sampleRate
+}
+
+// exchange is a captured request/response pair.
+type exchange struct {
+	mu     sync.Mutex
+	start  time.Time
+	method string
+	url    string
+	proto  string
+	header http.Header
+	body   *prefixBuffer
+	sentUp bool
+}
+
+// start begins the capture of a request. The returned writer must be
+// used for the response and the returned func called when the response
+// is done.
+func (c *capture) start(w http.ResponseWriter, r *http.Request,
+	info *requestInfo) (http.ResponseWriter, func()) {
+	ex := &exchange{
+		start:  time.Now(),
+		method: r.Method,
+		url:    requestURL(r),
+		proto:  r.Proto,
+		header: r.Header.Clone(),
+		body:   &prefixBuffer{limit: c.maxBody},
+	}
+	info.capture = ex
+	cw := &captureWriter{
+		responseWriter: newRecordingWriter(w, c.maxBody),
+		proto:          r.Proto,
+	}
+	return cw, func() {
+		c.write(info, ex, cw)
+	}
+}
+
+// recordUpstream records the request as it is sent to the upstream.
+func (ex *exchange) recordUpstream(out *http.Request) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	ex.sentUp = true
+	ex.method = out.Method
+	ex.url = out.URL.String()
+	ex.proto = out.Proto
+	ex.header = out.Header.Clone()
+	if out.Host != "" {
+		ex.header.Set("Host", out.Host)
+	} else {
+		ex.header.Set("Host", out.URL.Host)
+	}
+	if out.Body != nil && out.Body != http.NoBody {
+		out.Body = readCloser{io.TeeReader(out.Body, ex.body), out.Body}
+	}
+}
+
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// captureWriter captures the response written to the client.
+type captureWriter struct {
+	*responseWriter
+	proto string
+}
+
+// harEntry is an entry of a HAR 1.2 log. It is also what is written
+// in each line of the ndjson output.
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	RequestID       string      `json:"_requestId,omitempty"`
+	Route           string      `json:"_route"`
+	Upstream        string      `json:"_upstream"`
+	// the request did not reach the upstream, the client request
+	// is recorded instead
+	NotSent bool `json:"_notSent,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text"`
+	Encoding  string `json:"_encoding,omitempty"`
+	Truncated bool   `json:"_truncated,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size      int64  `json:"size"`
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated bool   `json:"_truncated,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func (c *capture) entry(info *requestInfo, ex *exchange, cw *captureWriter) *harEntry {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	total := time.Since(ex.start)
+	status, header := cw.response()
+	reqBody, reqSize, reqTruncated := ex.body.content()
+	respBody, respSize, respTruncated := cw.body.content()
+	e := &harEntry{
+		StartedDateTime: ex.start.Format(time.RFC3339Nano),
+		Time:            milliseconds(total),
+		RequestID:       info.requestID,
+		Route:           info.route,
+		Upstream:        info.upstream,
+		NotSent:         !ex.sentUp,
+		Request: harRequest{
+			Method:      ex.method,
+			URL:         ex.url,
+			HTTPVersion: ex.proto,
+			Cookies:     []harNameValue{},
+			Headers:     c.harHeaders(ex.header),
+			QueryString: harQuery(ex.url),
+			HeadersSize: -1,
+			BodySize:    reqSize,
+		},
+		Response: harResponse{
+			Status:      status,
+			StatusText:  http.StatusText(status),
+			HTTPVersion: cw.proto,
+			Cookies:     []harNameValue{},
+			Headers:     c.harHeaders(header),
+			RedirectURL: header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    respSize,
+			Content: harContent{
+				Size:      respSize,
+				MimeType:  header.Get("Content-Type"),
+				Truncated: respTruncated,
+			},
+		},
+		Timings: harTimings{
+			Wait:    milliseconds(info.upstreamTTFB),
+			Receive: milliseconds(total - info.upstreamTTFB),
+		},
+	}
+	e.Response.Content.Text, e.Response.Content.Encoding = harText(respBody)
+	if reqSize > 0 {
+		pd := &harPostData{
+			MimeType:  ex.header.Get("Content-Type"),
+			Truncated: reqTruncated,
+		}
+		pd.Text, pd.Encoding = harText(reqBody)
+		e.Request.PostData = pd
+	}
+	return e
+}
+
+// harHeaders returns the headers sorted by name with the redacted
+// values replaced.
+func (c *capture) harHeaders(h http.Header) []harNameValue {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := []harNameValue{}
+	for _, name := range names {
+		for _, v := range h[name] {
+			if c.redact[http.CanonicalHeaderKey(name)] {
+				v = redactedValue
+			}
+			headers = append(headers, harNameValue{name, v})
+		}
+	}
+	return headers
+}
+
+func harQuery(rawURL string) []harNameValue {
+	query := []harNameValue{}
+	_, rawQuery, found := strings.Cut(rawURL, "?")
+	if !found {
+		return query
+	}
+	for _, kv := range strings.Split(rawQuery, "&") {
+		k, v, _ := strings.Cut(kv, "=")
+		query = append(query, harNameValue{k, v})
+	}
+	return query
+}
+
+// harText returns the body as text. Bodies that are not utf-8 are
+// base64 encoded.
+func harText(b []byte) (string, string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func (c *capture) write(info *requestInfo, ex *exchange, cw *captureWriter) {
+	e := c.entry(info, ex, cw)
+	var err error
+	switch c.format {
+	case captureHAR:
+		err = c.writeHAR(e)
+	case captureNDJSON:
+		b, _ := json.Marshal(e)
+		_, err = c.out.Write(append(b, '\n'))
+	}
+	if err != nil {
+		requestLogger(info).Error("capture error", "error", err)
+	}
+}
+
+// writeHAR writes the entry in its own har file.
+func (c *capture) writeHAR(e *harEntry) error {
+	har := map[string]any{
+		"log": map[string]any{
+			"version": "1.2",
+			"creator": map[string]string{"name": "tupi-proxy", "version": "1"},
+			"entries": []*harEntry{e},
+		},
+	}
+	b, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the request id may come from the client so it is not used in
+	// the file name
+	name := fmt.Sprintf("%d-%016x.har", time.Now().UnixNano(), rand.Uint64())
+	path := filepath.Join(c.dir, name)
+	if filepath.Dir(path) != filepath.Clean(c.dir) {
+		return fmt.Errorf("bad capture file %s", path)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// parseCapture parses the `capture` key of the config like:
+// {"sampleRate" = 0.01, "match" = {"pathPrefix" = "/api"}, "format" = "har", "dir" = "/tmp/capture"}
+// The match table takes the same predicates of the routes.
+func parseCapture(c map[string]any) (*capture, error) {
+	raw, exists, err := getMap(c, "capture")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCaptureError, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	cp := &capture{maxBody: defaultCaptureMaxBody, redact: map[string]bool{}}
+
+	rate, _, err := getFloat(raw, "sampleRate")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCaptureError, err)
+	}
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("%w: sampleRate must be between 0 and 1", BadCaptureError)
+	}
+	cp.sampleRate = rate
+
+	match, exists, err := getMap(raw, "match")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCaptureError, err)
+	}
+	if exists {
+		cp.predicates, err = parsePredicates(match)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadCaptureError, err)
+		}
+		if len(cp.predicates) == 0 {
+			return nil, fmt.Errorf("%w: empty match", BadCaptureError)
+		}
+	}
+	if cp.sampleRate == 0 && len(cp.predicates) == 0 {
+		return nil, fmt.Errorf("%w: needs sampleRate or match", BadCaptureError)
+	}
+
+	maxBody, exists, err := getInt(raw, "maxBody")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCaptureError, err)
+	}
+	if exists {
+		cp.maxBody = maxBody
+	}
+
+	redact, exists, err := getStringList(raw, "redactHeaders")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCaptureError, err)
+	}
+	if !exists {
+		redact = defaultRedactHeaders
+	}
+	for _, h := range redact {
+		cp.redact[http.CanonicalHeaderKey(h)] = true
+	}
+
+	format, exists, err := getString(raw, "format")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCaptureError, err)
+	}
+	if !exists {
+		format = captureNDJSON
+	}
+	cp.format = format
+	switch format {
+	case captureHAR:
+		dir, _, err := getString(raw, "dir")
+		if err != nil || dir == "" {
+			return nil, fmt.Errorf("%w: har format needs a dir", BadCaptureError)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("%w: %w", BadCaptureError, err)
+		}
+		cp.dir = dir
+	case captureNDJSON:
+		cp.out, err = parseLogOutput(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadCaptureError, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: format must be har or ndjson", BadCaptureError)
+	}
+	return cp, nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCapture(t *testing.T) {
+	dir := t.TempDir()
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"no capture", map[string]any{}, nil},
+		{"not a table", map[string]any{"capture": "x"}, BadCaptureError},
+		{"nothing to capture", map[string]any{"capture": map[string]any{}}, BadCaptureError},
+		{"bad rate", map[string]any{"capture": map[string]any{"sampleRate": 2}}, BadCaptureError},
+		{"empty match", map[string]any{"capture": map[string]any{
+			"match": map[string]any{}}}, BadCaptureError},
+		{"bad match", map[string]any{"capture": map[string]any{
+			"match": map[string]any{"pathRegex": "("}}}, BadConfigValue},
+		{"bad format", map[string]any{"capture": map[string]any{
+			"sampleRate": 0.1, "format": "xml"}}, BadCaptureError},
+		{"har without dir", map[string]any{"capture": map[string]any{
+			"sampleRate": 0.1, "format": "har"}}, BadCaptureError},
+		{"bad redact", map[string]any{"capture": map[string]any{
+			"sampleRate": 0.1, "redactHeaders": "Cookie"}}, BadCaptureError},
+		{"har", map[string]any{"capture": map[string]any{
+			"sampleRate": 0.1, "format": "har", "dir": dir}}, nil},
+		{"ndjson", map[string]any{"capture": map[string]any{
+			"match": map[string]any{"pathPrefix": "/debug"}}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseCapture(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestCaptureWants(t *testing.T) {
+	var tests = []struct {
+		name     string
+		capture  *capture
+		path     string
+		expected bool
+	}{
+		{"match", &capture{predicates: []predicate{pathPrefixPredicate{"/debug"}}},
+			"/debug/x", true},
+		{"no match", &capture{predicates: []predicate{pathPrefixPredicate{"/debug"}}},
+			"/x", false},
+		{"sampled", &capture{sampleRate: 1}, "/x", true},
+		{"not sampled", &capture{}, "/x", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.path, nil)
+			if test.capture.wants(r) != test.expected {
+				t.Fatalf("bad wants for %s", test.path)
+			}
+		})
+	}
+}
+
+func TestServeCapture(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.ReadAll(r.Body)
+			w.Header().Set("Set-Cookie", "session=secret")
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("hello from " + r.URL.Path))
+		}))
+	defer upstream.Close()
+	testProxy = nil
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "capture.ndjson")
+	conf := map[string]any{
+		"host": upstream.URL,
+		"capture": map[string]any{
+			"match":   map[string]any{"pathPrefix": "/debug"},
+			"output":  "file",
+			"path":    path,
+			"maxBody": 10,
+		},
+		"routes": []any{
+			map[string]any{"pathPrefix": "/debug", "stripPrefix": "/debug"},
+		},
+	}
+	for _, p := range []string{"/debug/a?x=1", "/other"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", p, strings.NewReader("the request body"))
+		r.Header.Set("Authorization", "Bearer secret")
+		Serve(w, r, &conf)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("bad read %s", err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("bad lines %d", len(lines))
+	}
+	if strings.Contains(lines[0], "secret") {
+		t.Fatalf("not redacted %s", lines[0])
+	}
+	var e harEntry
+	json.Unmarshal([]byte(lines[0]), &e)
+	if e.Request.URL != upstream.URL+"/a?x=1" || e.NotSent {
+		t.Fatalf("bad upstream request %+v", e.Request)
+	}
+	if e.Request.PostData == nil || e.Request.PostData.Text != "the reques" ||
+		!e.Request.PostData.Truncated || e.Request.BodySize != 16 {
+		t.Fatalf("bad request body %+v", e.Request.PostData)
+	}
+	if e.Response.Status != 200 || e.Response.Content.Text != "hello from" {
+		t.Fatalf("bad response %+v", e.Response)
+	}
+	if len(e.Request.QueryString) != 1 || e.Request.QueryString[0].Value != "1" {
+		t.Fatalf("bad query %+v", e.Request.QueryString)
+	}
+}
+
+func TestServeCaptureHAR(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte{0xff, 0xfe})
+		}))
+	defer upstream.Close()
+	testProxy = nil
+
+	dir := t.TempDir()
+	conf := map[string]any{
+		"host": upstream.URL,
+		"capture": map[string]any{
+			"sampleRate": 1,
+			"format":     "har",
+			"dir":        dir,
+		},
+	}
+	// the client request id can't choose the file
+	for range 2 {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(defaultRequestIDHeader, "../../x")
+		Serve(w, r, &conf)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	if len(files) != 2 {
+		t.Fatalf("bad files %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "../../x.har")); err == nil {
+		t.Fatalf("file written outside dir")
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("bad read %s", err.Error())
+	}
+	var har struct {
+		Log struct {
+			Version string     `json:"version"`
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	json.Unmarshal(b, &har)
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 1 {
+		t.Fatalf("bad har %s", string(b))
+	}
+	if har.Log.Entries[0].RequestID != "../../x" {
+		t.Fatalf("bad request id %s", har.Log.Entries[0].RequestID)
+	}
+	content := har.Log.Entries[0].Response.Content
+	if content.Encoding != "base64" || content.Text != "//4=" {
+		t.Fatalf("bad content %+v", content)
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var BadConcurrencyError error = errors.New("[tupi-proxy] Bad concurrency config")
+
+const (
+	limitAIMD     = "aimd"
+	limitVegas    = "vegas"
+	limitGradient = "gradient"
+
+	defaultInitialLimit = 20
+	defaultMinLimit     = 1
+	defaultMaxLimit     = 1000
+	defaultQueueSize    = 100
+	defaultQueueTimeout = 100 * time.Millisecond
+	// requests after which vegas measures the latency without load
+	// again
+	defaultProbeInterval = 500
+)
+
+// concurrency limits the requests in flight to each upstream. The
+// limit of each upstream adapts to the latency and to the errors of
+// the upstream. Requests over the limit wait in a queue for a while
+// and are rejected if they don't get in.
+type concurrency struct {
+	newAlgorithm func() limitAlgorithm
+	initialLimit float64
+	minLimit     float64
+	maxLimit     float64
+	queueSize    int
+	queueTimeout time.Duration
+	priorities   *priorities
+
+	mu       sync.Mutex
+	limiters map[string]*limiter
+}
+
+// limitAlgorithm computes a new limit after each request. inFlight
+// is the number of requests in flight when the request finished and
+// dropped is true if the request failed in a way that indicates the
+// upstream is overloaded.
+type limitAlgorithm interface {
+	update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64
+}
+
+func (c *concurrency) limiter(upstream string) *limiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.limiters[upstream]
+	if !ok {
+		l = &limiter{
+			upstream:  upstream,
+			algorithm: c.newAlgorithm(),
+			minLimit:  c.minLimit,
+			maxLimit:  c.maxLimit,
+			limit:     c.initialLimit,
+			queueSize: c.queueSize,
+		}
+		concurrencyLimit.set(l.limit, upstream)
+		c.limiters[upstream] = l
+	}
+	return l
+}
+
+// acquire gets a slot for the request in the upstream limiter. It
+// returns false if the request must be rejected. Otherwise release
+// must be called when the request is done. routeClass is the priority
+// class of the route.
+func (c *concurrency) acquire(r *http.Request, info *requestInfo,
+	routeClass string) (func(dropped bool), bool) {
+	l := c.limiter(info.upstream)
+	class, priority := c.priorities.classOf(r, info, routeClass)
+	waited, ok := l.acquire(r.Context(), c.queueTimeout, priority)
+	if waited > 0 {
+		queueWait.observe(waited.Seconds(), info.upstream, class)
+	}
+	if !ok {
+		concurrencyRejected.add(1, info.route, info.upstream)
+		return nil, false
+	}
+	start := time.Now()
+	return func(dropped bool) {
+		// the time to first byte is a better signal than the time to
+		// send a response that may be streamed
+		rtt := info.upstreamTTFB
+		if rtt == 0 {
+			rtt = time.Since(start)
+		}
+		l.release(rtt, dropped)
+	}, true
+}
+
+// overloaded returns true if the request result indicates that the
+// upstream is overloaded.
+func overloaded(info *requestInfo) bool {
+	if info.upstreamError != "" && info.upstreamError != errorCancelled {
+		return true
+	}
+	switch info.upstreamStatus {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// limiter is the concurrency limiter of an upstream.
+type limiter struct {
+	upstream  string
+	algorithm limitAlgorithm
+	minLimit  float64
+	maxLimit  float64
+	queueSize int
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	queue    waitQueue
+	seq      uint64
+}
+
+// acquire gets a slot in the limiter. If there is no free slot the
+// request waits in the queue, where the requests with higher priority
+// get the slots first. It returns how long the request waited in the
+// queue and if it got a slot.
+func (l *limiter) acquire(ctx context.Context, timeout time.Duration,
+	priority int64) (time.Duration, bool) {
+	l.mu.Lock()
+	if l.inFlight < int(l.limit) && len(l.queue) == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return 0, true
+	}
+	if len(l.queue) >= l.queueSize {
+		l.mu.Unlock()
+		return 0, false
+	}
+	start := time.Now()
+	l.seq++
+	w := &waiter{ready: make(chan struct{}), priority: priority, seq: l.seq}
+	heap.Push(&l.queue, w)
+	queueDepth.set(float64(len(l.queue)), l.upstream)
+	l.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-w.ready:
+		return time.Since(start), true
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.ready:
+		// got in while giving up
+		return time.Since(start), true
+	default:
+	}
+	heap.Remove(&l.queue, w.index)
+	queueDepth.set(float64(len(l.queue)), l.upstream)
+	return time.Since(start), false
+}
+
+func (l *limiter) release(rtt time.Duration, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inFlight := l.inFlight
+	l.inFlight--
+	limit := l.algorithm.update(l.limit, rtt, inFlight, dropped)
+	l.limit = math.Max(l.minLimit, math.Min(l.maxLimit, limit))
+	concurrencyLimit.set(l.limit, l.upstream)
+	for len(l.queue) > 0 && l.inFlight < int(l.limit) {
+		w := heap.Pop(&l.queue).(*waiter)
+		l.inFlight++
+		close(w.ready)
+	}
+	queueDepth.set(float64(len(l.queue)), l.upstream)
+}
+
+// aimdLimit increases the limit by one while the requests succeed
+// and the limit is being used, and decreases it by backoff when a
+// request is dropped.
+type aimdLimit struct {
+	backoff float64
+}
+
+func (a *aimdLimit) update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64 {
+	if dropped {
+		return limit * a.backoff
+	}
+	if float64(inFlight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// vegasLimit estimates the queue in the upstream from the latency
+// without load (the minimum latency seen) and keeps it between alpha
+// and beta, like TCP Vegas.
+type vegasLimit struct {
+	rttNoLoad time.Duration
+	// the minimum latency is forgotten after some requests so it can
+	// follow changes in the upstream
+	probeCount int
+	samples    int
+}
+
+func (v *vegasLimit) update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64 {
+	v.samples++
+	if v.probeCount > 0 && v.samples >= v.probeCount {
+		v.samples = 0
+		v.rttNoLoad = 0
+	}
+	if v.rttNoLoad == 0 || rtt < v.rttNoLoad {
+		v.rttNoLoad = rtt
+		return limit
+	}
+	step := math.Max(1, math.Log10(limit))
+	if dropped {
+		return limit - step
+	}
+	if float64(inFlight)*2 < limit {
+		return limit
+	}
+	queue := limit * (1 - float64(v.rttNoLoad)/float64(rtt))
+	alpha := 3 * step
+	beta := 6 * step
+	switch {
+	case queue <= alpha:
+		return limit + step
+	case queue >= beta:
+		return limit - step
+	}
+	return limit
+}
+
+// gradientLimit compares the recent latency with the long term
+// latency. When the recent latency grows the limit shrinks, and a
+// queue of sqrt(limit) is allowed so the limit can grow.
+type gradientLimit struct {
+	shortRTT float64
+	longRTT  float64
+}
+
+const (
+	gradientShortWeight = 0.5
+	gradientLongWeight  = 0.01
+	gradientSmoothing   = 0.2
+)
+
+func (g *gradientLimit) update(limit float64, rtt time.Duration, inFlight int, dropped bool) float64 {
+	sample := float64(rtt)
+	if g.longRTT == 0 {
+		g.shortRTT = sample
+		g.longRTT = sample
+	}
+	g.shortRTT += (sample - g.shortRTT) * gradientShortWeight
+	g.longRTT += (sample - g.longRTT) * gradientLongWeight
+	// the long term latency follows the recovery of the upstream
+	if g.longRTT/g.shortRTT > 2 {
+		g.longRTT *= 0.95
+	}
+	if dropped {
+		return limit * 0.9
+	}
+	if float64(inFlight)*2 < limit {
+		return limit
+	}
+	gradient := math.Max(0.5, math.Min(1, g.longRTT/g.shortRTT))
+	newLimit := limit*gradient + math.Sqrt(limit)
+	return limit*(1-gradientSmoothing) + newLimit*gradientSmoothing
+}
+
+// parseConcurrency parses the `concurrency` key of the config like:
+// {"algorithm" = "vegas", "maxLimit" = 200, "queueSize" = 50, "queueTimeout" = "50ms"}
+// If there is no concurrency key the inherited one is returned.
+func parseConcurrency(c map[string]any, inherited *concurrency) (*concurrency, error) {
+	raw, exists, err := getMap(c, "concurrency")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+	}
+	if !exists {
+		return inherited, nil
+	}
+	disabled, _, err := getBool(raw, "disabled")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+	}
+	if disabled {
+		return nil, nil
+	}
+	cc := &concurrency{limiters: map[string]*limiter{}}
+
+	algorithm, exists, err := getString(raw, "algorithm")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+	}
+	if !exists {
+		algorithm = limitVegas
+	}
+	switch algorithm {
+	case limitAIMD:
+		backoff, exists, err := getFloat(raw, "backoff")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+		}
+		if !exists {
+			backoff = 0.9
+		}
+		if backoff <= 0 || backoff >= 1 {
+			return nil, fmt.Errorf("%w: backoff must be between 0 and 1", BadConcurrencyError)
+		}
+		cc.newAlgorithm = func() limitAlgorithm { return &aimdLimit{backoff: backoff} }
+	case limitVegas:
+		probe, exists, err := getInt(raw, "probeInterval")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+		}
+		if !exists {
+			probe = defaultProbeInterval
+		}
+		if probe < 0 {
+			return nil, fmt.Errorf("%w: probeInterval can't be negative", BadConcurrencyError)
+		}
+		cc.newAlgorithm = func() limitAlgorithm { return &vegasLimit{probeCount: int(probe)} }
+	case limitGradient:
+		cc.newAlgorithm = func() limitAlgorithm { return &gradientLimit{} }
+	default:
+		return nil, fmt.Errorf(
+			"%w: algorithm must be aimd, vegas or gradient", BadConcurrencyError)
+	}
+
+	limits := []struct {
+		key  string
+		dest *float64
+		def  float64
+	}{
+		{"initialLimit", &cc.initialLimit, defaultInitialLimit},
+		{"minLimit", &cc.minLimit, defaultMinLimit},
+		{"maxLimit", &cc.maxLimit, defaultMaxLimit},
+	}
+	for _, l := range limits {
+		v, exists, err := getInt(raw, l.key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+		}
+		*l.dest = l.def
+		if exists {
+			if v <= 0 {
+				return nil, fmt.Errorf("%w: %s must be positive", BadConcurrencyError, l.key)
+			}
+			*l.dest = float64(v)
+		}
+	}
+	if cc.minLimit > cc.maxLimit {
+		return nil, fmt.Errorf("%w: minLimit bigger than maxLimit", BadConcurrencyError)
+	}
+	cc.initialLimit = math.Max(cc.minLimit, math.Min(cc.maxLimit, cc.initialLimit))
+
+	queueSize, exists, err := getInt(raw, "queueSize")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+	}
+	cc.queueSize = defaultQueueSize
+	if exists {
+		if queueSize < 0 {
+			return nil, fmt.Errorf("%w: queueSize can't be negative", BadConcurrencyError)
+		}
+		cc.queueSize = int(queueSize)
+	}
+
+	queueTimeout, exists, err := getDuration(raw, "queueTimeout")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+	}
+	cc.queueTimeout = defaultQueueTimeout
+	if exists {
+		cc.queueTimeout = queueTimeout
+	}
+
+	cc.priorities, err = parsePriorities(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
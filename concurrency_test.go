@@ -0,0 +1,268 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimitAlgorithms(t *testing.T) {
+	ms := time.Millisecond
+	var tests = []struct {
+		name      string
+		algorithm limitAlgorithm
+		rtts      []time.Duration
+		inFlight  int
+		dropped   bool
+		check     func(limit float64) bool
+	}{
+		{"aimd increase", &aimdLimit{backoff: 0.9}, []time.Duration{ms}, 10, false,
+			func(l float64) bool { return l == 11 }},
+		{"aimd idle", &aimdLimit{backoff: 0.9}, []time.Duration{ms}, 2, false,
+			func(l float64) bool { return l == 10 }},
+		{"aimd backoff", &aimdLimit{backoff: 0.5}, []time.Duration{ms}, 10, true,
+			func(l float64) bool { return l == 5 }},
+		{"vegas no queue", &vegasLimit{}, []time.Duration{10 * ms, 10 * ms}, 10, false,
+			func(l float64) bool { return l == 11 }},
+		{"vegas queue", &vegasLimit{}, []time.Duration{10 * ms, 40 * ms}, 10, false,
+			func(l float64) bool { return l == 9 }},
+		{"vegas dropped", &vegasLimit{}, []time.Duration{10 * ms, 10 * ms}, 10, true,
+			func(l float64) bool { return l == 9 }},
+		{"gradient stable", &gradientLimit{}, []time.Duration{10 * ms, 10 * ms}, 10, false,
+			func(l float64) bool { return l > 10 }},
+		{"gradient slower", &gradientLimit{}, []time.Duration{10 * ms, 100 * ms}, 10, false,
+			func(l float64) bool { return l < 10 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limit := 10.0
+			for i, rtt := range test.rtts {
+				last := i == len(test.rtts)-1
+				l := test.algorithm.update(limit, rtt, test.inFlight, test.dropped && last)
+				if last {
+					limit = l
+				}
+			}
+			if !test.check(limit) {
+				t.Fatalf("bad limit %f", limit)
+			}
+		})
+	}
+}
+
+func TestVegasBaselineShift(t *testing.T) {
+	cc, _ := parseConcurrency(map[string]any{"concurrency": map[string]any{}}, nil)
+	if v := cc.newAlgorithm().(*vegasLimit); v.probeCount != defaultProbeInterval {
+		t.Fatalf("bad default probe interval %d", v.probeCount)
+	}
+	ms := time.Millisecond
+	var tests = []struct {
+		name  string
+		probe int
+		check func(limit float64) bool
+	}{
+		{"probe", defaultProbeInterval, func(l float64) bool { return l > 100 }},
+		{"no probe", 0, func(l float64) bool { return l < 20 }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := &vegasLimit{probeCount: test.probe}
+			limit := 50.0
+			for i := 0; i < 100; i++ {
+				limit = v.update(limit, 10*ms, int(limit), false)
+			}
+			// a deploy makes the upstream slower for good
+			for i := 0; i < 3*defaultProbeInterval; i++ {
+				limit = math.Max(1, math.Min(1000, v.update(limit, 40*ms, int(limit), false)))
+			}
+			if !test.check(limit) {
+				t.Fatalf("bad limit %f", limit)
+			}
+		})
+	}
+}
+
+func newTestLimiter(limit float64, queueSize int) *limiter {
+	cc := &concurrency{
+		newAlgorithm: func() limitAlgorithm { return &aimdLimit{backoff: 0.9} },
+		initialLimit: limit,
+		minLimit:     1,
+		maxLimit:     limit,
+		queueSize:    queueSize,
+		limiters:     map[string]*limiter{},
+	}
+	return cc.limiter("test.bla")
+}
+
+func TestLimiterAcquire(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("rejected", func(t *testing.T) {
+		l := newTestLimiter(1, 0)
+		if _, ok := l.acquire(ctx, time.Second, 0); !ok {
+			t.Fatalf("first rejected")
+		}
+		if _, ok := l.acquire(ctx, time.Second, 0); ok {
+			t.Fatalf("second acquired")
+		}
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		l := newTestLimiter(1, 1)
+		l.acquire(ctx, time.Second, 0)
+		if _, ok := l.acquire(ctx, 10*time.Millisecond, 0); ok {
+			t.Fatalf("acquired")
+		}
+		if len(l.queue) != 0 {
+			t.Fatalf("waiter not removed")
+		}
+	})
+
+	t.Run("queued", func(t *testing.T) {
+		l := newTestLimiter(1, 1)
+		l.acquire(ctx, time.Second, 0)
+		got := make(chan bool)
+		go func() {
+			_, ok := l.acquire(ctx, time.Second, 0)
+			got <- ok
+		}()
+		for {
+			l.mu.Lock()
+			n := len(l.queue)
+			l.mu.Unlock()
+			if n == 1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		l.release(time.Millisecond, false)
+		if !<-got {
+			t.Fatalf("queued not acquired")
+		}
+		if l.inFlight != 1 {
+			t.Fatalf("bad in flight %d", l.inFlight)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		l := newTestLimiter(1, 1)
+		l.acquire(ctx, time.Second, 0)
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, ok := l.acquire(cctx, time.Second, 0); ok {
+			t.Fatalf("acquired")
+		}
+	})
+}
+
+func TestOverloaded(t *testing.T) {
+	var tests = []struct {
+		name     string
+		info     *requestInfo
+		expected bool
+	}{
+		{"ok", &requestInfo{upstreamStatus: 200}, false},
+		{"server error", &requestInfo{upstreamStatus: 500}, false},
+		{"unavailable", &requestInfo{upstreamStatus: 503}, true},
+		{"timeout", &requestInfo{upstreamError: errorTimeout}, true},
+		{"cancelled", &requestInfo{upstreamError: errorCancelled}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if overloaded(test.info) != test.expected {
+				t.Fatalf("bad overloaded")
+			}
+		})
+	}
+}
+
+func TestParseConcurrency(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"not a table", map[string]any{"concurrency": "x"}, BadConcurrencyError},
+		{"bad algorithm", map[string]any{"concurrency": map[string]any{
+			"algorithm": "x"}}, BadConcurrencyError},
+		{"bad backoff", map[string]any{"concurrency": map[string]any{
+			"algorithm": "aimd", "backoff": 1.5}}, BadConcurrencyError},
+		{"bad limit", map[string]any{"concurrency": map[string]any{
+			"maxLimit": 0}}, BadConcurrencyError},
+		{"min over max", map[string]any{"concurrency": map[string]any{
+			"minLimit": 10, "maxLimit": 5}}, BadConcurrencyError},
+		{"bad queue", map[string]any{"concurrency": map[string]any{
+			"queueSize": -1}}, BadConcurrencyError},
+		{"bad timeout", map[string]any{"concurrency": map[string]any{
+			"queueTimeout": "x"}}, BadConcurrencyError},
+		{"negative probe interval", map[string]any{"concurrency": map[string]any{
+			"probeInterval": -1}}, BadConcurrencyError},
+		{"ok", map[string]any{"concurrency": map[string]any{
+			"algorithm": "gradient", "maxLimit": 50, "queueTimeout": "10ms"}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseConcurrency(test.conf, nil)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestServeConcurrency(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-block
+		}))
+	defer upstream.Close()
+	testProxy = nil
+
+	conf := map[string]any{
+		"host": upstream.URL,
+		"concurrency": map[string]any{
+			"algorithm": "aimd", "initialLimit": 1, "maxLimit": 1, "queueSize": 0,
+		},
+	}
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		Serve(w, httptest.NewRequest("GET", "/", nil), &conf)
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	Serve(w, httptest.NewRequest("GET", "/", nil), &conf)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("bad code %d", w.Code)
+	}
+	close(block)
+	if code := <-done; code != 200 {
+		t.Fatalf("bad first code %d", code)
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// confKey is the key used to store the parsed config inside the
+// plugin config map, so the parsing is done only once.
+const confKey = "__tupi-proxy-config"
+
+var BadConfigValue error = errors.New("[tupi-proxy] Bad config value")
+
+// proxyConfig is the parsed version of the plugin config.
+type proxyConfig struct {
+	defaultRoute *route
+	// routes sorted by priority
+	routes          []*route
+	trustedProxies  trustedProxies
+	requestIDHeader string
+	tracer          *tracer
+	metrics         *metricsConfig
+	accessLog       *accessLog
+	capture         *capture
+	errorPages      *errorPages
+}
+
+var confMutex sync.RWMutex
+
+// parseConfig validates the raw plugin config and returns its
+// parsed version.
+func parseConfig(c map[string]any) (*proxyConfig, error) {
+	if c == nil {
+		return nil, MissingConfigError
+	}
+
+	h, exists := c["host"]
+	if !exists {
+		return nil, NoHostError
+	}
+
+	hs, ok := h.(string)
+	if !ok {
+		return nil, BadHostError
+	}
+	u, err := url.Parse(hs)
+	if err != nil {
+		return nil, BadHostError
+	}
+
+	preserveHost := false
+	hasPreserveHost := false
+	if p, exists := c["preserveHost"]; exists {
+		preserveHost, ok = p.(bool)
+		if !ok {
+			return nil, BadPreserveHost
+		}
+		hasPreserveHost = true
+	}
+
+	rewrite, err := parsePathRewrite(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	canary, err := parseCanary(c)
+	if err != nil {
+		return nil, err
+	}
+
+	mirror, err := parseMirror(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	forwarded, err := parseForwardedHeaders(c, forwardedHeaders{})
+	if err != nil {
+		return nil, err
+	}
+
+	reqRules, err := parseHeaderRules(c, "requestHeaders")
+	if err != nil {
+		return nil, err
+	}
+	respRules, err := parseHeaderRules(c, "responseHeaders")
+	if err != nil {
+		return nil, err
+	}
+
+	requestIDHeader, err := parseRequestIDHeader(c)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer, err := parseTracing(c)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsConf, err := parseMetrics(c)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted, err := parseTrustedProxies(c)
+	if err != nil {
+		return nil, err
+	}
+
+	accessLog, err := parseAccessLog(c)
+	if err != nil {
+		return nil, err
+	}
+
+	capture, err := parseCapture(c)
+	if err != nil {
+		return nil, err
+	}
+
+	errorPages, err := parseErrorPages(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ipAccess, err := parseIPAccess(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := parseRequestLimits(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	forwardAuth, err := parseForwardAuth(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	jwt, err := parseJWT(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	basicAuth, err := parseBasicAuth(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	signing, err := parseSigning(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimit, err := parseRateLimit(c, nil, "default")
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency, err := parseConcurrency(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &proxyConfig{
+		defaultRoute: &route{
+			name:            "default",
+			host:            u,
+			preserveHost:    preserveHost,
+			hasPreserveHost: hasPreserveHost,
+			rewrite:         rewrite,
+			canary:          canary,
+			mirror:          mirror,
+			forwarded:       forwarded,
+			requestHeaders:  reqRules,
+			responseHeaders: respRules,
+			ipAccess:        ipAccess,
+			limits:          limits,
+			forwardAuth:     forwardAuth,
+			jwt:             jwt,
+			basicAuth:       basicAuth,
+			signing:         signing,
+			rateLimit:       rateLimit,
+			concurrency:     concurrency,
+		},
+		trustedProxies:  trusted,
+		requestIDHeader: requestIDHeader,
+		tracer:          tracer,
+		metrics:         metricsConf,
+		accessLog:       accessLog,
+		capture:         capture,
+		errorPages:      errorPages,
+	}
+
+	routes, err := parseRoutes(c, pc.defaultRoute)
+	if err != nil {
+		return nil, err
+	}
+	pc.routes = routes
+	return pc, nil
+}
+
+// storeConfig parses the raw config and keeps the parsed version
+// in the config map, replacing any previous parsed config. This is
+// what happens when tupi (re)loads the config.
+func storeConfig(c map[string]any) error {
+	pc, err := parseConfig(c)
+	if err != nil {
+		return err
+	}
+	if pc.metrics != nil && pc.metrics.listen != "" {
+		err := startMetricsListener(pc.metrics.listen)
+		if err != nil {
+			return fmt.Errorf("%w: %w", BadMetricsError, err)
+		}
+	}
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	c[confKey] = pc
+	return nil
+}
+
+// getProxyConfig returns the parsed config for a raw config. If the
+// config was not parsed yet it is parsed and stored.
+func getProxyConfig(conf *map[string]any) (*proxyConfig, error) {
+	if conf == nil || *conf == nil {
+		return nil, MissingConfigError
+	}
+	c := *conf
+	confMutex.RLock()
+	pc, ok := c[confKey].(*proxyConfig)
+	confMutex.RUnlock()
+	if ok {
+		return pc, nil
+	}
+
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	if pc, ok := c[confKey].(*proxyConfig); ok {
+		return pc, nil
+	}
+	pc, err := parseConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	c[confKey] = pc
+	return pc, nil
+}
+
+// helpers to read values from the raw config. Values come from
+// a toml file so numbers may be int64 or float64 and lists are []any.
+
+func getString(c map[string]any, key string) (string, bool, error) {
+	v, exists := c[key]
+	if !exists {
+		return "", false, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", true, fmt.Errorf("%w: %s must be a string", BadConfigValue, key)
+	}
+	return s, true, nil
+}
+
+func getBool(c map[string]any, key string) (bool, bool, error) {
+	v, exists := c[key]
+	if !exists {
+		return false, false, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, true, fmt.Errorf("%w: %s must be a boolean", BadConfigValue, key)
+	}
+	return b, true, nil
+}
+
+func getInt(c map[string]any, key string) (int64, bool, error) {
+	v, exists := c[key]
+	if !exists {
+		return 0, false, nil
+	}
+	switch n := v.(type) {
+	case int:
+		return int64(n), true, nil
+	case int64:
+		return n, true, nil
+	case float64:
+		if n == float64(int64(n)) {
+			return int64(n), true, nil
+		}
+	}
+	return 0, true, fmt.Errorf("%w: %s must be an integer", BadConfigValue, key)
+}
+
+func getFloat(c map[string]any, key string) (float64, bool, error) {
+	v, exists := c[key]
+	if !exists {
+		return 0, false, nil
+	}
+	switch n := v.(type) {
+	case int:
+		return float64(n), true, nil
+	case int64:
+		return float64(n), true, nil
+	case float64:
+		return n, true, nil
+	}
+	return 0, true, fmt.Errorf("%w: %s must be a number", BadConfigValue, key)
+}
+
+// getDuration reads a duration. Strings are parsed by time.ParseDuration
+// and numbers are taken as milliseconds.
+func getDuration(c map[string]any, key string) (time.Duration, bool, error) {
+	v, exists := c[key]
+	if !exists {
+		return 0, false, nil
+	}
+	err := fmt.Errorf("%w: %s must be a duration", BadConfigValue, key)
+	if s, ok := v.(string); ok {
+		d, perr := time.ParseDuration(s)
+		if perr != nil {
+			return 0, true, err
+		}
+		return d, true, nil
+	}
+	ms, _, ierr := getInt(c, key)
+	if ierr != nil {
+		return 0, true, err
+	}
+	return time.Duration(ms) * time.Millisecond, true, nil
+}
+
+func getStringList(c map[string]any, key string) ([]string, bool, error) {
+	v, exists := c[key]
+	if !exists {
+		return nil, false, nil
+	}
+	err := fmt.Errorf("%w: %s must be a list of strings", BadConfigValue, key)
+	switch l := v.(type) {
+	case []string:
+		return l, true, nil
+	case []any:
+		r := make([]string, 0, len(l))
+		for _, i := range l {
+			s, ok := i.(string)
+			if !ok {
+				return nil, true, err
+			}
+			r = append(r, s)
+		}
+		return r, true, nil
+	}
+	return nil, true, err
+}
+
+func getMap(c map[string]any, key string) (map[string]any, bool, error) {
+	v, exists := c[key]
+	if !exists {
+		return nil, false, nil
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, true, fmt.Errorf("%w: %s must be a table", BadConfigValue, key)
+	}
+	return m, true, nil
+}
+
+func getMapList(c map[string]any, key string) ([]map[string]any, bool, error) {
+	v, exists := c[key]
+	if !exists {
+		return nil, false, nil
+	}
+	err := fmt.Errorf("%w: %s must be a list of tables", BadConfigValue, key)
+	switch l := v.(type) {
+	case []map[string]any:
+		return l, true, nil
+	case []any:
+		r := make([]map[string]any, 0, len(l))
+		for _, i := range l {
+			m, ok := i.(map[string]any)
+			if !ok {
+				return nil, true, err
+			}
+			r = append(r, m)
+		}
+		return r, true, nil
+	}
+	return nil, true, err
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGetProxyConfig(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{
+			"nil config",
+			nil,
+			MissingConfigError,
+		},
+		{
+			"bad config",
+			map[string]any{"host": 1},
+			BadHostError,
+		},
+		{
+			"ok",
+			map[string]any{"host": "http://host.bla"},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pc, err := getProxyConfig(&test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+			if err != nil {
+				return
+			}
+			again, _ := getProxyConfig(&test.conf)
+			if again != pc {
+				t.Fatalf("config parsed twice")
+			}
+		})
+	}
+}
+
+func TestConfigHelpers(t *testing.T) {
+	c := map[string]any{
+		"s":   "x",
+		"i":   int64(1),
+		"f":   1.5,
+		"fi":  2.0,
+		"l":   []any{"a", "b"},
+		"bl":  []any{"a", 1},
+		"m":   map[string]any{},
+		"ml":  []any{map[string]any{}},
+		"bml": []any{1},
+	}
+	if _, _, err := getString(c, "i"); !errors.Is(err, BadConfigValue) {
+		t.Fatalf("bad string err %v", err)
+	}
+	if _, _, err := getBool(c, "s"); !errors.Is(err, BadConfigValue) {
+		t.Fatalf("bad bool err %v", err)
+	}
+	if _, _, err := getInt(c, "f"); !errors.Is(err, BadConfigValue) {
+		t.Fatalf("bad int err %v", err)
+	}
+	if i, _, _ := getInt(c, "fi"); i != 2 {
+		t.Fatalf("bad int %d", i)
+	}
+	if f, _, _ := getFloat(c, "i"); f != 1 {
+		t.Fatalf("bad float %f", f)
+	}
+	if l, _, _ := getStringList(c, "l"); len(l) != 2 {
+		t.Fatalf("bad list %v", l)
+	}
+	if _, _, err := getStringList(c, "bl"); !errors.Is(err, BadConfigValue) {
+		t.Fatalf("bad list err %v", err)
+	}
+	if _, _, err := getMap(c, "s"); !errors.Is(err, BadConfigValue) {
+		t.Fatalf("bad map err %v", err)
+	}
+	if l, _, _ := getMapList(c, "ml"); len(l) != 1 {
+		t.Fatalf("bad map list %v", l)
+	}
+	if _, _, err := getMapList(c, "bml"); !errors.Is(err, BadConfigValue) {
+		t.Fatalf("bad map list err %v", err)
+	}
+	if _, exists, _ := getString(c, "nope"); exists {
+		t.Fatalf("missing key exists")
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var BadErrorPagesError error = errors.New("[tupi-proxy] Bad error pages config")
+
+const (
+	problemJSONContentType = "application/problem+json"
+	defaultPageContentType = "text/html; charset=utf-8"
+)
+
+// errorPages are the bodies of the error responses.
+type errorPages struct {
+	// keys are status codes like "502", classes like "5xx" or "default"
+	pages map[string]*errorPage
+	// answer with problem+json if the client prefers it
+	problemJSON bool
+	// replace the body of the upstream 5xx responses
+	intercept bool
+}
+
+// errorPage is a static body or a template.
+type errorPage struct {
+	contentType string
+	body        []byte
+	tmpl        *template.Template
+}
+
+// errorPageData is what the templates get.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	RequestID  string
+	Method     string
+	Path       string
+	Route      string
+}
+
+// problem is a RFC 9457 problem details object.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+func (ep *errorPages) page(status int) *errorPage {
+	if p, ok := ep.pages[strconv.Itoa(status)]; ok {
+		return p
+	}
+	if p, ok := ep.pages[strconv.Itoa(status/100)+"xx"]; ok {
+		return p
+	}
+	return ep.pages["default"]
+}
+
+// render returns the content type and the body of an error response.
+// ok is false if there is nothing configured for the status.
+func (ep *errorPages) render(r *http.Request, info *requestInfo,
+	status int, detail string) (string, []byte, bool) {
+	if ep.problemJSON && prefersProblemJSON(r.Header.Get("Accept")) {
+		b, _ := json.Marshal(problem{
+			Type:      "about:blank",
+			Title:     http.StatusText(status),
+			Status:    status,
+			Detail:    detail,
+			Instance:  info.path,
+			RequestID: info.requestID,
+		})
+		return problemJSONContentType, b, true
+	}
+	p := ep.page(status)
+	if p == nil {
+		return "", nil, false
+	}
+	if p.tmpl == nil {
+		return p.contentType, p.body, true
+	}
+	var b bytes.Buffer
+	err := p.tmpl.Execute(&b, errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		RequestID:  info.requestID,
+		Method:     info.method,
+		Path:       info.path,
+		Route:      info.route,
+	})
+	if err != nil {
+		requestLogger(info).Error("error page template error", "error", err)
+		return "", nil, false
+	}
+	return p.contentType, b.Bytes(), true
+}
+
+// prefersProblemJSON returns true if the client accepts json with a
+// quality not lower than html. Only explicit json types count, so
+// clients sending */* get the html page.
+func prefersProblemJSON(accept string) bool {
+	var qJSON, qHTML float64
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		switch mt {
+		case problemJSONContentType, "application/json":
+			qJSON = max(qJSON, q)
+		case "text/html", "text/*", "*/*":
+			qHTML = max(qHTML, q)
+		}
+	}
+	return qJSON > 0 && qJSON >= qHTML
+}
+
+// writeError writes an error response generated by the proxy.
+func writeError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	info := getRequestInfo(r)
+	if info.errorPages != nil {
+		contentType, body, ok := info.errorPages.render(r, info, status, detail)
+		if ok {
+			w.Header().Set("Content-Type", contentType)
+			info.responseHeaders.apply(w.Header(), info)
+			w.WriteHeader(status)
+			w.Write(body)
+			return
+		}
+	}
+	info.responseHeaders.apply(w.Header(), info)
+	w.WriteHeader(status)
+	w.Write([]byte(http.StatusText(status)))
+}
+
+// interceptResponse replaces the body of an upstream 5xx response by
+// the configured error page.
+func (ep *errorPages) interceptResponse(resp *http.Response, info *requestInfo) {
+	if !ep.intercept || resp.StatusCode < 500 {
+		return
+	}
+	contentType, body, ok := ep.render(resp.Request, info, resp.StatusCode, "")
+	if !ok {
+		return
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Transfer-Encoding")
+	resp.Header.Del("Etag")
+}
+
+// parseErrorPages parses the `errorPages` key of the config like:
+// {"pages" = {"5xx" = {"template" = "/srv/5xx.html"}}, "interceptErrors" = true}
+func parseErrorPages(c map[string]any) (*errorPages, error) {
+	raw, exists, err := getMap(c, "errorPages")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadErrorPagesError, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	ep := &errorPages{pages: map[string]*errorPage{}, problemJSON: true}
+
+	problemJSON, exists, err := getBool(raw, "problemJson")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadErrorPagesError, err)
+	}
+	if exists {
+		ep.problemJSON = problemJSON
+	}
+	ep.intercept, _, err = getBool(raw, "interceptErrors")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadErrorPagesError, err)
+	}
+
+	pages, _, err := getMap(raw, "pages")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadErrorPagesError, err)
+	}
+	for key := range pages {
+		if !validErrorPageKey(key) {
+			return nil, fmt.Errorf("%w: bad status %s", BadErrorPagesError, key)
+		}
+		rawPage, _, err := getMap(pages, key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadErrorPagesError, err)
+		}
+		p, err := parseErrorPage(rawPage)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", BadErrorPagesError, key, err)
+		}
+		ep.pages[key] = p
+	}
+	return ep, nil
+}
+
+func validErrorPageKey(key string) bool {
+	if key == "default" {
+		return true
+	}
+	if len(key) == 3 && strings.HasSuffix(key, "xx") {
+		return key[0] >= '1' && key[0] <= '5'
+	}
+	n, err := strconv.Atoi(key)
+	return err == nil && n >= 100 && n <= 599
+}
+
+func parseErrorPage(c map[string]any) (*errorPage, error) {
+	p := &errorPage{contentType: defaultPageContentType}
+	contentType, exists, err := getString(c, "contentType")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		p.contentType = contentType
+	}
+
+	file, hasFile, err := getString(c, "file")
+	if err != nil {
+		return nil, err
+	}
+	tmplFile, hasTmpl, err := getString(c, "template")
+	if err != nil {
+		return nil, err
+	}
+	if hasFile == hasTmpl {
+		return nil, fmt.Errorf("%w: needs one of file or template", BadConfigValue)
+	}
+	if hasFile {
+		p.body, err = os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	p.tmpl, err = template.ParseFiles(tmplFile)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPrefersProblemJSON(t *testing.T) {
+	var tests = []struct {
+		accept   string
+		expected bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", true},
+		{"application/problem+json", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"text/html;q=0.5, application/json", true},
+		{"application/json;q=0, */*", false},
+	}
+	for _, test := range tests {
+		if prefersProblemJSON(test.accept) != test.expected {
+			t.Fatalf("bad prefers for %s", test.accept)
+		}
+	}
+}
+
+func TestParseErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "502.html")
+	os.WriteFile(page, []byte("bad gateway"), 0644)
+	tmpl := filepath.Join(dir, "5xx.html")
+	os.WriteFile(tmpl, []byte("{{.Status}} {{.RequestID}}"), 0644)
+	badTmpl := filepath.Join(dir, "bad.html")
+	os.WriteFile(badTmpl, []byte("{{.Status"), 0644)
+
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"no error pages", map[string]any{}, nil},
+		{"not a table", map[string]any{"errorPages": "x"}, BadErrorPagesError},
+		{"bad status", map[string]any{"errorPages": map[string]any{
+			"pages": map[string]any{"999": map[string]any{"file": page}}}}, BadErrorPagesError},
+		{"no file", map[string]any{"errorPages": map[string]any{
+			"pages": map[string]any{"502": map[string]any{}}}}, BadConfigValue},
+		{"missing file", map[string]any{"errorPages": map[string]any{
+			"pages": map[string]any{"502": map[string]any{"file": "/no/file"}}}}, os.ErrNotExist},
+		{"bad template", map[string]any{"errorPages": map[string]any{
+			"pages": map[string]any{"5xx": map[string]any{"template": badTmpl}}}}, BadErrorPagesError},
+		{"bad intercept", map[string]any{"errorPages": map[string]any{
+			"interceptErrors": "yes"}}, BadErrorPagesError},
+		{"ok", map[string]any{"errorPages": map[string]any{
+			"interceptErrors": true,
+			"pages": map[string]any{
+				"502":     map[string]any{"file": page},
+				"5xx":     map[string]any{"template": tmpl},
+				"default": map[string]any{"file": page, "contentType": "text/plain"},
+			}}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseErrorPages(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestServeErrorPages(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("stack trace"))
+		}))
+	defer upstream.Close()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+	testProxy = nil
+
+	dir := t.TempDir()
+	tmpl := filepath.Join(dir, "5xx.html")
+	os.WriteFile(tmpl, []byte("<p>{{.Status}} {{.RequestID}}</p>"), 0644)
+	conf := map[string]any{
+		"host": upstream.URL,
+		"errorPages": map[string]any{
+			"interceptErrors": true,
+			"pages":           map[string]any{"5xx": map[string]any{"template": tmpl}},
+		},
+		"routes": []any{
+			map[string]any{"pathPrefix": "/closed", "host": "http://" + closed},
+		},
+	}
+
+	var tests = []struct {
+		name        string
+		path        string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"intercepted", "/", "text/html", 500, defaultPageContentType},
+		{"proxy error", "/closed", "", 503, defaultPageContentType},
+		{"problem json", "/closed", "application/json", 503, problemJSONContentType},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", test.path, nil)
+			r.Header.Set("Accept", test.accept)
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+			if w.Header().Get("Content-Type") != test.contentType {
+				t.Fatalf("bad content type %s", w.Header().Get("Content-Type"))
+			}
+			id := w.Header().Get(defaultRequestIDHeader)
+			if test.contentType == problemJSONContentType {
+				var p problem
+				json.Unmarshal(w.Body.Bytes(), &p)
+				if p.Status != test.status || p.RequestID != id || p.Instance != test.path {
+					t.Fatalf("bad problem %s", w.Body.String())
+				}
+				return
+			}
+			expected := "<p>" + strconv.Itoa(test.status) + " " + id + "</p>"
+			if w.Body.String() != expected {
+				t.Fatalf("bad body %s", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var BadForwardAuthError error = errors.New("[tupi-proxy] Bad forward auth config")
+
+const (
+	defaultForwardAuthTimeout   = 5 * time.Second
+	defaultForwardAuthCacheSize = 10000
+	// max size of the auth service response body sent to the client
+	maxAuthBody = 64 * 1024
+)
+
+// forwardAuth asks an auth service if a request may pass. The auth
+// service gets a subrequest with some headers of the request and:
+// 2xx allows the request, 401 and 403 are returned to the client and
+// anything else denies the request.
+type forwardAuth struct {
+	url    *url.URL
+	method string
+	// client headers sent to the auth service
+	requestHeaders []string
+	// auth service headers copied to the upstream request
+	responseHeaders []string
+	// auth service header with the authenticated identity
+	identityHeader string
+	timeout        time.Duration
+	client         *http.Client
+
+	cacheTTL  time.Duration
+	cacheKey  []string
+	cacheSize int
+	mu        sync.Mutex
+	cache     map[string]*authDecision
+}
+
+// authDecision is the answer of the auth service.
+type authDecision struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (d *authDecision) allowed() bool {
+	return d.status >= 200 && d.status < 300
+}
+
+// authorize checks the request with the auth service. If the request
+// is allowed it returns true and the request headers are updated. If
+// not the response was already written.
+func (fa *forwardAuth) authorize(w http.ResponseWriter, r *http.Request, info *requestInfo) bool {
+	// the client can't send the headers that come from the auth service
+	for _, h := range fa.responseHeaders {
+		r.Header.Del(h)
+	}
+	key, cacheable := fa.key(r, info)
+	d := fa.cached(key, cacheable)
+	if d == nil {
+		var err error
+		d, err = fa.ask(r, info)
+		if err != nil {
+			requestLogger(info).Error("forward auth error", "error", err)
+			writeError(w, r, http.StatusInternalServerError, "auth service error")
+			return false
+		}
+		if cacheable && (d.allowed() || d.status == http.StatusUnauthorized ||
+			d.status == http.StatusForbidden) {
+			fa.store(key, d)
+		}
+	}
+
+	if d.allowed() {
+		for _, h := range fa.responseHeaders {
+			for _, v := range d.header.Values(h) {
+				r.Header.Add(h, v)
+			}
+		}
+		if fa.identityHeader != "" {
+			info.identity = d.header.Get(fa.identityHeader)
+		}
+		return true
+	}
+
+	if d.status == http.StatusUnauthorized || d.status == http.StatusForbidden {
+		for _, h := range []string{"Www-Authenticate", "Content-Type", "Location"} {
+			if v := d.header.Get(h); v != "" {
+				w.Header().Set(h, v)
+			}
+		}
+		if len(d.body) == 0 {
+			writeError(w, r, d.status, "")
+			return false
+		}
+		info.responseHeaders.apply(w.Header(), info)
+		w.WriteHeader(d.status)
+		w.Write(d.body)
+		return false
+	}
+	requestLogger(info).Error("forward auth denied", "status", d.status)
+	writeError(w, r, http.StatusInternalServerError, "auth service error")
+	return false
+}
+
+// ask sends the subrequest to the auth service.
+func (fa *forwardAuth) ask(r *http.Request, info *requestInfo) (*authDecision, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), fa.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, fa.method, fa.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range fa.requestHeaders {
+		for _, v := range r.Header.Values(h) {
+			req.Header.Add(h, v)
+		}
+	}
+	// proto and host are resolved with the trusted proxies
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", info.proto)
+	req.Header.Set("X-Forwarded-Host", info.host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", info.clientIP)
+	if info.requestIDHeader != "" && info.requestID != "" {
+		req.Header.Set(info.requestIDHeader, info.requestID)
+	}
+	resp, err := fa.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAuthBody))
+	if err != nil {
+		return nil, err
+	}
+	return &authDecision{status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// key returns the cache key for the request. The auth service may
+// decide by the method and the uri so they are part of the key. The
+// request is not cacheable if the cache is disabled or if it has none
+// of the cacheKey headers.
+func (fa *forwardAuth) key(r *http.Request, info *requestInfo) (string, bool) {
+	if fa.cacheTTL <= 0 {
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString(info.route + "\x00" + r.Method + "\x00" + r.URL.RequestURI() + "\x01")
+	found := false
+	for _, h := range fa.cacheKey {
+		for _, v := range r.Header.Values(h) {
+			found = true
+			b.WriteString(v)
+			b.WriteByte(0)
+		}
+		b.WriteByte(1)
+	}
+	return b.String(), found
+}
+
+func (fa *forwardAuth) cached(key string, cacheable bool) *authDecision {
+	if !cacheable {
+		return nil
+	}
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	d, ok := fa.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(d.expires) {
+		delete(fa.cache, key)
+		return nil
+	}
+	return d
+}
+
+func (fa *forwardAuth) store(key string, d *authDecision) {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	now := time.Now()
+	if len(fa.cache) >= fa.cacheSize {
+		for k, old := range fa.cache {
+			if now.After(old.expires) {
+				delete(fa.cache, k)
+			}
+		}
+		// still full, make room for the new decision
+		for k := range fa.cache {
+			if len(fa.cache) < fa.cacheSize {
+				break
+			}
+			delete(fa.cache, k)
+		}
+	}
+	d.expires = now.Add(fa.cacheTTL)
+	fa.cache[key] = d
+}
+
+// parseForwardAuth parses the `forwardAuth` key of the config like:
+// {"url" = "http://auth:9000/check", "requestHeaders" = ["Authorization"],
+// "responseHeaders" = ["X-User-Id"], "cacheTtl" = "10s", "cacheKey" = ["Authorization"]}
+// If there is no forwardAuth key the inherited one is returned.
+func parseForwardAuth(c map[string]any, inherited *forwardAuth) (*forwardAuth, error) {
+	raw, exists, err := getMap(c, "forwardAuth")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadForwardAuthError, err)
+	}
+	if !exists {
+		return inherited, nil
+	}
+	disabled, _, err := getBool(raw, "disabled")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadForwardAuthError, err)
+	}
+	if disabled {
+		return nil, nil
+	}
+
+	fa := &forwardAuth{
+		method:    http.MethodGet,
+		timeout:   defaultForwardAuthTimeout,
+		cacheSize: defaultForwardAuthCacheSize,
+		cache:     map[string]*authDecision{},
+	}
+	rawURL, _, err := getString(raw, "url")
+	if err != nil || rawURL == "" {
+		return nil, fmt.Errorf("%w: needs an url", BadForwardAuthError)
+	}
+	fa.url, err = url.Parse(rawURL)
+	if err != nil || (fa.url.Scheme != "http" && fa.url.Scheme != "https") {
+		return nil, fmt.Errorf("%w: bad url %s", BadForwardAuthError, rawURL)
+	}
+
+	method, exists, err := getString(raw, "method")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadForwardAuthError, err)
+	}
+	if exists {
+		fa.method = strings.ToUpper(method)
+	}
+
+	lists := []struct {
+		key  string
+		dest *[]string
+	}{
+		{"requestHeaders", &fa.requestHeaders},
+		{"responseHeaders", &fa.responseHeaders},
+		{"cacheKey", &fa.cacheKey},
+	}
+	for _, l := range lists {
+		*l.dest, _, err = getStringList(raw, l.key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadForwardAuthError, err)
+		}
+	}
+
+	fa.identityHeader, _, err = getString(raw, "identityHeader")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadForwardAuthError, err)
+	}
+	if fa.identityHeader != "" && !containsHeader(fa.responseHeaders, fa.identityHeader) {
+		// the identity also goes to the upstream
+		fa.responseHeaders = append(fa.responseHeaders, fa.identityHeader)
+	}
+
+	timeout, exists, err := getDuration(raw, "timeout")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadForwardAuthError, err)
+	}
+	if exists {
+		fa.timeout = timeout
+	}
+	fa.client = &http.Client{
+		// the redirects are answers for the client
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	fa.cacheTTL, _, err = getDuration(raw, "cacheTtl")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadForwardAuthError, err)
+	}
+	if fa.cacheTTL > 0 && len(fa.cacheKey) == 0 {
+		return nil, fmt.Errorf("%w: cacheTtl needs a cacheKey", BadForwardAuthError)
+	}
+	size, exists, err := getInt(raw, "cacheSize")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadForwardAuthError, err)
+	}
+	if exists {
+		if size <= 0 {
+			return nil, fmt.Errorf("%w: cacheSize must be positive", BadForwardAuthError)
+		}
+		fa.cacheSize = int(size)
+	}
+	return fa, nil
+}
+
+func containsHeader(headers []string, h string) bool {
+	for _, v := range headers {
+		if strings.EqualFold(v, h) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,298 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newAuthServer(t *testing.T, calls *atomic.Int64) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			switch r.Header.Get("Authorization") {
+			case "good":
+				if r.Header.Get("X-Forwarded-Uri") != "/private?a=1" ||
+					r.Header.Get("X-Forwarded-Method") != "POST" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("X-User-Id", "joe")
+				w.Header().Set("X-Other", "not copied")
+			case "forbidden":
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("go away"))
+			case "":
+				w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+			default:
+				w.WriteHeader(http.StatusTeapot)
+			}
+		}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestServeForwardAuth(t *testing.T) {
+	var calls atomic.Int64
+	auth := newAuthServer(t, &calls)
+	var p *myProxy
+	testProxy = func(rt *route, host string) httpProxy {
+		p = &myProxy{route: rt, host: host}
+		return p
+	}
+	defer func() { testProxy = nil }()
+
+	conf := map[string]any{
+		"host": "http://v1.bla",
+		"forwardAuth": map[string]any{
+			"url":            auth.URL,
+			"requestHeaders": []any{"Authorization"},
+			"identityHeader": "X-User-Id",
+			"cacheTtl":       "1m",
+			"cacheKey":       []any{"Authorization"},
+		},
+		"routes": []any{
+			map[string]any{"pathPrefix": "/public", "forwardAuth": map[string]any{"disabled": true}},
+		},
+	}
+
+	var tests = []struct {
+		name   string
+		path   string
+		auth   string
+		status int
+		calls  int64
+	}{
+		{"allowed", "/private?a=1", "good", 200, 1},
+		{"cached", "/private?a=1", "good", 200, 1},
+		{"unauthorized", "/private?a=1", "", 401, 2},
+		{"forbidden", "/private?a=1", "forbidden", 403, 3},
+		{"fail closed", "/private?a=1", "bad", 500, 4},
+		{"not cached failure", "/private?a=1", "bad", 500, 5},
+		{"public", "/public", "", 200, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p = nil
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", test.path, nil)
+			if test.auth != "" {
+				r.Header.Set("Authorization", test.auth)
+			}
+			// the client can't send the identity
+			r.Header.Set("X-User-Id", "admin")
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+			if calls.Load() != test.calls {
+				t.Fatalf("bad calls %d", calls.Load())
+			}
+			switch test.status {
+			case 200:
+				if test.path == "/public" {
+					return
+				}
+				if v := p.pr.Out.Header.Values("X-User-Id"); len(v) != 1 || v[0] != "joe" {
+					t.Fatalf("bad user id %v", v)
+				}
+				if p.pr.Out.Header.Get("X-Other") != "" {
+					t.Fatalf("header copied")
+				}
+				if getRequestInfo(p.pr.In).identity != "joe" {
+					t.Fatalf("bad identity")
+				}
+			case 401:
+				if w.Header().Get("WWW-Authenticate") != `Basic realm="test"` {
+					t.Fatalf("bad www-authenticate %s", w.Header().Get("WWW-Authenticate"))
+				}
+			case 403:
+				if w.Body.String() != "go away" {
+					t.Fatalf("bad body %s", w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestServeForwardAuthTrustedProxy(t *testing.T) {
+	var got http.Header
+	auth := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header.Clone()
+		}))
+	defer auth.Close()
+	testProxy = func(rt *route, host string) httpProxy {
+		return &myProxy{route: rt, host: host}
+	}
+	defer func() { testProxy = nil }()
+
+	conf := map[string]any{
+		"host":           "http://v1.bla",
+		"trustedProxies": []any{"10.0.0.0/8"},
+		"forwardAuth":    map[string]any{"url": auth.URL},
+	}
+	var tests = []struct {
+		name       string
+		remoteAddr string
+		expected   map[string]string
+	}{
+		{"trusted", "10.0.0.1:1234", map[string]string{
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "public.example",
+			"X-Forwarded-For":   "1.2.3.4",
+		}},
+		{"spoofed", "5.6.7.8:1234", map[string]string{
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  "example.com",
+			"X-Forwarded-For":   "5.6.7.8",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = test.remoteAddr
+			r.Header.Set("X-Forwarded-Proto", "https")
+			r.Header.Set("X-Forwarded-Host", "public.example")
+			r.Header.Set("X-Forwarded-For", "1.2.3.4")
+			Serve(w, r, &conf)
+			if w.Code != 200 {
+				t.Fatalf("bad code %d", w.Code)
+			}
+			for k, v := range test.expected {
+				if got.Get(k) != v {
+					t.Fatalf("bad %s: %s", k, got.Get(k))
+				}
+			}
+		})
+	}
+}
+
+func TestServeForwardAuthCacheByPath(t *testing.T) {
+	var calls atomic.Int64
+	auth := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			if r.Header.Get("X-Forwarded-Uri") != "/public" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		}))
+	defer auth.Close()
+	testProxy = func(rt *route, host string) httpProxy {
+		return &myProxy{route: rt, host: host}
+	}
+	defer func() { testProxy = nil }()
+
+	conf := map[string]any{
+		"host": "http://v1.bla",
+		"forwardAuth": map[string]any{
+			"url":            auth.URL,
+			"requestHeaders": []any{"Authorization"},
+			"cacheTtl":       "1m",
+			"cacheKey":       []any{"Authorization"},
+		},
+	}
+	var tests = []struct {
+		name   string
+		path   string
+		auth   string
+		status int
+		calls  int64
+	}{
+		{"public", "/public", "token", 200, 1},
+		{"public cached", "/public", "token", 200, 1},
+		{"admin same token", "/admin", "token", 403, 2},
+		{"anonymous public", "/public", "", 200, 3},
+		{"anonymous admin", "/admin", "", 403, 4},
+		{"anonymous not cached", "/public", "", 200, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", test.path, nil)
+			if test.auth != "" {
+				r.Header.Set("Authorization", test.auth)
+			}
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+			if calls.Load() != test.calls {
+				t.Fatalf("bad calls %d", calls.Load())
+			}
+		})
+	}
+}
+
+func TestForwardAuthCache(t *testing.T) {
+	fa := &forwardAuth{
+		cacheTTL:  time.Minute,
+		cacheKey:  []string{"Authorization"},
+		cacheSize: 2,
+		cache:     map[string]*authDecision{},
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		fa.store(k, &authDecision{status: 200})
+	}
+	if len(fa.cache) != 2 {
+		t.Fatalf("bad cache size %d", len(fa.cache))
+	}
+	if fa.cached("c", true) == nil {
+		t.Fatalf("new decision not cached")
+	}
+	fa.cache["c"].expires = time.Now().Add(-time.Second)
+	if fa.cached("c", true) != nil {
+		t.Fatalf("expired decision returned")
+	}
+}
+
+func TestParseForwardAuth(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"not a table", map[string]any{"forwardAuth": "x"}, BadForwardAuthError},
+		{"no url", map[string]any{"forwardAuth": map[string]any{}}, BadForwardAuthError},
+		{"bad url", map[string]any{"forwardAuth": map[string]any{
+			"url": "ftp://auth"}}, BadForwardAuthError},
+		{"bad headers", map[string]any{"forwardAuth": map[string]any{
+			"url": "http://auth", "requestHeaders": "Cookie"}}, BadForwardAuthError},
+		{"ttl without key", map[string]any{"forwardAuth": map[string]any{
+			"url": "http://auth", "cacheTtl": "10s"}}, BadForwardAuthError},
+		{"bad cache size", map[string]any{"forwardAuth": map[string]any{
+			"url": "http://auth", "cacheSize": 0}}, BadForwardAuthError},
+		{"ok", map[string]any{"forwardAuth": map[string]any{
+			"url": "http://auth/check", "method": "post", "timeout": "1s"}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseForwardAuth(test.conf, nil)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var BadForwardedError error = errors.New("[tupi-proxy] Bad forwarded headers config")
+
+// forwardedHeaders tells which headers with information about the client
+// request are sent to the upstream.
+type forwardedHeaders struct {
+	// X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Port
+	xForwarded bool
+	// RFC 7239 Forwarded
+	forwarded bool
+}
+
+// forwardingHeaders are the headers removed from the client request
+// before the forwarding headers are set.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Port",
+}
+
+// setForwarded sets the forwarding headers in the request sent to the
+// upstream. Forwarding headers sent by the client are always removed and
+// only the values sent by a trusted proxy are kept.
+func (fh forwardedHeaders) setForwarded(out *http.Request, in *http.Request) {
+	for _, h := range forwardingHeaders {
+		out.Header.Del(h)
+	}
+	if !fh.xForwarded && !fh.forwarded {
+		return
+	}
+
+	info := getRequestInfo(in)
+	xff, elements := forwardedChain(info)
+	if fh.xForwarded {
+		xff = append(xff, info.peerIP)
+		out.Header.Set("X-Forwarded-For", strings.Join(xff, ", "))
+		out.Header.Set("X-Forwarded-Proto", info.proto)
+		out.Header.Set("X-Forwarded-Host", info.host)
+		out.Header.Set("X-Forwarded-Port", info.port)
+	}
+	if fh.forwarded {
+		// the same proto and host of the X-Forwarded headers, resolved
+		// with the trusted proxies
+		elements = append(elements, forwardedElement(info.peerIP, info.host, info.proto))
+		out.Header.Set("Forwarded", strings.Join(elements, ", "))
+	}
+}
+
+// forwardedChain returns the hops before the peer, sent by a trusted
+// proxy, as X-Forwarded-For values and as Forwarded elements. Both come
+// from the chain used to resolve the client ip: X-Forwarded-For or, if
+// the proxy did not send it, Forwarded.
+func forwardedChain(info *requestInfo) ([]string, []string) {
+	var xff, elements []string
+	if len(info.forwardedFor) == 0 {
+		for _, node := range forwardedForNodes(info.forwarded) {
+			if ip := normalizeIP(node); ip != "" {
+				node = ip
+			}
+			xff = append(xff, node)
+		}
+		return xff, append(elements, info.forwarded...)
+	}
+	for _, node := range info.forwardedFor {
+		if ip := normalizeIP(node); ip != "" {
+			node = forwardedNode(ip)
+		} else {
+			node = forwardedValue(node)
+		}
+		elements = append(elements, "for="+node)
+	}
+	return append(xff, info.forwardedFor...), elements
+}
+
+// forwardedElement returns a forwarded-element as in RFC 7239
+func forwardedElement(clientIP, host, proto string) string {
+	var parts []string
+	if clientIP != "" {
+		parts = append(parts, "for="+forwardedNode(clientIP))
+	}
+	if host != "" {
+		parts = append(parts, "host="+forwardedValue(host))
+	}
+	parts = append(parts, "proto="+proto)
+	return strings.Join(parts, ";")
+}
+
+// forwardedNode returns the node for an ip. IPv6 addresses must be
+// enclosed in brackets and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes the value if it is not a token.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// remoteIP returns the ip of the client connection
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestPort returns the port the client used to connect.
+func requestPort(r *http.Request, proto string) string {
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		return port
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+			return port
+		}
+	}
+	if proto == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// parseForwardedHeaders parses the `forwardedHeaders` key. It may be
+// "x-forwarded", "forwarded", "both" or "none".
+func parseForwardedHeaders(c map[string]any, fh forwardedHeaders) (forwardedHeaders, error) {
+	v, exists, err := getString(c, "forwardedHeaders")
+	if err != nil {
+		return fh, fmt.Errorf("%w: %w", BadForwardedError, err)
+	}
+	if !exists {
+		return fh, nil
+	}
+	switch strings.ToLower(v) {
+	case "x-forwarded":
+		return forwardedHeaders{xForwarded: true}, nil
+	case "forwarded":
+		return forwardedHeaders{forwarded: true}, nil
+	case "both":
+		return forwardedHeaders{xForwarded: true, forwarded: true}, nil
+	case "none":
+		return forwardedHeaders{}, nil
+	}
+	return fh, fmt.Errorf(
+		"%w: must be x-forwarded, forwarded, both or none", BadForwardedError)
+}
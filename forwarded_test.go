@@ -0,0 +1,180 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseForwardedHeaders(t *testing.T) {
+	var tests = []struct {
+		name     string
+		conf     map[string]any
+		expected forwardedHeaders
+		err      error
+	}{
+		{"default", map[string]any{}, forwardedHeaders{}, nil},
+		{"bad type", map[string]any{"forwardedHeaders": true}, forwardedHeaders{}, BadForwardedError},
+		{"bad value", map[string]any{"forwardedHeaders": "x"}, forwardedHeaders{}, BadForwardedError},
+		{"x-forwarded", map[string]any{"forwardedHeaders": "X-Forwarded"},
+			forwardedHeaders{xForwarded: true}, nil},
+		{"forwarded", map[string]any{"forwardedHeaders": "forwarded"},
+			forwardedHeaders{forwarded: true}, nil},
+		{"both", map[string]any{"forwardedHeaders": "both"},
+			forwardedHeaders{xForwarded: true, forwarded: true}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fh, err := parseForwardedHeaders(test.conf, forwardedHeaders{})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+			if fh != test.expected {
+				t.Fatalf("bad forwarded headers %v", fh)
+			}
+		})
+	}
+}
+
+func TestSetForwarded(t *testing.T) {
+	var tests = []struct {
+		name       string
+		fh         forwardedHeaders
+		remoteAddr string
+		host       string
+		tls        bool
+		localAddr  net.Addr
+		expected   map[string]string
+	}{
+		{
+			"none strips client headers",
+			forwardedHeaders{},
+			"1.2.3.4:5678",
+			"the.site",
+			false,
+			nil,
+			map[string]string{"X-Forwarded-For": "", "Forwarded": ""},
+		},
+		{
+			"x-forwarded",
+			forwardedHeaders{xForwarded: true},
+			"1.2.3.4:5678",
+			"the.site",
+			true,
+			nil,
+			map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "the.site",
+				"X-Forwarded-Port":  "443",
+				"Forwarded":         "",
+			},
+		},
+		{
+			"port from host",
+			forwardedHeaders{xForwarded: true},
+			"1.2.3.4:5678",
+			"the.site:8080",
+			false,
+			nil,
+			map[string]string{"X-Forwarded-Port": "8080"},
+		},
+		{
+			"port from local addr",
+			forwardedHeaders{xForwarded: true},
+			"1.2.3.4:5678",
+			"the.site",
+			false,
+			&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8081},
+			map[string]string{"X-Forwarded-Port": "8081"},
+		},
+		{
+			"forwarded ipv6",
+			forwardedHeaders{forwarded: true},
+			"[2001:db8::1]:5678",
+			"the.site:8080",
+			false,
+			nil,
+			map[string]string{
+				"Forwarded":       `for="[2001:db8::1]";host="the.site:8080";proto=http`,
+				"X-Forwarded-For": "",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in, _ := http.NewRequest("GET", "http://the.site/", nil)
+			in.RemoteAddr = test.remoteAddr
+			in.Host = test.host
+			in.Header.Set("X-Forwarded-For", "6.6.6.6")
+			in.Header.Set("Forwarded", "for=6.6.6.6")
+			if test.tls {
+				in.TLS = &tls.ConnectionState{}
+			}
+			if test.localAddr != nil {
+				ctx := context.WithValue(in.Context(), http.LocalAddrContextKey, test.localAddr)
+				in = in.WithContext(ctx)
+			}
+			out := in.Clone(in.Context())
+			test.fh.setForwarded(out, in)
+			for k, v := range test.expected {
+				if out.Header.Get(k) != v {
+					t.Fatalf("bad %s: %s", k, out.Header.Get(k))
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedHttpAndWs(t *testing.T) {
+	u, _ := url.Parse("http://up.bla")
+	rt := &route{host: u, forwarded: forwardedHeaders{xForwarded: true, forwarded: true}}
+
+	in, _ := http.NewRequest("GET", "http://the.site/", nil)
+	in.RemoteAddr = "1.2.3.4:5678"
+	pr := &httputil.ProxyRequest{In: in, Out: in.Clone(in.Context())}
+	rewriteRequest(pr, rt, "")
+	if pr.Out.Header.Get("X-Forwarded-For") != "1.2.3.4" {
+		t.Fatalf("bad http x-forwarded-for %s", pr.Out.Header.Get("X-Forwarded-For"))
+	}
+
+	h := newHijacker(false)
+	testDial = func(n, a string) (net.Conn, error) {
+		return h.destConn, nil
+	}
+	defer func() {
+		testDial = nil
+	}()
+	p := &wsProxy{route: rt}
+	p.ServeHTTP(h, in)
+	written := string(h.destConn.(*bufferConn).written())
+	if !strings.Contains(written, "X-Forwarded-For: 1.2.3.4\r\n") ||
+		!strings.Contains(written, "Forwarded: for=1.2.3.4;host=the.site;proto=http\r\n") {
+		t.Fatalf("bad ws request %s", written)
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/jucacrispim/tupi-proxy
 
-go 1.23
+go 1.24.0
+
+require golang.org/x/crypto v0.41.0
@@ -0,0 +1,201 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var BadHeaderRulesError error = errors.New("[tupi-proxy] Bad header rules config")
+
+type headerOpKind int
+
+const (
+	headerRename headerOpKind = iota
+	headerRemove
+	headerSet
+	headerAdd
+)
+
+type headerOp struct {
+	kind    headerOpKind
+	name    string
+	newName string
+	value   *valueTemplate
+}
+
+// headerRules are the changes done to the headers of a request or
+// response, in order.
+type headerRules []headerOp
+
+func (hr headerRules) apply(h http.Header, info *requestInfo) {
+	for _, op := range hr {
+		switch op.kind {
+		case headerRename:
+			values := h.Values(op.name)
+			if len(values) == 0 {
+				continue
+			}
+			h.Del(op.name)
+			for _, v := range values {
+				h.Add(op.newName, v)
+			}
+		case headerRemove:
+			h.Del(op.name)
+		case headerSet:
+			h.Set(op.name, op.value.render(info))
+		case headerAdd:
+			h.Add(op.name, op.value.render(info))
+		}
+	}
+}
+
+// valueTemplate is a header value that may reference information about
+// the request like {clientIp} or {path}
+type valueTemplate struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal string
+	// if not empty the part is a variable
+	variable string
+}
+
+var templateVars = map[string]func(*requestInfo) string{
+	"clientIp":  func(i *requestInfo) string { return i.clientIP },
+	"host":      func(i *requestInfo) string { return i.host },
+	"scheme":    func(i *requestInfo) string { return i.proto },
+	"method":    func(i *requestInfo) string { return i.method },
+	"path":      func(i *requestInfo) string { return i.path },
+	"route":     func(i *requestInfo) string { return i.route },
+	"requestId": func(i *requestInfo) string { return i.requestID },
+}
+
+func parseValueTemplate(s string) (*valueTemplate, error) {
+	t := &valueTemplate{}
+	for s != "" {
+		start := strings.Index(s, "{")
+		if start < 0 {
+			t.parts = append(t.parts, templatePart{literal: s})
+			break
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unclosed { in %s", BadHeaderRulesError, s)
+		}
+		end += start
+		name := s[start+1 : end]
+		if _, ok := templateVars[name]; !ok {
+			return nil, fmt.Errorf("%w: unknown variable %s", BadHeaderRulesError, name)
+		}
+		if start > 0 {
+			t.parts = append(t.parts, templatePart{literal: s[:start]})
+		}
+		t.parts = append(t.parts, templatePart{variable: name})
+		s = s[end+1:]
+	}
+	return t, nil
+}
+
+func (t *valueTemplate) render(info *requestInfo) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.variable != "" {
+			b.WriteString(templateVars[p.variable](info))
+		} else {
+			b.WriteString(p.literal)
+		}
+	}
+	return b.String()
+}
+
+// parseHeaderRules parses rules like:
+// {"rename" = {"X-Old" = "X-New"}, "remove" = ["X-Debug"],
+// "set" = {"X-Client-Ip" = "{clientIp}"}, "add" = {"Via" = "tupi"}}
+// The rules are applied in the order rename, remove, set, add.
+func parseHeaderRules(c map[string]any, key string) (headerRules, error) {
+	raw, exists, err := getMap(c, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadHeaderRulesError, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	var rules headerRules
+
+	rename, err := sortedStringMap(raw, "rename")
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range rename {
+		rules = append(rules, headerOp{kind: headerRename, name: kv[0], newName: kv[1]})
+	}
+
+	remove, _, err := getStringList(raw, "remove")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadHeaderRulesError, err)
+	}
+	for _, name := range remove {
+		rules = append(rules, headerOp{kind: headerRemove, name: name})
+	}
+
+	for _, kind := range []headerOpKind{headerSet, headerAdd} {
+		k := "set"
+		if kind == headerAdd {
+			k = "add"
+		}
+		values, err := sortedStringMap(raw, k)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range values {
+			t, err := parseValueTemplate(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, headerOp{kind: kind, name: kv[0], value: t})
+		}
+	}
+	return rules, nil
+}
+
+// sortedStringMap returns the key/value pairs of a table of strings
+// sorted by key, so the rules are always applied in the same order.
+func sortedStringMap(c map[string]any, key string) ([][2]string, error) {
+	m, _, err := getMap(c, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadHeaderRulesError, err)
+	}
+	var pairs [][2]string
+	for k := range m {
+		v, _, err := getString(m, k)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadHeaderRulesError, err)
+		}
+		pairs = append(pairs, [2]string{k, v})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i][0] < pairs[j][0]
+	})
+	return pairs, nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseHeaderRules(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"no rules", map[string]any{}, nil},
+		{"not a table", map[string]any{"requestHeaders": "x"}, BadHeaderRulesError},
+		{"bad set", map[string]any{"requestHeaders": map[string]any{
+			"set": map[string]any{"X-A": 1}}}, BadHeaderRulesError},
+		{"bad remove", map[string]any{"requestHeaders": map[string]any{
+			"remove": "X-A"}}, BadHeaderRulesError},
+		{"unknown variable", map[string]any{"requestHeaders": map[string]any{
+			"set": map[string]any{"X-A": "{nada}"}}}, BadHeaderRulesError},
+		{"unclosed variable", map[string]any{"requestHeaders": map[string]any{
+			"add": map[string]any{"X-A": "{path"}}}, BadHeaderRulesError},
+		{"ok", map[string]any{"requestHeaders": map[string]any{
+			"rename": map[string]any{"X-Old": "X-New"},
+			"remove": []any{"X-Debug"},
+			"set":    map[string]any{"X-Client": "{clientIp}"},
+			"add":    map[string]any{"Via": "tupi"},
+		}}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseHeaderRules(test.conf, "requestHeaders")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestHeaderRulesApply(t *testing.T) {
+	rules, err := parseHeaderRules(map[string]any{"h": map[string]any{
+		"rename": map[string]any{"X-Old": "X-New", "X-Missing": "X-Other"},
+		"remove": []any{"X-Debug"},
+		"set": map[string]any{
+			"X-Info": "{method} {scheme}://{host}{path} from {clientIp} " +
+				"via {route} ({requestId})",
+		},
+		"add": map[string]any{"X-New": "added"},
+	}}, "h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &requestInfo{
+		clientIP:  "1.2.3.4",
+		host:      "the.site",
+		proto:     "https",
+		method:    "GET",
+		path:      "/users",
+		route:     "v2",
+		requestID: "abc",
+	}
+	h := http.Header{}
+	h.Set("X-Old", "old")
+	h.Set("X-Debug", "1")
+	rules.apply(h, info)
+
+	expected := http.Header{
+		"X-New":  []string{"old", "added"},
+		"X-Info": []string{"GET https://the.site/users from 1.2.3.4 via v2 (abc)"},
+	}
+	if !reflect.DeepEqual(h, expected) {
+		t.Fatalf("bad headers %v", h)
+	}
+}
+
+func TestServeHeaderRules(t *testing.T) {
+	defer func() {
+		testProxy = nil
+	}()
+	var p *myProxy
+	testProxy = func(rt *route, host string) httpProxy {
+		p = &myProxy{route: rt, host: host}
+		return p
+	}
+
+	conf := map[string]any{
+		"host": "http://v1.bla",
+		"requestHeaders": map[string]any{
+			"set": map[string]any{"X-Proxy": "tupi"},
+		},
+		"responseHeaders": map[string]any{
+			"remove": []any{"Server"},
+		},
+		"routes": []any{
+			map[string]any{
+				"name":       "api",
+				"pathPrefix": "/api",
+				"requestHeaders": map[string]any{
+					"set": map[string]any{"X-Route": "{route}"},
+				},
+				"responseHeaders": map[string]any{
+					"set": map[string]any{"X-Route": "{route}"},
+				},
+			},
+		},
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/users", nil)
+	Serve(w, r, &conf)
+	if p.pr.Out.Header.Get("X-Proxy") != "tupi" || p.pr.Out.Header.Get("X-Route") != "api" {
+		t.Fatalf("bad request headers %v", p.pr.Out.Header)
+	}
+
+	resp := &http.Response{
+		Header:  http.Header{"Server": []string{"nginx"}},
+		Request: p.pr.Out,
+	}
+	modifyResponse(resp, p.route)
+	if resp.Header.Get("Server") != "" || resp.Header.Get("X-Route") != "api" {
+		t.Fatalf("bad response headers %v", resp.Header)
+	}
+}
+
+func TestServeHeaderRulesErrorResponses(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+	testProxy = nil
+
+	dir := t.TempDir()
+	page := filepath.Join(dir, "5xx.html")
+	os.WriteFile(page, []byte("<p>error</p>"), 0644)
+	conf := map[string]any{
+		"host": "http://" + closed,
+		"responseHeaders": map[string]any{
+			"set": map[string]any{"Strict-Transport-Security": "max-age=63072000"},
+		},
+		"routes": []any{
+			map[string]any{
+				"name":       "blocked",
+				"pathPrefix": "/blocked",
+				"ipAccess":   map[string]any{"deny": []any{"0.0.0.0/0"}},
+				"responseHeaders": map[string]any{
+					"set": map[string]any{"X-Route": "{route}"},
+				},
+			},
+		},
+		"errorPages": map[string]any{
+			"pages": map[string]any{"5xx": map[string]any{"file": page}},
+		},
+	}
+
+	var tests = []struct {
+		name   string
+		path   string
+		status int
+		route  string
+	}{
+		{"denied", "/blocked", 403, "blocked"},
+		// with an error page
+		{"upstream error", "/", 503, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", test.path, nil)
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+			if w.Header().Get("Strict-Transport-Security") != "max-age=63072000" ||
+				w.Header().Get("X-Route") != test.route {
+				t.Fatalf("bad headers %v", w.Header())
+			}
+		})
+	}
+}
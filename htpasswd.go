@@ -0,0 +1,314 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// passwords checked are cached so bcrypt does not run on every
+	// request
+	maxVerifiedPasswords = 1000
+
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+)
+
+// htpasswdFile is a file with one user:hash per line. The hashes may
+// be bcrypt ($2y$) or SHA-256 crypt ($5$). Empty lines and lines
+// starting with # are ignored.
+type htpasswdFile struct {
+	path   string
+	reload time.Duration
+
+	mu        sync.Mutex
+	users     map[string]string
+	modTime   time.Time
+	lastCheck time.Time
+	verified  map[[sha256.Size]byte]struct{}
+	// checked for unknown users so they take as long as known ones
+	dummy string
+}
+
+func loadHtpasswdFile(path string, reload time.Duration) (*htpasswdFile, error) {
+	hf := &htpasswdFile{path: path, reload: reload}
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	hf.users, err = readHtpasswdFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hf.modTime = st.ModTime()
+	hf.lastCheck = time.Now()
+	hf.verified = map[[sha256.Size]byte]struct{}{}
+	hf.dummy = dummyPasswordHash(hf.users)
+	return hf, nil
+}
+
+// hash returns the hash of a user, reading the file again if it
+// changed. If the new file is bad the old users are kept. Unknown
+// users get the dummy hash.
+func (hf *htpasswdFile) hash(user string) (string, bool) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	if time.Since(hf.lastCheck) >= hf.reload {
+		hf.lastCheck = time.Now()
+		st, err := os.Stat(hf.path)
+		if err == nil && !st.ModTime().Equal(hf.modTime) {
+			users, err := readHtpasswdFile(hf.path)
+			if err != nil {
+				slog.Error("htpasswd reload error", "path", hf.path, "error", err)
+			} else {
+				hf.users = users
+				hf.modTime = st.ModTime()
+				hf.verified = map[[sha256.Size]byte]struct{}{}
+				hf.dummy = dummyPasswordHash(users)
+			}
+		}
+	}
+	h, ok := hf.users[user]
+	if !ok {
+		return hf.dummy, false
+	}
+	return h, true
+}
+
+// check returns true if the password of the user is right.
+func (hf *htpasswdFile) check(user, password string) bool {
+	hash, ok := hf.hash(user)
+	if !ok {
+		// the time does not tell if the user exists
+		checkPasswordHash(hash, password)
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+	hf.mu.Lock()
+	_, ok = hf.verified[key]
+	hf.mu.Unlock()
+	if ok {
+		return true
+	}
+	if !checkPasswordHash(hash, password) {
+		return false
+	}
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	if len(hf.verified) >= maxVerifiedPasswords {
+		clear(hf.verified)
+	}
+	hf.verified[key] = struct{}{}
+	return true
+}
+
+func readHtpasswdFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := map[string]string{}
+	s := bufio.NewScanner(f)
+	n := 0
+	for s.Scan() {
+		n++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("bad line %d", n)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$5$") {
+			return nil, fmt.Errorf("unsupported hash for %s", user)
+		}
+		users[user] = hash
+	}
+	return users, s.Err()
+}
+
+// dummyPasswordHash returns a hash with the same cost of the hashes of
+// the users. Without users a bcrypt hash with the default cost is used.
+func dummyPasswordHash(users map[string]string) string {
+	password := "tupi-proxy dummy password"
+	for _, hash := range users {
+		if strings.HasPrefix(hash, "$5$") {
+			dummy, err := sha256Crypt(password, hash)
+			if err == nil {
+				return dummy
+			}
+			continue
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			continue
+		}
+		dummy, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+		if err == nil {
+			return string(dummy)
+		}
+	}
+	dummy, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(dummy)
+}
+
+func checkPasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "$5$") {
+		computed, err := sha256Crypt(password, hash)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// sha256Crypt hashes a password with the SHA-256 crypt algorithm. The
+// salt and the rounds come from the setting, ie: $5$rounds=5000$salt
+func sha256Crypt(password, setting string) (string, error) {
+	rest, ok := strings.CutPrefix(setting, "$5$")
+	if !ok {
+		return "", errors.New("not a sha-256 crypt hash")
+	}
+	rounds := shaCryptDefaultRounds
+	customRounds := false
+	if r, after, ok := strings.Cut(rest, "$"); ok && strings.HasPrefix(r, "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(r, "rounds="))
+		if err != nil {
+			return "", errors.New("bad rounds")
+		}
+		rounds = min(max(n, shaCryptMinRounds), shaCryptMaxRounds)
+		customRounds = true
+		rest = after
+	}
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+	p := []byte(password)
+	s := []byte(salt)
+
+	b := sha256.New()
+	b.Write(p)
+	b.Write(s)
+	b.Write(p)
+	sumB := b.Sum(nil)
+
+	a := sha256.New()
+	a.Write(p)
+	a.Write(s)
+	for i := len(p); i > 0; i -= sha256.Size {
+		a.Write(sumB[:min(i, sha256.Size)])
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			a.Write(sumB)
+		} else {
+			a.Write(p)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha256.New()
+	for range len(p) {
+		dp.Write(p)
+	}
+	seqP := repeatBytes(dp.Sum(nil), len(p))
+
+	ds := sha256.New()
+	for range 16 + int(sumA[0]) {
+		ds.Write(s)
+	}
+	seqS := repeatBytes(ds.Sum(nil), len(s))
+
+	sum := sumA
+	c := sha256.New()
+	for i := range rounds {
+		c.Reset()
+		if i&1 == 1 {
+			c.Write(seqP)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write(seqS)
+		}
+		if i%7 != 0 {
+			c.Write(seqP)
+		}
+		if i&1 == 1 {
+			c.Write(sum)
+		} else {
+			c.Write(seqP)
+		}
+		sum = c.Sum(sum[:0])
+	}
+
+	var out bytes.Buffer
+	out.WriteString("$5$")
+	if customRounds {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt)
+	out.WriteByte('$')
+	order := [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	for _, o := range order {
+		cryptBase64(&out, sum[o[0]], sum[o[1]], sum[o[2]], 4)
+	}
+	cryptBase64(&out, 0, sum[31], sum[30], 3)
+	return out.String(), nil
+}
+
+func repeatBytes(b []byte, n int) []byte {
+	r := make([]byte, n)
+	for i := 0; i < n; i += len(b) {
+		copy(r[i:], b)
+	}
+	return r
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func cryptBase64(out *bytes.Buffer, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for range n {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSHA256Crypt(t *testing.T) {
+	// test vectors from the sha-crypt specification
+	var tests = []struct {
+		setting  string
+		password string
+		hash     string
+	}{
+		{"$5$saltstring", "Hello world!",
+			"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{"$5$rounds=10000$saltstringsaltstring", "Hello world!",
+			"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{"$5$rounds=5000$toolongsaltstring", "This is just a test",
+			"$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5"},
+		{"$5$rounds=10$roundstoolow", "the minimum number is still observed",
+			"$5$rounds=1000$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC"},
+	}
+	for _, test := range tests {
+		hash, err := sha256Crypt(test.password, test.setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != test.hash {
+			t.Fatalf("bad hash %s", hash)
+		}
+		// the hash is also a setting
+		if !checkPasswordHash(test.hash, test.password) {
+			t.Fatalf("password not checked for %s", test.hash)
+		}
+	}
+	if _, err := sha256Crypt("x", "$6$salt"); err == nil {
+		t.Fatalf("no error for bad setting")
+	}
+}
+
+func writeHtpasswd(t *testing.T, path, user, password string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "# users\n\n" + user + ":" + string(hash) + "\n" +
+		"sha:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, "joe", "secret")
+	hf, err := loadHtpasswdFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		user     string
+		password string
+		ok       bool
+	}{
+		{"joe", "secret", true},
+		{"joe", "secret", true},
+		{"joe", "wrong", false},
+		{"sha", "Hello world!", true},
+		{"ann", "secret", false},
+	}
+	for _, test := range tests {
+		if hf.check(test.user, test.password) != test.ok {
+			t.Fatalf("bad check for %s:%s", test.user, test.password)
+		}
+	}
+
+	writeHtpasswd(t, path, "ann", "other")
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	if !hf.check("ann", "other") || hf.check("joe", "secret") {
+		t.Fatalf("file not reloaded")
+	}
+
+	// a bad file keeps the old users
+	os.WriteFile(path, []byte("bad line\n"), 0o600)
+	later = later.Add(time.Second)
+	os.Chtimes(path, later, later)
+	if !hf.check("ann", "other") {
+		t.Fatalf("old users lost")
+	}
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name   string
+		users  map[string]string
+		prefix string
+	}{
+		{"no users", map[string]string{}, "$2a$10$"},
+		{"bcrypt", map[string]string{"joe": string(bcryptHash)}, "$2a$05$"},
+		{"sha-256 crypt", map[string]string{
+			"sha": "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+			"$5$rounds=10000$saltstringsaltst$"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dummy := dummyPasswordHash(test.users)
+			if !strings.HasPrefix(dummy, test.prefix) {
+				t.Fatalf("bad dummy %s", dummy)
+			}
+			for _, hash := range test.users {
+				if dummy == hash {
+					t.Fatalf("dummy is a user hash")
+				}
+			}
+		})
+	}
+}
+
+func TestHtpasswdUnknownUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, "joe", "secret")
+	hf, err := loadHtpasswdFile(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, ok := hf.hash("ann")
+	if ok || hash != hf.dummy || hash == "" {
+		t.Fatalf("bad hash for unknown user %s", hash)
+	}
+	if hf.check("ann", "tupi-proxy dummy password") {
+		t.Fatalf("unknown user allowed")
+	}
+}
+
+func TestReadHtpasswdFile(t *testing.T) {
+	var tests = []struct {
+		name    string
+		content string
+		isErr   bool
+	}{
+		{"ok", "joe:$2y$05$abc\n# comment\nann:$5$salt$hash\n", false},
+		{"no hash", "joe\n", true},
+		{"no user", ":$2y$05$abc\n", true},
+		{"unsupported hash", "joe:{SHA}abc\n", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "htpasswd")
+			os.WriteFile(path, []byte(test.content), 0o600)
+			_, err := readHtpasswdFile(path)
+			if (err != nil) != test.isErr {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
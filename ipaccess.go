@@ -0,0 +1,223 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var BadIPAccessError error = errors.New("[tupi-proxy] Bad ip access config")
+
+const defaultIPListReload = 5 * time.Second
+
+// ipAccess is an access control list of client ips. Denied ips are
+// checked first. If there are allowed ips only them are allowed.
+type ipAccess struct {
+	allow *ipList
+	deny  *ipList
+}
+
+// allowed returns true if the client ip may access the route.
+func (a *ipAccess) allowed(info *requestInfo) bool {
+	addr, err := netip.ParseAddr(info.clientIP)
+	if err != nil {
+		// without a valid ip only an acl without allow list passes
+		return a.allow.empty()
+	}
+	addr = addr.Unmap()
+	if a.deny.contains(addr) {
+		return false
+	}
+	return a.allow.empty() || a.allow.contains(addr)
+}
+
+// ipList is a list of ranges from the config and from files. The files
+// are read again when they change.
+type ipList struct {
+	prefixes []netip.Prefix
+	files    []*prefixFile
+}
+
+func (l *ipList) empty() bool {
+	return len(l.prefixes) == 0 && len(l.files) == 0
+}
+
+func (l *ipList) contains(addr netip.Addr) bool {
+	if containsAddr(l.prefixes, addr) {
+		return true
+	}
+	for _, f := range l.files {
+		if containsAddr(f.get(), addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixFile is a file with one ip or cidr range per line. Empty lines
+// and lines starting with # are ignored. The file is checked for
+// changes at most once per reload interval.
+type prefixFile struct {
+	path   string
+	reload time.Duration
+
+	mu        sync.Mutex
+	prefixes  []netip.Prefix
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func loadPrefixFile(path string, reload time.Duration) (*prefixFile, error) {
+	pf := &prefixFile{path: path, reload: reload}
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	pf.prefixes, err = readPrefixFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pf.modTime = st.ModTime()
+	pf.lastCheck = time.Now()
+	return pf, nil
+}
+
+// get returns the ranges of the file, reading it again if it changed.
+// If the new file is bad the old ranges are kept.
+func (pf *prefixFile) get() []netip.Prefix {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if time.Since(pf.lastCheck) < pf.reload {
+		return pf.prefixes
+	}
+	pf.lastCheck = time.Now()
+	st, err := os.Stat(pf.path)
+	if err != nil || st.ModTime().Equal(pf.modTime) {
+		return pf.prefixes
+	}
+	prefixes, err := readPrefixFile(pf.path)
+	if err != nil {
+		slog.Error("ip list reload error", "path", pf.path, "error", err)
+		return pf.prefixes
+	}
+	pf.prefixes = prefixes
+	pf.modTime = st.ModTime()
+	return pf.prefixes
+}
+
+func readPrefixFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var prefixes []netip.Prefix
+	s := bufio.NewScanner(f)
+	n := 0
+	for s.Scan() {
+		n++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := parsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, s.Err()
+}
+
+// parseIPAccess parses the `ipAccess` key of the config like:
+// {"allow" = ["10.0.0.0/8"], "denyFiles" = ["/etc/tupi/blocked.txt"]}
+// If there is no ipAccess key the inherited one is returned.
+func parseIPAccess(c map[string]any, inherited *ipAccess) (*ipAccess, error) {
+	raw, exists, err := getMap(c, "ipAccess")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadIPAccessError, err)
+	}
+	if !exists {
+		return inherited, nil
+	}
+	reload, exists, err := getDuration(raw, "reloadInterval")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadIPAccessError, err)
+	}
+	if !exists {
+		reload = defaultIPListReload
+	}
+	a := &ipAccess{}
+	a.allow, err = parseIPList(raw, "allow", reload)
+	if err != nil {
+		return nil, err
+	}
+	a.deny, err = parseIPList(raw, "deny", reload)
+	if err != nil {
+		return nil, err
+	}
+	if a.allow.empty() && a.deny.empty() {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// parseIPList parses the key list and the <key>Files list of files.
+func parseIPList(c map[string]any, key string, reload time.Duration) (*ipList, error) {
+	l := &ipList{}
+	ranges, _, err := getStringList(c, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadIPAccessError, err)
+	}
+	for _, r := range ranges {
+		p, err := parsePrefix(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadIPAccessError, err)
+		}
+		l.prefixes = append(l.prefixes, p)
+	}
+	files, _, err := getStringList(c, key+"Files")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadIPAccessError, err)
+	}
+	for _, path := range files {
+		pf, err := loadPrefixFile(path, reload)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadIPAccessError, err)
+		}
+		l.files = append(l.files, pf)
+	}
+	return l, nil
+}
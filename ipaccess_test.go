@@ -0,0 +1,168 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIPAccessAllowed(t *testing.T) {
+	deny, _ := parseIPList(map[string]any{
+		"deny": []any{"10.1.0.0/16", "2001:db8::/32"}}, "deny", 0)
+	allow, _ := parseIPList(map[string]any{
+		"allow": []any{"10.0.0.0/8", "192.168.0.1"}}, "allow", 0)
+	none := &ipList{}
+
+	var tests = []struct {
+		name     string
+		acl      *ipAccess
+		ip       string
+		expected bool
+	}{
+		{"allowed", &ipAccess{allow: allow, deny: deny}, "10.2.0.1", true},
+		{"denied", &ipAccess{allow: allow, deny: deny}, "10.1.0.1", false},
+		{"not allowed", &ipAccess{allow: allow, deny: deny}, "172.16.0.1", false},
+		{"single ip", &ipAccess{allow: allow, deny: none}, "192.168.0.1", true},
+		{"mapped ipv4", &ipAccess{allow: allow, deny: none}, "::ffff:10.0.0.1", true},
+		{"ipv6 denied", &ipAccess{allow: none, deny: deny}, "2001:db8::1", false},
+		{"ipv6 not denied", &ipAccess{allow: none, deny: deny}, "2001:db9::1", true},
+		{"bad ip with allow", &ipAccess{allow: allow, deny: none}, "", false},
+		{"bad ip with deny", &ipAccess{allow: none, deny: deny}, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := &requestInfo{clientIP: test.ip}
+			if test.acl.allowed(info) != test.expected {
+				t.Fatalf("bad allowed for %s", test.ip)
+			}
+		})
+	}
+}
+
+func TestPrefixFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.txt")
+	os.WriteFile(path, []byte("# abusers\n10.0.0.1\n\n10.1.0.0/16\n"), 0644)
+	pf, err := loadPrefixFile(path, 0)
+	if err != nil {
+		t.Fatalf("bad load %s", err.Error())
+	}
+	if len(pf.get()) != 2 {
+		t.Fatalf("bad prefixes %v", pf.get())
+	}
+
+	os.WriteFile(path, []byte("10.0.0.1\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Minute))
+	if len(pf.get()) != 1 {
+		t.Fatalf("not reloaded %v", pf.get())
+	}
+
+	// a bad file keeps the old ranges
+	os.WriteFile(path, []byte("bad ip\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute))
+	if len(pf.get()) != 1 {
+		t.Fatalf("bad file loaded %v", pf.get())
+	}
+}
+
+func TestParseIPAccess(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.txt")
+	os.WriteFile(good, []byte("10.0.0.0/8\n"), 0644)
+	bad := filepath.Join(dir, "bad.txt")
+	os.WriteFile(bad, []byte("10.0.0.0/99\n"), 0644)
+	inherited := &ipAccess{}
+
+	var tests = []struct {
+		name     string
+		conf     map[string]any
+		expected func(*ipAccess) bool
+		err      error
+	}{
+		{"inherited", map[string]any{},
+			func(a *ipAccess) bool { return a == inherited }, nil},
+		{"empty", map[string]any{"ipAccess": map[string]any{}},
+			func(a *ipAccess) bool { return a == nil }, nil},
+		{"not a table", map[string]any{"ipAccess": "x"}, nil, BadIPAccessError},
+		{"bad range", map[string]any{"ipAccess": map[string]any{
+			"allow": []any{"10.0.0.0/99"}}}, nil, BadIPAccessError},
+		{"missing file", map[string]any{"ipAccess": map[string]any{
+			"denyFiles": []any{"/no/file"}}}, nil, os.ErrNotExist},
+		{"bad file", map[string]any{"ipAccess": map[string]any{
+			"denyFiles": []any{bad}}}, nil, BadIPAccessError},
+		{"ok", map[string]any{"ipAccess": map[string]any{
+			"allow": []any{"192.168.0.0/16"}, "denyFiles": []any{good},
+			"reloadInterval": "1s"}},
+			func(a *ipAccess) bool { return len(a.deny.files) == 1 }, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := parseIPAccess(test.conf, inherited)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+			if test.expected != nil && !test.expected(a) {
+				t.Fatalf("bad acl %+v", a)
+			}
+		})
+	}
+}
+
+func TestServeIPAccess(t *testing.T) {
+	testProxy = func(rt *route, host string) httpProxy {
+		return &myProxy{route: rt, host: host}
+	}
+	defer func() { testProxy = nil }()
+
+	conf := map[string]any{
+		"host":     "http://v1.bla",
+		"ipAccess": map[string]any{"deny": []any{"10.0.0.0/8"}},
+		"routes": []any{
+			map[string]any{"pathPrefix": "/admin", "ipAccess": map[string]any{
+				"allow": []any{"192.168.0.0/16"}}},
+			map[string]any{"pathPrefix": "/open", "ipAccess": map[string]any{}},
+		},
+	}
+	var tests = []struct {
+		name   string
+		path   string
+		ip     string
+		status int
+	}{
+		{"allowed", "/", "172.16.0.1", 200},
+		{"denied", "/", "10.0.0.1", 403},
+		{"route allowed", "/admin", "192.168.1.1", 200},
+		{"route not allowed", "/admin", "172.16.0.1", 403},
+		{"route without acl", "/open", "10.0.0.1", 200},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", test.path, nil)
+			r.RemoteAddr = test.ip + ":1234"
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+		})
+	}
+}
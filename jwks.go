@@ -0,0 +1,291 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKSRefresh = 10 * time.Minute
+	// unknown key ids fetch the keys again at most once per interval
+	minJWKSRefresh = 30 * time.Second
+	maxJWKSSize    = 1024 * 1024
+)
+
+// jwk is a key of a key set.
+type jwk struct {
+	kid string
+	// RSA, EC, OKP or oct
+	kty string
+	key any
+}
+
+// jwks is a set of keys from a file or an url. Files are read again
+// when they change and urls are fetched again after the refresh
+// interval or when a token has an unknown key id.
+type jwks struct {
+	file    string
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu        sync.Mutex
+	keys      []jwk
+	modTime   time.Time
+	fetchedAt time.Time
+	// the running load, if any
+	loading *jwksLoad
+}
+
+// jwksLoad is a load of the keys. Concurrent loads wait for the
+// running one.
+type jwksLoad struct {
+	done chan struct{}
+	err  error
+}
+
+// get returns the keys with the key id. Without a key id all keys
+// are returned. Stale keys are refreshed in background and the cached
+// keys are used meanwhile.
+func (ks *jwks) get(kid string) ([]jwk, error) {
+	keys, loaded, age := ks.find(kid)
+	switch {
+	// the keys may have been rotated
+	case !loaded || (len(keys) == 0 && kid != "" && age > minJWKSRefresh):
+		err := ks.reload()
+		keys, loaded, _ = ks.find(kid)
+		if err != nil && (!loaded || len(keys) == 0) {
+			return nil, err
+		}
+	case age > ks.refresh:
+		go ks.reload()
+	}
+	return keys, nil
+}
+
+// find returns the keys with the key id, if the keys were loaded and
+// the time since the last load.
+func (ks *jwks) find(kid string) ([]jwk, bool, time.Duration) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	age := time.Since(ks.fetchedAt)
+	if kid == "" {
+		return ks.keys, ks.keys != nil, age
+	}
+	var keys []jwk
+	for _, k := range ks.keys {
+		if k.kid == kid {
+			keys = append(keys, k)
+		}
+	}
+	return keys, ks.keys != nil, age
+}
+
+// reload loads the keys. Only one load runs at a time and the lock is
+// not held while the keys are read. Errors keep the old keys.
+func (ks *jwks) reload() error {
+	ks.mu.Lock()
+	if l := ks.loading; l != nil {
+		ks.mu.Unlock()
+		<-l.done
+		return l.err
+	}
+	l := &jwksLoad{done: make(chan struct{})}
+	ks.loading = l
+	ks.fetchedAt = time.Now()
+	modTime := ks.modTime
+	if ks.keys == nil {
+		modTime = time.Time{}
+	}
+	ks.mu.Unlock()
+
+	keys, newModTime, err := ks.read(modTime)
+	ks.mu.Lock()
+	if err == nil && keys != nil {
+		ks.keys = keys
+		ks.modTime = newModTime
+	}
+	l.err = err
+	ks.loading = nil
+	ks.mu.Unlock()
+	close(l.done)
+	return err
+}
+
+// read reads the keys. A file not changed since modTime returns nil
+// keys.
+func (ks *jwks) read(modTime time.Time) ([]jwk, time.Time, error) {
+	var b []byte
+	var err error
+	if ks.file != "" {
+		st, err := os.Stat(ks.file)
+		if err != nil {
+			return nil, modTime, err
+		}
+		if st.ModTime().Equal(modTime) {
+			return nil, modTime, nil
+		}
+		modTime = st.ModTime()
+		b, err = os.ReadFile(ks.file)
+		if err != nil {
+			return nil, modTime, err
+		}
+	} else {
+		b, err = ks.fetch()
+		if err != nil {
+			return nil, modTime, err
+		}
+	}
+	keys, err := decodeJWKS(b)
+	return keys, modTime, err
+}
+
+func (ks *jwks) fetch() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ks.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+type rawJWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// decodeJWKS decodes a json key set. Keys not used for signatures and
+// keys of unknown types are ignored.
+func decodeJWKS(b []byte) ([]jwk, error) {
+	var set struct {
+		Keys []rawJWK `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	keys := []jwk{}
+	for _, rk := range set.Keys {
+		if rk.Use != "" && rk.Use != "sig" {
+			continue
+		}
+		key, err := rk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", rk.Kid, err)
+		}
+		if key == nil {
+			continue
+		}
+		keys = append(keys, jwk{kid: rk.Kid, kty: rk.Kty, key: key})
+	}
+	return keys, nil
+}
+
+func (rk rawJWK) publicKey() (any, error) {
+	switch rk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(rk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(rk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("bad rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if rk.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := decodeBigInt(rk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(rk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "OKP":
+		if rk.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(rk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(rk.K)
+		if err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty key value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
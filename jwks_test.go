@@ -0,0 +1,159 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJWKSURLRotation(t *testing.T) {
+	tk := newTestKeys(t)
+	var mu sync.Mutex
+	set := []any{rsaJWK("one", tk.rsa)}
+	var calls atomic.Int64
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			mu.Lock()
+			defer mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]any{"keys": set})
+		}))
+	defer s.Close()
+
+	ks := &jwks{url: s.URL, refresh: time.Hour, client: s.Client()}
+	if keys, err := ks.get("one"); err != nil || len(keys) != 1 {
+		t.Fatalf("bad keys %v %v", keys, err)
+	}
+	// cached
+	ks.get("one")
+	if calls.Load() != 1 {
+		t.Fatalf("bad calls %d", calls.Load())
+	}
+
+	mu.Lock()
+	set = []any{rsaJWK("one", tk.rsa), rsaJWK("two", tk.other)}
+	mu.Unlock()
+	// the keys were just fetched
+	if keys, _ := ks.get("two"); len(keys) != 0 {
+		t.Fatalf("fetched too soon")
+	}
+	ks.fetchedAt = time.Now().Add(-time.Minute)
+	if keys, err := ks.get("two"); err != nil || len(keys) != 1 {
+		t.Fatalf("bad rotated keys %v %v", keys, err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("bad calls %d", calls.Load())
+	}
+
+	// errors keep the old keys
+	s.Close()
+	ks.fetchedAt = time.Now().Add(-2 * time.Hour)
+	if keys, err := ks.get("one"); err != nil || len(keys) != 1 {
+		t.Fatalf("old keys lost %v %v", keys, err)
+	}
+}
+
+func TestJWKSSlowRefresh(t *testing.T) {
+	tk := newTestKeys(t)
+	var slow atomic.Bool
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if slow.Load() {
+				time.Sleep(500 * time.Millisecond)
+			}
+			json.NewEncoder(w).Encode(map[string]any{"keys": []any{rsaJWK("one", tk.rsa)}})
+		}))
+	defer s.Close()
+
+	ks := &jwks{url: s.URL, refresh: time.Minute, client: s.Client()}
+	if keys, err := ks.get("one"); err != nil || len(keys) != 1 {
+		t.Fatalf("bad keys %v %v", keys, err)
+	}
+	slow.Store(true)
+	ks.mu.Lock()
+	ks.fetchedAt = time.Now().Add(-2 * time.Minute)
+	ks.mu.Unlock()
+	start := time.Now()
+	for range 3 {
+		// the cached keys are used while the keys are refreshed
+		if keys, err := ks.get("one"); err != nil || len(keys) != 1 {
+			t.Fatalf("bad keys %v %v", keys, err)
+		}
+	}
+	if time.Since(start) > 200*time.Millisecond {
+		t.Fatalf("get waited for the refresh")
+	}
+}
+
+func TestJWKSFileReload(t *testing.T) {
+	tk := newTestKeys(t)
+	b, _ := json.Marshal(map[string]any{"keys": []any{rsaJWK("one", tk.rsa)}})
+	path := writeJWKS(t, b)
+	ks := &jwks{file: path, refresh: time.Minute}
+	if keys, _ := ks.get("one"); len(keys) != 1 {
+		t.Fatalf("bad keys %v", keys)
+	}
+
+	b, _ = json.Marshal(map[string]any{"keys": []any{rsaJWK("two", tk.other)}})
+	os.WriteFile(path, b, 0o600)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	ks.fetchedAt = time.Now().Add(-2 * time.Minute)
+	if keys, _ := ks.get("two"); len(keys) != 1 {
+		t.Fatalf("file not reloaded")
+	}
+	if keys, _ := ks.get("one"); len(keys) != 0 {
+		t.Fatalf("old key kept")
+	}
+}
+
+func TestDecodeJWKS(t *testing.T) {
+	var tests = []struct {
+		name  string
+		set   string
+		keys  int
+		isErr bool
+	}{
+		{"not json", "x", 0, true},
+		{"empty", `{"keys": []}`, 0, false},
+		{"unknown types", `{"keys": [{"kty": "EC", "crv": "P-521"}, {"kty": "XX"}]}`, 0, false},
+		{"encryption key", `{"keys": [{"kty": "oct", "use": "enc", "k": "c2VjcmV0"}]}`, 0, false},
+		{"oct", `{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`, 1, false},
+		{"bad rsa", `{"keys": [{"kty": "RSA", "n": "", "e": "AQAB"}]}`, 0, true},
+		{"bad ec point", `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`, 0, true},
+		{"bad ed25519", `{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": "AQ"}]}`, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := decodeJWKS([]byte(test.set))
+			if (err != nil) != test.isErr {
+				t.Fatalf("bad err %v", err)
+			}
+			if len(keys) != test.keys {
+				t.Fatalf("bad keys %v", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,571 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var BadJWTError error = errors.New("[tupi-proxy] Bad jwt config")
+
+var (
+	invalidTokenError      = errors.New("invalid token")
+	insufficientScopeError = errors.New("insufficient scope")
+	// the keys could not be loaded, not a client error
+	keysUnavailableError = errors.New("keys unavailable")
+)
+
+// jwtAlgorithms are the supported signature algorithms and the key
+// types they use. An algorithm only verifies with keys of its type so
+// a public key can't be used as a hmac secret.
+var jwtAlgorithms = map[string]string{
+	"HS256": "oct",
+	"RS256": "RSA",
+	"ES256": "EC",
+	"EdDSA": "OKP",
+}
+
+// jwtAuth verifies bearer tokens. Requests without a valid token are
+// answered with 401 and the claims of valid tokens may be sent to the
+// upstream in headers.
+type jwtAuth struct {
+	keys *jwks
+	// hmac secret for HS256
+	secret     []byte
+	algorithms []string
+	issuer     string
+	// the token must have one of the audiences
+	audience []string
+	leeway   time.Duration
+	// tokens without exp are rejected
+	requireExp bool
+	// claim name to the values the claim must have
+	requiredClaims map[string][]string
+	// claim name to the upstream header with its value
+	claimHeaders  map[string]string
+	identityClaim string
+	realm         string
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// authorize verifies the token of the request. If the request is
+// allowed it returns true and the claim headers are set. If not the
+// response was already written.
+func (ja *jwtAuth) authorize(w http.ResponseWriter, r *http.Request, info *requestInfo) bool {
+	// the client can't send the headers that come from the claims
+	for _, h := range ja.claimHeaders {
+		r.Header.Del(h)
+	}
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", ja.challenge("", ""))
+		writeError(w, r, http.StatusUnauthorized, "missing bearer token")
+		return false
+	}
+	claims, err := ja.verify(token, time.Now())
+	if err == nil {
+		err = ja.checkRequired(claims)
+	}
+	if errors.Is(err, keysUnavailableError) {
+		requestLogger(info).Error("jwt keys error", "error", err)
+		writeError(w, r, http.StatusServiceUnavailable, "")
+		return false
+	}
+	if err != nil {
+		// the details are only logged
+		requestLogger(info).Info("jwt denied", "error", err)
+		status := http.StatusUnauthorized
+		code := "invalid_token"
+		description := "the token is invalid"
+		if errors.Is(err, insufficientScopeError) {
+			status = http.StatusForbidden
+			code = "insufficient_scope"
+			description = "the token does not have the required claims"
+		}
+		w.Header().Set("WWW-Authenticate", ja.challenge(code, description))
+		writeError(w, r, status, description)
+		return false
+	}
+
+	for claim, h := range ja.claimHeaders {
+		if v, ok := claims[claim]; ok {
+			r.Header.Set(h, claimString(v))
+		}
+	}
+	if id, ok := claims[ja.identityClaim].(string); ok {
+		info.identity = id
+	}
+	return true
+}
+
+func (ja *jwtAuth) challenge(code, description string) string {
+	c := `Bearer realm="` + ja.realm + `"`
+	if code != "" {
+		c += `, error="` + code + `"`
+	}
+	if description != "" {
+		c += `, error_description="` + strings.ReplaceAll(description, `"`, "'") + `"`
+	}
+	return c
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// verify checks the signature and the registered claims of a token
+// and returns its claims.
+func (ja *jwtAuth) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", invalidTokenError)
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: bad header", invalidTokenError)
+	}
+	if !containsString(ja.algorithms, header.Alg) {
+		return nil, fmt.Errorf("%w: algorithm %s not allowed", invalidTokenError, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature", invalidTokenError)
+	}
+	keys, err := ja.candidates(header)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if verifyJWTSignature(header.Alg, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: bad signature", invalidTokenError)
+	}
+
+	claims := map[string]any{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: bad claims", invalidTokenError)
+	}
+	if err := ja.checkRegistered(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// candidates returns the keys that may have signed the token.
+func (ja *jwtAuth) candidates(header jwtHeader) ([]jwk, error) {
+	kty := jwtAlgorithms[header.Alg]
+	var keys []jwk
+	if kty == "oct" && ja.secret != nil {
+		keys = append(keys, jwk{kty: "oct", key: ja.secret})
+	}
+	if ja.keys != nil {
+		set, err := ja.keys.get(header.Kid)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", keysUnavailableError, err)
+		}
+		for _, k := range set {
+			if k.kty == kty {
+				keys = append(keys, k)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no key for the token", invalidTokenError)
+	}
+	return keys, nil
+}
+
+func verifyJWTSignature(alg string, key any, signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(pub, signed, sig)
+	}
+	return false
+}
+
+// checkRegistered checks exp, nbf, iss and aud.
+func (ja *jwtAuth) checkRegistered(claims map[string]any, now time.Time) error {
+	exp, ok, err := numericDate(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok && ja.requireExp {
+		return fmt.Errorf("%w: no exp", invalidTokenError)
+	}
+	if ok && !now.Before(exp.Add(ja.leeway)) {
+		return fmt.Errorf("%w: expired", invalidTokenError)
+	}
+	nbf, ok, err := numericDate(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(ja.leeway).Before(nbf) {
+		return fmt.Errorf("%w: not valid yet", invalidTokenError)
+	}
+	if ja.issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != ja.issuer {
+			return fmt.Errorf("%w: bad issuer", invalidTokenError)
+		}
+	}
+	if len(ja.audience) > 0 {
+		found := false
+		for _, aud := range claimValues(claims["aud"]) {
+			if containsString(ja.audience, aud) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: bad audience", invalidTokenError)
+		}
+	}
+	return nil
+}
+
+// checkRequired checks if the claims have the required values.
+func (ja *jwtAuth) checkRequired(claims map[string]any) error {
+	for name, required := range ja.requiredClaims {
+		v, ok := claims[name]
+		if !ok {
+			return fmt.Errorf("%w: missing claim %s", insufficientScopeError, name)
+		}
+		values := claimValues(v)
+		for _, r := range required {
+			if !containsString(values, r) {
+				return fmt.Errorf("%w: claim %s needs %s", insufficientScopeError, name, r)
+			}
+		}
+	}
+	return nil
+}
+
+func numericDate(claims map[string]any, name string) (time.Time, bool, error) {
+	v, ok := claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("%w: bad %s", invalidTokenError, name)
+	}
+	return time.Unix(int64(f), 0), true, nil
+}
+
+// claimValues returns the values of a claim. Lists are the list
+// values and strings are split on spaces like the scope claim.
+func claimValues(v any) []string {
+	switch c := v.(type) {
+	case string:
+		return strings.Fields(c)
+	case []any:
+		values := make([]string, 0, len(c))
+		for _, i := range c {
+			if s, ok := i.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// claimString returns the value of a claim for a header. Lists of
+// strings are joined with commas and other values are json.
+func claimString(v any) string {
+	switch c := v.(type) {
+	case string:
+		return c
+	case []any:
+		values := claimValues(c)
+		if len(values) == len(c) {
+			return strings.Join(values, ",")
+		}
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseJWT parses the `jwt` key of the config like:
+// {"jwksUrl" = "https://auth/.well-known/jwks.json", "issuer" = "https://auth", "audience" = ["api"], "claimHeaders" = {"sub" = "X-User-Id"}}
+// The keys of a route's jwt are set over the inherited ones so a route
+// may only add its required claims. If there is no jwt key the
+// inherited one is returned.
+func parseJWT(c map[string]any, inherited *jwtAuth) (*jwtAuth, error) {
+	raw, exists, err := getMap(c, "jwt")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+	}
+	if !exists {
+		return inherited, nil
+	}
+	disabled, _, err := getBool(raw, "disabled")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+	}
+	if disabled {
+		return nil, nil
+	}
+
+	ja := &jwtAuth{
+		algorithms:    []string{"HS256", "RS256", "ES256", "EdDSA"},
+		identityClaim: "sub",
+		realm:         "tupi-proxy",
+		requireExp:    true,
+	}
+	if inherited != nil {
+		*ja = *inherited
+	}
+
+	ks, err := parseJWKS(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+	}
+	if ks != nil {
+		ja.keys = ks
+	}
+	secret, exists, err := getString(raw, "secret")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+	}
+	if exists {
+		ja.secret = []byte(secret)
+	}
+	if ja.keys == nil && len(ja.secret) == 0 {
+		return nil, fmt.Errorf("%w: needs jwksFile, jwksUrl or secret", BadJWTError)
+	}
+
+	algs, exists, err := getStringList(raw, "algorithms")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+	}
+	if exists {
+		for _, a := range algs {
+			if _, ok := jwtAlgorithms[a]; !ok {
+				return nil, fmt.Errorf("%w: unknown algorithm %s", BadJWTError, a)
+			}
+		}
+		ja.algorithms = algs
+	}
+
+	strs := []struct {
+		key  string
+		dest *string
+	}{
+		{"issuer", &ja.issuer},
+		{"identityClaim", &ja.identityClaim},
+		{"realm", &ja.realm},
+	}
+	for _, s := range strs {
+		v, exists, err := getString(raw, s.key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+		}
+		if exists {
+			*s.dest = v
+		}
+	}
+	if strings.Contains(ja.realm, `"`) {
+		return nil, fmt.Errorf("%w: bad realm", BadJWTError)
+	}
+
+	requireExp, exists, err := getBool(raw, "requireExp")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+	}
+	if exists {
+		ja.requireExp = requireExp
+	}
+
+	audience, exists, err := getStringList(raw, "audience")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+	}
+	if exists {
+		ja.audience = audience
+	}
+
+	leeway, exists, err := getDuration(raw, "leeway")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+	}
+	if exists {
+		if leeway < 0 {
+			return nil, fmt.Errorf("%w: leeway can't be negative", BadJWTError)
+		}
+		ja.leeway = leeway
+	}
+
+	required, exists, err := getMap(raw, "requiredClaims")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+	}
+	if exists {
+		ja.requiredClaims = map[string][]string{}
+		for name := range required {
+			values, err := getClaimValues(required, name)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+			}
+			ja.requiredClaims[name] = values
+		}
+	}
+
+	headers, exists, err := getMap(raw, "claimHeaders")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadJWTError, err)
+	}
+	if exists {
+		ja.claimHeaders = map[string]string{}
+		for name := range headers {
+			h, _, err := getString(headers, name)
+			if err != nil || h == "" {
+				return nil, fmt.Errorf("%w: bad header for claim %s", BadJWTError, name)
+			}
+			ja.claimHeaders[name] = h
+		}
+	}
+	return ja, nil
+}
+
+// getClaimValues returns a required claim value that may be a string
+// or a list of strings.
+func getClaimValues(c map[string]any, key string) ([]string, error) {
+	if s, ok := c[key].(string); ok {
+		return []string{s}, nil
+	}
+	values, _, err := getStringList(c, key)
+	return values, err
+}
+
+// parseJWKS parses the key set keys of the jwt config. It returns nil
+// if there are no key set keys.
+func parseJWKS(c map[string]any) (*jwks, error) {
+	file, _, err := getString(c, "jwksFile")
+	if err != nil {
+		return nil, err
+	}
+	rawURL, _, err := getString(c, "jwksUrl")
+	if err != nil {
+		return nil, err
+	}
+	if file == "" && rawURL == "" {
+		return nil, nil
+	}
+	if file != "" && rawURL != "" {
+		return nil, errors.New("jwksFile and jwksUrl can't be used together")
+	}
+	ks := &jwks{file: file, refresh: defaultJWKSRefresh}
+	if rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("bad jwksUrl %s", rawURL)
+		}
+		ks.url = rawURL
+		ks.client = &http.Client{}
+	}
+	refresh, exists, err := getDuration(c, "jwksRefresh")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		if refresh <= 0 {
+			return nil, errors.New("jwksRefresh must be positive")
+		}
+		ks.refresh = refresh
+	}
+	if file != "" {
+		// a bad file is a config error
+		if err := ks.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
@@ -0,0 +1,401 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testKeys struct {
+	rsa   *rsa.PrivateKey
+	ec    *ecdsa.PrivateKey
+	ed    ed25519.PrivateKey
+	hmac  []byte
+	other *rsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKeys{rsa: rsaKey, ec: ecKey, ed: edKey, hmac: []byte("the secret"), other: other}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, k *rsa.PrivateKey) map[string]any {
+	return map[string]any{"kid": kid, "kty": "RSA", "n": b64(k.N.Bytes()),
+		"e": b64([]byte{1, 0, 1})}
+}
+
+// jwksJSON returns a key set with the public keys.
+func (tk *testKeys) jwksJSON() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	tk.ec.X.FillBytes(x)
+	tk.ec.Y.FillBytes(y)
+	keys := []any{
+		rsaJWK("rsa", tk.rsa),
+		map[string]any{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(x), "y": b64(y)},
+		map[string]any{"kid": "ed", "kty": "OKP", "crv": "Ed25519",
+			"x": b64(tk.ed.Public().(ed25519.PublicKey))},
+		map[string]any{"kid": "hs", "kty": "oct", "k": b64(tk.hmac)},
+		map[string]any{"kid": "enc", "kty": "RSA", "use": "enc"},
+	}
+	b, _ := json.Marshal(map[string]any{"keys": keys})
+	return b
+}
+
+func signJWT(t *testing.T, alg, kid string, key any, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]any{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, e := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		err = e
+		sig = make([]byte, 64)
+		if e == nil {
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	case "EdDSA":
+		sig = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signed))
+	case "none":
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func writeJWKS(t *testing.T, b []byte) string {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTVerify(t *testing.T) {
+	tk := newTestKeys(t)
+	ks := &jwks{file: writeJWKS(t, tk.jwksJSON()), refresh: time.Minute}
+	ja := &jwtAuth{
+		keys:       ks,
+		algorithms: []string{"HS256", "RS256", "ES256", "EdDSA"},
+		issuer:     "https://auth",
+		audience:   []string{"api", "other"},
+		leeway:     30 * time.Second,
+		requireExp: true,
+	}
+	now := time.Now()
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"iss": "https://auth", "aud": []any{"api"}, "sub": "joe",
+			"exp": now.Add(time.Minute).Unix()}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	tampered := signJWT(t, "RS256", "rsa", tk.rsa, claims(nil))
+	parts := strings.Split(tampered, ".")
+	parts[1] = b64([]byte(`{"sub":"admin"}`))
+	tampered = strings.Join(parts, ".")
+
+	var tests = []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"hs256", signJWT(t, "HS256", "hs", tk.hmac, claims(nil)), nil},
+		{"rs256", signJWT(t, "RS256", "rsa", tk.rsa, claims(nil)), nil},
+		{"es256", signJWT(t, "ES256", "ec", tk.ec, claims(nil)), nil},
+		{"eddsa", signJWT(t, "EdDSA", "ed", tk.ed, claims(nil)), nil},
+		{"no kid", signJWT(t, "RS256", "", tk.rsa, claims(nil)), nil},
+		{"string audience", signJWT(t, "RS256", "rsa", tk.rsa,
+			claims(map[string]any{"aud": "other"})), nil},
+		{"expired in leeway", signJWT(t, "RS256", "rsa", tk.rsa,
+			claims(map[string]any{"exp": now.Add(-10 * time.Second).Unix()})), nil},
+		{"expired", signJWT(t, "RS256", "rsa", tk.rsa,
+			claims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), invalidTokenError},
+		{"not valid yet", signJWT(t, "RS256", "rsa", tk.rsa,
+			claims(map[string]any{"nbf": now.Add(time.Minute).Unix()})), invalidTokenError},
+		{"bad issuer", signJWT(t, "RS256", "rsa", tk.rsa,
+			claims(map[string]any{"iss": "https://evil"})), invalidTokenError},
+		{"bad audience", signJWT(t, "RS256", "rsa", tk.rsa,
+			claims(map[string]any{"aud": "web"})), invalidTokenError},
+		{"bad exp", signJWT(t, "RS256", "rsa", tk.rsa,
+			claims(map[string]any{"exp": "tomorrow"})), invalidTokenError},
+		{"unknown key", signJWT(t, "RS256", "rsa", tk.other, claims(nil)), invalidTokenError},
+		{"wrong key type", signJWT(t, "ES256", "rsa", tk.ec, claims(nil)), invalidTokenError},
+		{"alg none", signJWT(t, "none", "", nil, claims(nil)), invalidTokenError},
+		{"tampered", tampered, invalidTokenError},
+		{"malformed", "a.b", invalidTokenError},
+		{"no exp", signJWT(t, "RS256", "rsa", tk.rsa, map[string]any{
+			"iss": "https://auth", "aud": "api", "sub": "joe"}), invalidTokenError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := ja.verify(test.token, now)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+			if err == nil && c["sub"] != "joe" {
+				t.Fatalf("bad claims %v", c)
+			}
+		})
+	}
+}
+
+func TestJWTCheckRequired(t *testing.T) {
+	ja := &jwtAuth{requiredClaims: map[string][]string{
+		"scope": {"read", "write"}, "groups": {"admin"}}}
+	var tests = []struct {
+		name   string
+		claims map[string]any
+		err    error
+	}{
+		{"ok", map[string]any{"scope": "read write delete", "groups": []any{"dev", "admin"}}, nil},
+		{"missing claim", map[string]any{"scope": "read write"}, insufficientScopeError},
+		{"missing value", map[string]any{"scope": "read", "groups": []any{"admin"}},
+			insufficientScopeError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ja.checkRequired(test.claims); !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestServeJWT(t *testing.T) {
+	tk := newTestKeys(t)
+	var p *myProxy
+	testProxy = func(rt *route, host string) httpProxy {
+		p = &myProxy{route: rt, host: host}
+		return p
+	}
+	defer func() { testProxy = nil }()
+
+	conf := map[string]any{
+		"host": "http://v1.bla",
+		"jwt": map[string]any{
+			"jwksFile":     writeJWKS(t, tk.jwksJSON()),
+			"audience":     []any{"api"},
+			"claimHeaders": map[string]any{"sub": "X-User-Id", "groups": "X-User-Groups"},
+		},
+		"routes": []any{
+			map[string]any{"pathPrefix": "/public", "jwt": map[string]any{"disabled": true}},
+			map[string]any{"pathPrefix": "/admin", "jwt": map[string]any{
+				"requiredClaims": map[string]any{"groups": "admin"}}},
+		},
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+	user := signJWT(t, "ES256", "ec", tk.ec, map[string]any{
+		"sub": "joe", "aud": "api", "exp": exp, "groups": []any{"dev", "ops"}})
+	admin := signJWT(t, "EdDSA", "ed", tk.ed, map[string]any{
+		"sub": "ann", "aud": "api", "exp": exp, "groups": []any{"admin"}})
+
+	var tests = []struct {
+		name      string
+		path      string
+		token     string
+		status    int
+		challenge string
+	}{
+		{"no token", "/", "", 401, `Bearer realm="tupi-proxy"`},
+		{"bad token", "/", "a.b.c", 401,
+			`Bearer realm="tupi-proxy", error="invalid_token", error_description="the token is invalid"`},
+		{"ok", "/", user, 200, ""},
+		{"public", "/public", "", 200, ""},
+		{"missing claim", "/admin", user, 403, `Bearer realm="tupi-proxy", error="insufficient_scope"`},
+		{"admin", "/admin", admin, 200, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p = nil
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", test.path, nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			// the client can't send the claims
+			r.Header.Set("X-User-Id", "root")
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+			if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), test.challenge) {
+				t.Fatalf("bad www-authenticate %s", w.Header().Get("WWW-Authenticate"))
+			}
+			if test.status != 200 || test.path == "/public" {
+				return
+			}
+			if test.token == user {
+				if v := p.pr.Out.Header.Values("X-User-Id"); len(v) != 1 || v[0] != "joe" {
+					t.Fatalf("bad user id %v", v)
+				}
+				if p.pr.Out.Header.Get("X-User-Groups") != "dev,ops" {
+					t.Fatalf("bad groups %s", p.pr.Out.Header.Get("X-User-Groups"))
+				}
+				if getRequestInfo(p.pr.In).identity != "joe" {
+					t.Fatalf("bad identity")
+				}
+			}
+		})
+	}
+}
+
+func TestServeJWTKeysUnavailable(t *testing.T) {
+	tk := newTestKeys(t)
+	jwksServer := httptest.NewServer(nil)
+	jwksURL := jwksServer.URL + "/jwks.json"
+	jwksServer.Close()
+	conf := map[string]any{
+		"host": "http://v1.bla",
+		"jwt":  map[string]any{"jwksUrl": jwksURL},
+	}
+	token := signJWT(t, "RS256", "rsa", tk.rsa, map[string]any{
+		"sub": "joe", "exp": time.Now().Add(time.Minute).Unix()})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	Serve(w, r, &conf)
+	if w.Code != 503 {
+		t.Fatalf("bad code %d", w.Code)
+	}
+	if w.Header().Get("WWW-Authenticate") != "" {
+		t.Fatalf("bad www-authenticate %s", w.Header().Get("WWW-Authenticate"))
+	}
+	if strings.Contains(w.Body.String(), jwksURL) {
+		t.Fatalf("error details sent %s", w.Body.String())
+	}
+}
+
+func TestParseJWT(t *testing.T) {
+	path := writeJWKS(t, newTestKeys(t).jwksJSON())
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"not a table", map[string]any{"jwt": "x"}, BadJWTError},
+		{"no keys", map[string]any{"jwt": map[string]any{}}, BadJWTError},
+		{"file and url", map[string]any{"jwt": map[string]any{
+			"jwksFile": path, "jwksUrl": "http://auth/jwks"}}, BadJWTError},
+		{"missing file", map[string]any{"jwt": map[string]any{
+			"jwksFile": path + ".missing"}}, BadJWTError},
+		{"bad url", map[string]any{"jwt": map[string]any{"jwksUrl": "ftp://auth"}}, BadJWTError},
+		{"bad algorithm", map[string]any{"jwt": map[string]any{
+			"secret": "s", "algorithms": []any{"none"}}}, BadJWTError},
+		{"bad require exp", map[string]any{"jwt": map[string]any{
+			"secret": "s", "requireExp": "no"}}, BadJWTError},
+		{"bad leeway", map[string]any{"jwt": map[string]any{
+			"secret": "s", "leeway": "x"}}, BadJWTError},
+		{"bad required claim", map[string]any{"jwt": map[string]any{
+			"secret": "s", "requiredClaims": map[string]any{"scope": 1}}}, BadJWTError},
+		{"bad claim header", map[string]any{"jwt": map[string]any{
+			"secret": "s", "claimHeaders": map[string]any{"sub": 1}}}, BadJWTError},
+		{"ok", map[string]any{"jwt": map[string]any{
+			"jwksFile": path, "issuer": "https://auth", "audience": []any{"api"},
+			"leeway": "30s", "requiredClaims": map[string]any{"scope": []any{"read"}}}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseJWT(test.conf, nil)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+
+	t.Run("inherited", func(t *testing.T) {
+		inherited, _ := parseJWT(map[string]any{"jwt": map[string]any{
+			"jwksFile": path, "issuer": "https://auth"}}, nil)
+		ja, err := parseJWT(map[string]any{"jwt": map[string]any{
+			"requiredClaims": map[string]any{"scope": "admin"}}}, inherited)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ja.keys != inherited.keys || ja.issuer != "https://auth" {
+			t.Fatalf("not inherited")
+		}
+		if inherited.requiredClaims != nil {
+			t.Fatalf("inherited changed")
+		}
+	})
+}
+
+func TestClaimString(t *testing.T) {
+	var tests = []struct {
+		claim any
+		value string
+	}{
+		{"joe", "joe"},
+		{[]any{"a", "b"}, "a,b"},
+		{float64(1700000000), "1700000000"},
+		{true, "true"},
+		{map[string]any{"a": "b"}, `{"a":"b"}`},
+	}
+	for _, test := range tests {
+		if v := claimString(test.claim); v != test.value {
+			t.Fatalf("bad value %s", v)
+		}
+	}
+}
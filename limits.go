@@ -0,0 +1,112 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var BadLimitsError error = errors.New("[tupi-proxy] Bad limits config")
+
+// requestLimits are limits on the size of the requests. Zero means
+// no limit.
+type requestLimits struct {
+	maxBodySize    int64
+	maxHeaders     int64
+	maxHeaderBytes int64
+	maxURLLength   int64
+}
+
+// check checks the request against the limits. It returns the status
+// for the response if the request must be rejected, or 0. Bodies
+// without Content-Length are limited while they are read.
+func (l *requestLimits) check(w http.ResponseWriter, r *http.Request) int {
+	if l.maxURLLength > 0 && int64(len(r.RequestURI)) > l.maxURLLength {
+		return http.StatusRequestURITooLong
+	}
+	if l.maxHeaders > 0 || l.maxHeaderBytes > 0 {
+		var count, size int64
+		for name, values := range r.Header {
+			for _, v := range values {
+				count++
+				// name: value\r\n
+				size += int64(len(name) + len(v) + 4)
+			}
+		}
+		if l.maxHeaders > 0 && count > l.maxHeaders {
+			return http.StatusRequestHeaderFieldsTooLarge
+		}
+		if l.maxHeaderBytes > 0 && size > l.maxHeaderBytes {
+			return http.StatusRequestHeaderFieldsTooLarge
+		}
+	}
+	if l.maxBodySize > 0 {
+		if r.ContentLength > l.maxBodySize {
+			return http.StatusRequestEntityTooLarge
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, l.maxBodySize)
+		}
+	}
+	return 0
+}
+
+// parseRequestLimits parses the `limits` key of the config like:
+// {"maxBodySize" = 10485760, "maxHeaders" = 100, "maxHeaderBytes" = 16384, "maxUrlLength" = 4096}
+// The keys not in the config keep the inherited values.
+func parseRequestLimits(c map[string]any, inherited *requestLimits) (*requestLimits, error) {
+	raw, exists, err := getMap(c, "limits")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadLimitsError, err)
+	}
+	if !exists {
+		return inherited, nil
+	}
+	l := &requestLimits{}
+	if inherited != nil {
+		*l = *inherited
+	}
+	values := []struct {
+		key  string
+		dest *int64
+	}{
+		{"maxBodySize", &l.maxBodySize},
+		{"maxHeaders", &l.maxHeaders},
+		{"maxHeaderBytes", &l.maxHeaderBytes},
+		{"maxUrlLength", &l.maxURLLength},
+	}
+	for _, v := range values {
+		n, exists, err := getInt(raw, v.key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadLimitsError, err)
+		}
+		if !exists {
+			continue
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("%w: %s can't be negative", BadLimitsError, v.key)
+		}
+		*v.dest = n
+	}
+	if *l == (requestLimits{}) {
+		return nil, nil
+	}
+	return l, nil
+}
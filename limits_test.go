@@ -0,0 +1,148 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLimitsCheck(t *testing.T) {
+	limits := &requestLimits{
+		maxBodySize:    10,
+		maxHeaders:     3,
+		maxHeaderBytes: 60,
+		maxURLLength:   20,
+	}
+	var tests = []struct {
+		name    string
+		path    string
+		headers map[string]string
+		body    string
+		status  int
+	}{
+		{"ok", "/", map[string]string{"A": "1"}, "small", 0},
+		{"long url", "/" + strings.Repeat("a", 20), nil, "", http.StatusRequestURITooLong},
+		{"many headers", "/", map[string]string{"A": "1", "B": "2", "C": "3", "D": "4"}, "",
+			http.StatusRequestHeaderFieldsTooLarge},
+		{"big headers", "/", map[string]string{"A": strings.Repeat("a", 60)}, "",
+			http.StatusRequestHeaderFieldsTooLarge},
+		{"big body", "/", nil, strings.Repeat("a", 11), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+			if status := limits.check(httptest.NewRecorder(), r); status != test.status {
+				t.Fatalf("bad status %d", status)
+			}
+		})
+	}
+
+	t.Run("streamed body", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", 11)))
+		r.ContentLength = -1
+		if status := limits.check(httptest.NewRecorder(), r); status != 0 {
+			t.Fatalf("bad status %d", status)
+		}
+		_, err := io.ReadAll(r.Body)
+		var maxBytesErr *http.MaxBytesError
+		if !errors.As(err, &maxBytesErr) {
+			t.Fatalf("bad err %v", err)
+		}
+	})
+}
+
+func TestParseRequestLimits(t *testing.T) {
+	inherited := &requestLimits{maxBodySize: 10, maxHeaders: 5}
+	var tests = []struct {
+		name     string
+		conf     map[string]any
+		expected *requestLimits
+		err      error
+	}{
+		{"inherited", map[string]any{}, inherited, nil},
+		{"not a table", map[string]any{"limits": "x"}, nil, BadLimitsError},
+		{"negative", map[string]any{"limits": map[string]any{"maxHeaders": -1}},
+			nil, BadLimitsError},
+		{"override", map[string]any{"limits": map[string]any{"maxBodySize": 20}},
+			&requestLimits{maxBodySize: 20, maxHeaders: 5}, nil},
+		{"no limits", map[string]any{"limits": map[string]any{
+			"maxBodySize": 0, "maxHeaders": 0}}, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := parseRequestLimits(test.conf, inherited)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+			if test.expected == nil && l != nil || test.expected != nil && *l != *test.expected {
+				t.Fatalf("bad limits %+v", l)
+			}
+		})
+	}
+}
+
+func TestServeBodyLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.ReadAll(r.Body)
+			w.Write([]byte("ok"))
+		}))
+	defer upstream.Close()
+	testProxy = nil
+
+	conf := map[string]any{
+		"host":   upstream.URL,
+		"limits": map[string]any{"maxBodySize": 10},
+		"routes": []any{
+			map[string]any{"pathPrefix": "/upload", "limits": map[string]any{"maxBodySize": 100}},
+		},
+	}
+	var tests = []struct {
+		name          string
+		path          string
+		body          string
+		contentLength bool
+		status        int
+	}{
+		{"small", "/", "small", true, 200},
+		{"content length", "/", strings.Repeat("a", 11), true, 413},
+		{"streamed", "/", strings.Repeat("a", 11), false, 413},
+		{"route limit", "/upload", strings.Repeat("a", 50), false, 200},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+			if !test.contentLength {
+				r.ContentLength = -1
+			}
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var BadLogOutputError error = errors.New("[tupi-proxy] Bad log output config")
+
+// requestLogger returns the logger for the messages about a request.
+// The plugin uses the default slog logger so the messages go wherever
+// the tupi messages go.
+func requestLogger(info *requestInfo) *slog.Logger {
+	l := slog.Default()
+	if info.requestID != "" {
+		l = l.With("requestId", info.requestID)
+	}
+	return l
+}
+
+func logRequest(r *http.Request) *slog.Logger {
+	return requestLogger(getRequestInfo(r))
+}
+
+const (
+	defaultLogMaxSize    = 100 * 1024 * 1024
+	defaultLogMaxBackups = 5
+)
+
+// rotatingFile is a file that is rotated when it reaches maxSize.
+// The old files are named path.1, path.2... up to maxBackups.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = st.Size()
+	return nil
+}
+
+// setLimits changes the rotation limits of an open file.
+func (rf *rotatingFile) setLimits(maxSize int64, maxBackups int) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.maxSize = maxSize
+	rf.maxBackups = maxBackups
+}
+
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	if rf.maxBackups <= 0 {
+		os.Remove(rf.path)
+	}
+	for i := rf.maxBackups; i > 0; i-- {
+		src := rf.path
+		if i > 1 {
+			src = rf.path + "." + strconv.Itoa(i-1)
+		}
+		os.Rename(src, rf.path+"."+strconv.Itoa(i))
+	}
+	return rf.open()
+}
+
+// logOutputs are shared by configs so config reloads do not open the
+// same file or socket again.
+var logOutputs = map[string]io.Writer{}
+var logOutputsMutex sync.Mutex
+
+// parseLogOutput returns the writer for a log output config like:
+// {"output" = "file", "path" = "/var/log/access.log", "maxSize" = 1048576}
+// Outputs may be stdout, stderr, file or syslog.
+func parseLogOutput(c map[string]any) (io.Writer, error) {
+	output, exists, err := getString(c, "output")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadLogOutputError, err)
+	}
+	if !exists {
+		output = "stdout"
+	}
+	switch output {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	case "file":
+		return parseFileOutput(c)
+	case "syslog":
+		return parseSyslogOutput(c)
+	}
+	return nil, fmt.Errorf(
+		"%w: output must be stdout, stderr, file or syslog", BadLogOutputError)
+}
+
+func parseFileOutput(c map[string]any) (io.Writer, error) {
+	path, _, err := getString(c, "path")
+	if err != nil || path == "" {
+		return nil, fmt.Errorf("%w: file output needs a path", BadLogOutputError)
+	}
+	maxSize, exists, err := getInt(c, "maxSize")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadLogOutputError, err)
+	}
+	if !exists {
+		maxSize = defaultLogMaxSize
+	}
+	maxBackups, exists, err := getInt(c, "maxBackups")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadLogOutputError, err)
+	}
+	if !exists {
+		maxBackups = defaultLogMaxBackups
+	}
+
+	logOutputsMutex.Lock()
+	defer logOutputsMutex.Unlock()
+	key := "file " + path
+	if w, ok := logOutputs[key]; ok {
+		// the file is kept open and a reload may change the limits
+		rf := w.(*rotatingFile)
+		rf.setLimits(maxSize, int(maxBackups))
+		return rf, nil
+	}
+	rf, err := openRotatingFile(path, maxSize, int(maxBackups))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadLogOutputError, err)
+	}
+	logOutputs[key] = rf
+	return rf, nil
+}
+
+// parseSyslogOutput returns a writer to the local syslog. If no socket
+// is given the usual sockets (/dev/log...) are tried.
+func parseSyslogOutput(c map[string]any) (io.Writer, error) {
+	socket, _, err := getString(c, "socket")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadLogOutputError, err)
+	}
+	tag, exists, err := getString(c, "tag")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadLogOutputError, err)
+	}
+	if !exists {
+		tag = "tupi-proxy"
+	}
+
+	logOutputsMutex.Lock()
+	defer logOutputsMutex.Unlock()
+	key := "syslog " + socket + " " + tag
+	if w, ok := logOutputs[key]; ok {
+		return w, nil
+	}
+	network := ""
+	if socket != "" {
+		network = "unixgram"
+	}
+	w, err := syslog.Dial(network, socket, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadLogOutputError, err)
+	}
+	logOutputs[key] = w
+	return w, nil
+}
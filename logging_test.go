@@ -0,0 +1,103 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("bad open %s", err.Error())
+	}
+	for _, l := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		rf.Write([]byte(l))
+	}
+
+	var tests = []struct {
+		path    string
+		content string
+	}{
+		{path, "fourth\n"},
+		{path + ".1", "third\n"},
+		{path + ".2", "second\n"},
+	}
+	for _, test := range tests {
+		b, _ := os.ReadFile(test.path)
+		if !bytes.Equal(b, []byte(test.content)) {
+			t.Fatalf("bad content for %s: %s", test.path, string(b))
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Fatalf("too many backups")
+	}
+}
+
+func TestFileOutputReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	w, err := parseLogOutput(map[string]any{
+		"output": "file", "path": path, "maxSize": 10, "maxBackups": 1})
+	if err != nil {
+		t.Fatalf("bad err %s", err.Error())
+	}
+	nw, err := parseLogOutput(map[string]any{
+		"output": "file", "path": path, "maxSize": 100, "maxBackups": 3})
+	if err != nil {
+		t.Fatalf("bad err %s", err.Error())
+	}
+	if nw != w {
+		t.Fatalf("file opened again")
+	}
+	rf := w.(*rotatingFile)
+	if rf.maxSize != 100 || rf.maxBackups != 3 {
+		t.Fatalf("bad limits %d %d", rf.maxSize, rf.maxBackups)
+	}
+}
+
+func TestSyslogOutput(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("bad listen %s", err.Error())
+	}
+	defer conn.Close()
+
+	w, err := parseLogOutput(map[string]any{"output": "syslog", "socket": socket})
+	if err != nil {
+		t.Fatalf("bad output %s", err.Error())
+	}
+	w.Write([]byte("a line\n"))
+	b := make([]byte, 1024)
+	n, _ := conn.Read(b)
+	msg := string(b[:n])
+	if !strings.Contains(msg, "tupi-proxy") || !strings.Contains(msg, "a line") {
+		t.Fatalf("bad message %s", msg)
+	}
+
+	again, _ := parseLogOutput(map[string]any{"output": "syslog", "socket": socket})
+	if again != w {
+		t.Fatalf("output not shared")
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var BadMetricsError error = errors.New("[tupi-proxy] Bad metrics config")
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+var defaultBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricVec is a metric with labels in the prometheus text format.
+type metricVec struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+func newMetricVec(kind, name, help string, labelNames ...string) *metricVec {
+	m := &metricVec{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     map[string]*series{},
+	}
+	if kind == metricHistogram {
+		m.buckets = defaultBuckets
+	}
+	return m
+}
+
+func (m *metricVec) get(labels []string) *series {
+	key := strings.Join(labels, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		if m.kind == metricHistogram {
+			s.buckets = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) add(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value += v
+}
+
+func (m *metricVec) set(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value = v
+}
+
+func (m *metricVec) observe(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labels)
+	s.value += v
+	s.count++
+	for i, b := range m.buckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		labels := m.formatLabels(s.labels, "")
+		if m.kind != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatFloat(s.value))
+			continue
+		}
+		for i, b := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name,
+				m.formatLabels(s.labels, formatFloat(b)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.formatLabels(s.labels, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
+
+func (m *metricVec) formatLabels(values []string, le string) string {
+	var parts []string
+	for i, n := range m.labelNames {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		parts = append(parts, n+`="`+escapeLabel(v)+`"`)
+	}
+	if le != "" {
+		parts = append(parts, `le="`+le+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricsRegistry has all the metrics of the plugin. The metrics are
+// shared by all the domains using the plugin.
+type metricsRegistry struct {
+	metrics []*metricVec
+}
+
+func (mr *metricsRegistry) register(m *metricVec) *metricVec {
+	mr.metrics = append(mr.metrics, m)
+	return m
+}
+
+func (mr *metricsRegistry) write(w io.Writer) {
+	for _, m := range mr.metrics {
+		m.write(w)
+	}
+}
+
+func (mr *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mr.write(w)
+}
+
+var metrics = &metricsRegistry{}
+
+var (
+	requestsTotal = metrics.register(newMetricVec(metricCounter,
+		"tupi_proxy_requests_total", "Requests proxied.",
+		"route", "upstream", "code"))
+	requestDuration = metrics.register(newMetricVec(metricHistogram,
+		"tupi_proxy_request_duration_seconds", "Total time to serve a request.",
+		"route", "upstream"))
+	upstreamTTFB = metrics.register(newMetricVec(metricHistogram,
+		"tupi_proxy_upstream_ttfb_seconds",
+		"Time until the upstream response headers are received.",
+		"route", "upstream"))
+	requestsInFlight = metrics.register(newMetricVec(metricGauge,
+		"tupi_proxy_requests_in_flight", "Requests being served."))
+	wsTunnelsActive = metrics.register(newMetricVec(metricGauge,
+		"tupi_proxy_websocket_tunnels_active", "Open websocket tunnels.",
+		"route", "upstream"))
+	bytesIn = metrics.register(newMetricVec(metricCounter,
+		"tupi_proxy_received_bytes_total", "Bytes received from clients.",
+		"route", "upstream"))
+	bytesOut = metrics.register(newMetricVec(metricCounter,
+		"tupi_proxy_sent_bytes_total", "Bytes sent to clients.",
+		"route", "upstream"))
+	upstreamErrors = metrics.register(newMetricVec(metricCounter,
+		"tupi_proxy_upstream_errors_total", "Errors talking to upstreams.",
+		"route", "upstream", "type"))
+	shadowMismatches = metrics.register(newMetricVec(metricCounter,
+		"tupi_proxy_shadow_mismatches_total",
+		"Shadow responses different from the primary response.",
+		"shadow"))
+	rateLimited = metrics.register(newMetricVec(metricCounter,
+		"tupi_proxy_rate_limited_total",
+		"Requests denied by the rate limit.", "route"))
+	ipDenied = metrics.register(newMetricVec(metricCounter,
+		"tupi_proxy_ip_denied_total",
+		"Requests denied by the ip access lists.", "route"))
+	concurrencyLimit = metrics.register(newMetricVec(metricGauge,
+		"tupi_proxy_concurrency_limit",
+		"Current concurrency limit of the upstream.", "upstream"))
+	concurrencyRejected = metrics.register(newMetricVec(metricCounter,
+		"tupi_proxy_concurrency_rejected_total",
+		"Requests rejected by the concurrency limit.", "route", "upstream"))
+	queueDepth = metrics.register(newMetricVec(metricGauge,
+		"tupi_proxy_queue_depth",
+		"Requests waiting for the concurrency limit of the upstream.", "upstream"))
+	queueWait = metrics.register(newMetricVec(metricHistogram,
+		"tupi_proxy_queue_wait_seconds",
+		"Time waiting for the concurrency limit.", "upstream", "class"))
+)
+
+// codeClass returns the class of a status code, ie: 2xx
+func codeClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(b)
+	cr.n += int64(n)
+	return n, err
+}
+
+// requestMetrics are collected while a request is served.
+type requestMetrics struct {
+	start time.Time
+	body  *countingReader
+}
+
+func startRequestMetrics(r *http.Request) *requestMetrics {
+	requestsInFlight.add(1)
+	rm := &requestMetrics{start: time.Now()}
+	if r.Body != nil && r.Body != http.NoBody {
+		rm.body = &countingReader{ReadCloser: r.Body}
+		r.Body = rm.body
+	}
+	return rm
+}
+
+func (rm *requestMetrics) finish(info *requestInfo, rw *responseWriter) {
+	requestsInFlight.add(-1)
+	status := rw.status
+	if info.upgraded {
+		status = http.StatusSwitchingProtocols
+	}
+	requestsTotal.add(1, info.route, info.upstream, codeClass(status))
+	requestDuration.observe(time.Since(rm.start).Seconds(), info.route, info.upstream)
+	in := info.wsBytesIn.Load()
+	if rm.body != nil {
+		in += rm.body.n
+	}
+	bytesIn.add(float64(in), info.route, info.upstream)
+	bytesOut.add(float64(rw.bytes+info.wsBytesOut.Load()), info.route, info.upstream)
+}
+
+// serveMetrics serves the metrics path. The ip access lists of the
+// route matching the path are checked.
+func (pc *proxyConfig) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	info := pc.trustedProxies.resolve(r)
+	r = withRequestInfo(r, info)
+	rt := pc.matchRoute(r)
+	if rt.ipAccess != nil && !rt.ipAccess.allowed(info) {
+		ipDenied.add(1, rt.name)
+		writeError(w, r, http.StatusForbidden, "ip not allowed")
+		return
+	}
+	metrics.ServeHTTP(w, r)
+}
+
+// metricsConfig tells where the metrics are exposed.
+type metricsConfig struct {
+	// path intercepted in Serve
+	path string
+	// address of a dedicated listener
+	listen string
+}
+
+var metricsListeners = map[string]net.Listener{}
+var metricsListenersMutex sync.Mutex
+
+// startMetricsListener starts a http server for the metrics. Only one
+// server is started for an address.
+func startMetricsListener(addr string) error {
+	metricsListenersMutex.Lock()
+	defer metricsListenersMutex.Unlock()
+	if _, ok := metricsListeners[addr]; ok {
+		return nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	metricsListeners[addr] = l
+	go func() {
+		err := http.Serve(l, metrics)
+		slog.Error("metrics listener error", "error", err)
+	}()
+	return nil
+}
+
+func parseMetrics(c map[string]any) (*metricsConfig, error) {
+	raw, exists, err := getMap(c, "metrics")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadMetricsError, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	mc := &metricsConfig{}
+	mc.path, _, err = getString(raw, "path")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadMetricsError, err)
+	}
+	mc.listen, _, err = getString(raw, "listen")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadMetricsError, err)
+	}
+	if mc.path == "" && mc.listen == "" {
+		return nil, fmt.Errorf("%w: path or listen is needed", BadMetricsError)
+	}
+	return mc, nil
+}
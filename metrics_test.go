@@ -0,0 +1,199 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricVecWrite(t *testing.T) {
+	c := newMetricVec(metricCounter, "c_total", "A counter.", "a", "b")
+	c.add(1, "x", `q"uo\te`)
+	c.add(2, "x", `q"uo\te`)
+	g := newMetricVec(metricGauge, "g", "A gauge.")
+	g.set(5)
+	h := newMetricVec(metricHistogram, "h_seconds", "A histogram.", "a")
+	h.buckets = []float64{0.1, 1}
+	h.observe(0.05, "x")
+	h.observe(0.5, "x")
+	h.observe(2, "x")
+
+	var b bytes.Buffer
+	c.write(&b)
+	g.write(&b)
+	h.write(&b)
+	expected := `# HELP c_total A counter.
+# TYPE c_total counter
+c_total{a="x",b="q\"uo\\te"} 3
+# HELP g A gauge.
+# TYPE g gauge
+g 5
+# HELP h_seconds A histogram.
+# TYPE h_seconds histogram
+h_seconds_bucket{a="x",le="0.1"} 1
+h_seconds_bucket{a="x",le="1"} 2
+h_seconds_bucket{a="x",le="+Inf"} 3
+h_seconds_sum{a="x"} 2.55
+h_seconds_count{a="x"} 3
+`
+	if b.String() != expected {
+		t.Fatalf("bad output %s", b.String())
+	}
+}
+
+func TestCodeClass(t *testing.T) {
+	var tests = []struct {
+		status int
+		class  string
+	}{
+		{200, "2xx"}, {404, "4xx"}, {502, "5xx"}, {0, "unknown"},
+	}
+	for _, test := range tests {
+		if codeClass(test.status) != test.class {
+			t.Fatalf("bad class for %d", test.status)
+		}
+	}
+}
+
+func TestParseMetrics(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"no metrics", map[string]any{}, nil},
+		{"not a table", map[string]any{"metrics": "x"}, BadMetricsError},
+		{"empty", map[string]any{"metrics": map[string]any{}}, BadMetricsError},
+		{"bad path", map[string]any{"metrics": map[string]any{"path": 1}}, BadMetricsError},
+		{"ok", map[string]any{"metrics": map[string]any{"path": "/metrics"}}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseMetrics(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.ReadAll(r.Body)
+			w.Write([]byte("hello"))
+		}))
+	defer upstream.Close()
+
+	conf := map[string]any{
+		"host":    upstream.URL,
+		"metrics": map[string]any{"path": "/_metrics"},
+		"routes": []any{
+			map[string]any{"name": "metrics-test", "pathPrefix": "/m"},
+		},
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/m", strings.NewReader("the body"))
+	Serve(w, r, &conf)
+	if w.Body.String() != "hello" {
+		t.Fatalf("bad body %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/_metrics", nil)
+	Serve(w, r, &conf)
+	out := w.Body.String()
+	up := strings.TrimPrefix(upstream.URL, "http://")
+	for _, line := range []string{
+		`tupi_proxy_requests_total{route="metrics-test",upstream="` + up + `",code="2xx"} 1`,
+		`tupi_proxy_request_duration_seconds_count{route="metrics-test",upstream="` + up + `"} 1`,
+		`tupi_proxy_upstream_ttfb_seconds_count{route="metrics-test",upstream="` + up + `"} 1`,
+		`tupi_proxy_received_bytes_total{route="metrics-test",upstream="` + up + `"} 8`,
+		`tupi_proxy_sent_bytes_total{route="metrics-test",upstream="` + up + `"} 5`,
+		`tupi_proxy_requests_in_flight 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Fatalf("missing %s in %s", line, out)
+		}
+	}
+}
+
+func TestServeMetricsIPAccess(t *testing.T) {
+	conf := map[string]any{
+		"host":     "http://v1.bla",
+		"metrics":  map[string]any{"path": "/_metrics"},
+		"ipAccess": map[string]any{"allow": []any{"10.0.0.0/8"}},
+	}
+	var tests = []struct {
+		name       string
+		remoteAddr string
+		status     int
+	}{
+		{"allowed", "10.0.0.1:1234", 200},
+		{"denied", "1.2.3.4:1234", 403},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/_metrics", nil)
+			r.RemoteAddr = test.remoteAddr
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+			if test.status == 403 && strings.Contains(w.Body.String(), "tupi_proxy") {
+				t.Fatalf("metrics served")
+			}
+		})
+	}
+}
+
+func TestMetricsListener(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	conf := map[string]any{
+		"host":    "http://v1.bla",
+		"metrics": map[string]any{"listen": addr},
+	}
+	if err := Init("some.domain", &conf); err != nil {
+		t.Fatal(err)
+	}
+	// reload does not start a new listener
+	if err := Init("some.domain", &conf); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(b), "# TYPE tupi_proxy_requests_total counter") {
+		t.Fatalf("bad metrics %s", string(b))
+	}
+}
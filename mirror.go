@@ -0,0 +1,242 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var BadMirrorError error = errors.New("[tupi-proxy] Bad mirror config")
+
+const (
+	defaultMirrorMaxBody = 64 * 1024
+	defaultMirrorTimeout = 5 * time.Second
+)
+
+// hopHeaders are removed from requests sent to the shadow upstreams.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// mirror sends a copy of a sample of the requests to shadow upstreams.
+// The responses of the shadow upstreams are discarded.
+type mirror struct {
+	hosts []*url.URL
+	// percentage of requests mirrored. From 0 to 100.
+	percentage float64
+	// requests with bigger bodies are not mirrored
+	maxBody int64
+	timeout time.Duration
+	// if not nil, the shadow responses are compared to the primary one
+	compare *shadowCompare
+}
+
+var mirrorClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func (m *mirror) sample() bool {
+	if m.percentage >= 100 {
+		return true
+	}
+	return rand.Float64()*100 < m.percentage
+}
+
+// readBody reads up to maxBody bytes of the request body. The request
+// body is replaced so the primary upstream still gets the whole body.
+// The returned bool is false if the body is bigger than maxBody.
+func (m *mirror) readBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.maxBody {
+		return nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, m.maxBody+1))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	if err != nil || int64(len(buf)) > m.maxBody {
+		return nil, false
+	}
+	return buf, true
+}
+
+// shadowRequest returns a copy of the request to be sent to a
+// shadow upstream.
+func shadowRequest(ctx context.Context, r *http.Request, rt *route,
+	host *url.URL, body []byte) *http.Request {
+	sr := r.Clone(ctx)
+	sr.RequestURI = ""
+	sr.Host = ""
+	rt.rewrite.apply(sr.URL)
+	setUpstreamURL(sr.URL, host)
+	for _, h := range hopHeaders {
+		sr.Header.Del(h)
+	}
+	rt.forwarded.setForwarded(sr, r)
+	rt.requestHeaders.apply(sr.Header, getRequestInfo(r))
+	sr.Body = nil
+	sr.ContentLength = int64(len(body))
+	if len(body) > 0 {
+		sr.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	rt.signing.sign(sr)
+	return sr
+}
+
+// send sends the request to the shadow upstreams. It returns immediately
+// and the requests are sent in background. When the responses are
+// compared the returned writer records the primary response and the
+// returned function must be called when the primary response is done.
+func (m *mirror) send(w http.ResponseWriter, r *http.Request, rt *route) (http.ResponseWriter, func()) {
+	noop := func() {}
+	if !m.sample() {
+		return w, noop
+	}
+	body, ok := m.readBody(r)
+	if !ok {
+		return w, noop
+	}
+	var rec *responseRecorder
+	if m.compare != nil {
+		rec = newResponseRecorder(w, m.compare.maxBody)
+	}
+	info := getRequestInfo(r)
+	for _, h := range m.hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		sr := shadowRequest(ctx, r, rt, h, body)
+		go func() {
+			defer cancel()
+			resp, err := mirrorClient.Do(sr)
+			if err != nil {
+				requestLogger(info).Warn("mirror error", "error", err)
+				return
+			}
+			defer resp.Body.Close()
+			if rec == nil {
+				io.Copy(io.Discard, resp.Body)
+				return
+			}
+			shadow, err := readShadowResponse(resp, m.compare.maxBody)
+			if err != nil {
+				requestLogger(info).Warn("mirror error", "error", err)
+				return
+			}
+			<-rec.done
+			m.compare.compare(info, h.Host, &rec.resp, shadow)
+		}()
+	}
+	if rec == nil {
+		return w, noop
+	}
+	return rec, rec.finish
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// parseMirror parses the `mirror` key of the config. If there is no
+// mirror key the inherited one is returned.
+func parseMirror(c map[string]any, inherited *mirror) (*mirror, error) {
+	raw, exists, err := getMap(c, "mirror")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadMirrorError, err)
+	}
+	if !exists {
+		return inherited, nil
+	}
+	disabled, _, err := getBool(raw, "disabled")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadMirrorError, err)
+	}
+	if disabled {
+		return nil, nil
+	}
+
+	hosts, _, err := getStringList(raw, "hosts")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadMirrorError, err)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("%w: no hosts", BadMirrorError)
+	}
+	m := &mirror{
+		percentage: 100,
+		maxBody:    defaultMirrorMaxBody,
+		timeout:    defaultMirrorTimeout,
+	}
+	for _, h := range hosts {
+		u, err := url.Parse(h)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("%w: bad host %s", BadMirrorError, h)
+		}
+		m.hosts = append(m.hosts, u)
+	}
+
+	p, exists, err := getFloat(raw, "percentage")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadMirrorError, err)
+	}
+	if exists {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("%w: percentage must be between 0 and 100", BadMirrorError)
+		}
+		m.percentage = p
+	}
+
+	maxBody, exists, err := getInt(raw, "maxBodySize")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadMirrorError, err)
+	}
+	if exists {
+		m.maxBody = maxBody
+	}
+
+	timeout, exists, err := getDuration(raw, "timeout")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadMirrorError, err)
+	}
+	if exists {
+		m.timeout = timeout
+	}
+
+	m.compare, err = parseShadowCompare(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadMirrorError, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMirror(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{
+			"no mirror",
+			map[string]any{},
+			nil,
+		},
+		{
+			"no hosts",
+			map[string]any{"mirror": map[string]any{}},
+			BadMirrorError,
+		},
+		{
+			"bad host",
+			map[string]any{"mirror": map[string]any{"hosts": []any{"nada"}}},
+			BadMirrorError,
+		},
+		{
+			"bad percentage",
+			map[string]any{"mirror": map[string]any{
+				"hosts": []any{"http://shadow.bla"}, "percentage": -1}},
+			BadMirrorError,
+		},
+		{
+			"bad timeout",
+			map[string]any{"mirror": map[string]any{
+				"hosts": []any{"http://shadow.bla"}, "timeout": "x"}},
+			BadMirrorError,
+		},
+		{
+			"ok",
+			map[string]any{"mirror": map[string]any{
+				"hosts":       []any{"http://shadow.bla"},
+				"percentage":  int64(10),
+				"maxBodySize": int64(10),
+				"timeout":     "1s",
+			}},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseMirror(test.conf, nil)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestServeMirror(t *testing.T) {
+	defer func() {
+		testProxy = nil
+	}()
+
+	type shadowReq struct {
+		path string
+		body string
+	}
+	received := make(chan shadowReq, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			received <- shadowReq{r.URL.Path, string(b)}
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+	defer shadow.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+		}))
+	defer slow.Close()
+
+	var tests = []struct {
+		name     string
+		conf     map[string]any
+		body     string
+		mirrored bool
+	}{
+		{
+			"mirrored",
+			map[string]any{
+				"host":        "http://v1.bla",
+				"stripPrefix": "/api",
+				"mirror": map[string]any{
+					"hosts":   []any{shadow.URL, slow.URL},
+					"timeout": int64(50),
+				},
+			},
+			"the body",
+			true,
+		},
+		{
+			"not sampled",
+			map[string]any{
+				"host": "http://v1.bla",
+				"mirror": map[string]any{
+					"hosts":      []any{shadow.URL},
+					"percentage": 0,
+				},
+			},
+			"the body",
+			false,
+		},
+		{
+			"body too big",
+			map[string]any{
+				"host": "http://v1.bla",
+				"mirror": map[string]any{
+					"hosts":       []any{shadow.URL},
+					"maxBodySize": 3,
+				},
+			},
+			"the body",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var primaryBody string
+			testProxy = func(rt *route, host string) httpProxy {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					b, _ := io.ReadAll(r.Body)
+					primaryBody = string(b)
+				})
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/api/users", strings.NewReader(test.body))
+			r.ContentLength = -1
+			start := time.Now()
+			Serve(w, r, &test.conf)
+			if time.Since(start) > 250*time.Millisecond {
+				t.Fatalf("primary waited for the shadow")
+			}
+			if primaryBody != test.body {
+				t.Fatalf("bad primary body %s", primaryBody)
+			}
+
+			select {
+			case sr := <-received:
+				if !test.mirrored {
+					t.Fatalf("request mirrored")
+				}
+				if sr.path != "/users" || sr.body != test.body {
+					t.Fatalf("bad shadow request %v", sr)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if test.mirrored {
+					t.Fatalf("request not mirrored")
+				}
+			}
+		})
+	}
+}
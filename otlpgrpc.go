@@ -0,0 +1,193 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+)
+
+const otlpGRPCPath = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+
+// grpcTransport returns the http/2 transport for a grpc endpoint.
+// Endpoints with the http scheme use http/2 without tls (h2c), the
+// usual for collectors.
+func grpcTransport(endpoint string) http.RoundTripper {
+	t := &http.Transport{Protocols: new(http.Protocols)}
+	if strings.HasPrefix(endpoint, "https://") {
+		t.Protocols.SetHTTP2(true)
+	} else {
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return t
+}
+
+// sendGRPC sends the spans with the Export method of the grpc trace
+// service.
+func (e *otlpExporter) sendGRPC(ctx context.Context, spans []*span) error {
+	msg := encodeTraceRequest(e.serviceName, spans)
+	// grpc message: not compressed flag, length and the message
+	body := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+	body = append(body, msg...)
+	hreq, err := http.NewRequestWithContext(ctx, "POST",
+		strings.TrimSuffix(e.endpoint, "/")+otlpGRPCPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("Te", "trailers")
+	for k, v := range e.headers {
+		hreq.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// the trailers are available after the body is read
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	msgHeader := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// trailers only response
+		status = resp.Header.Get("Grpc-Status")
+		msgHeader = resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("collector returned grpc status %s: %s", status, msgHeader)
+	}
+	return nil
+}
+
+// protoBuffer encodes protobuf messages. Only what is needed for the
+// OTLP trace messages.
+type protoBuffer struct {
+	b []byte
+}
+
+func (p *protoBuffer) tag(field, wireType int) {
+	p.b = binary.AppendUvarint(p.b, uint64(field<<3|wireType))
+}
+
+func (p *protoBuffer) varint(field int, v uint64) {
+	p.tag(field, 0)
+	p.b = binary.AppendUvarint(p.b, v)
+}
+
+func (p *protoBuffer) fixed64(field int, v uint64) {
+	p.tag(field, 1)
+	p.b = binary.LittleEndian.AppendUint64(p.b, v)
+}
+
+func (p *protoBuffer) bytes(field int, b []byte) {
+	p.tag(field, 2)
+	p.b = binary.AppendUvarint(p.b, uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *protoBuffer) string(field int, s string) {
+	if s != "" {
+		p.bytes(field, []byte(s))
+	}
+}
+
+func (p *protoBuffer) message(field int, m *protoBuffer) {
+	p.bytes(field, m.b)
+}
+
+// encodeTraceRequest encodes an ExportTraceServiceRequest. See
+// https://github.com/open-telemetry/opentelemetry-proto
+func encodeTraceRequest(serviceName string, spans []*span) []byte {
+	resource := &protoBuffer{}
+	resource.message(1, encodeKeyValue(attribute{"service.name", serviceName}))
+	scope := &protoBuffer{}
+	scope.string(1, "tupi-proxy")
+	pss := &protoBuffer{}
+	pss.message(1, scope)
+	for _, s := range spans {
+		pss.message(2, encodeSpan(s))
+	}
+	prs := &protoBuffer{}
+	prs.message(1, resource)
+	prs.message(2, pss)
+	out := &protoBuffer{}
+	out.message(1, prs)
+	return out.b
+}
+
+func encodeSpan(s *span) *protoBuffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := &protoBuffer{}
+	p.bytes(1, s.ctx.traceID[:])
+	p.bytes(2, s.ctx.spanID[:])
+	p.string(3, s.ctx.traceState)
+	if s.parentID != [8]byte{} {
+		p.bytes(4, s.parentID[:])
+	}
+	p.string(5, s.name)
+	p.varint(6, uint64(s.kind))
+	p.fixed64(7, uint64(s.start.UnixNano()))
+	p.fixed64(8, uint64(s.end.UnixNano()))
+	for _, a := range s.attrs {
+		p.message(9, encodeKeyValue(a))
+	}
+	status := &protoBuffer{}
+	status.string(2, s.statusMsg)
+	if s.status != 0 {
+		status.varint(3, uint64(s.status))
+	}
+	p.message(15, status)
+	return p
+}
+
+// encodeKeyValue encodes an attribute with the same value types of the
+// json encoding.
+func encodeKeyValue(a attribute) *protoBuffer {
+	value := &protoBuffer{}
+	switch v := a.value.(type) {
+	case bool:
+		b := uint64(0)
+		if v {
+			b = 1
+		}
+		value.varint(2, b)
+	case int:
+		value.varint(3, uint64(v))
+	case int64:
+		value.varint(3, uint64(v))
+	case float64:
+		value.fixed64(4, math.Float64bits(v))
+	default:
+		value.bytes(1, []byte(fmt.Sprint(v)))
+	}
+	kv := &protoBuffer{}
+	kv.string(1, a.key)
+	kv.message(2, value)
+	return kv
+}
@@ -0,0 +1,207 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// protoFields decodes the fields of a protobuf message. Varints and
+// fixed64 are returned as 8 little endian bytes.
+func protoFields(t *testing.T, b []byte) map[int][][]byte {
+	fields := map[int][][]byte{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad tag")
+		}
+		b = b[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatalf("bad varint")
+			}
+			b = b[n:]
+			fields[field] = append(fields[field], binary.LittleEndian.AppendUint64(nil, v))
+		case 1:
+			fields[field] = append(fields[field], b[:8])
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				t.Fatalf("bad length")
+			}
+			fields[field] = append(fields[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("bad wire type %d", tag&7)
+		}
+	}
+	return fields
+}
+
+// grpcCollector is a stand-in for an OpenTelemetry collector taking
+// grpc.
+type grpcCollector struct {
+	t      *testing.T
+	status string
+	mu     sync.Mutex
+	// span name to span fields
+	spans map[string]map[int][][]byte
+	auth  string
+}
+
+func (c *grpcCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || r.URL.Path != otlpGRPCPath ||
+		r.Header.Get("Content-Type") != "application/grpc" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	msg := body[5:]
+	if int(binary.BigEndian.Uint32(body[1:5])) != len(msg) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.auth = r.Header.Get("Authorization")
+	for _, rs := range protoFields(c.t, msg)[1] {
+		for _, ss := range protoFields(c.t, rs)[2] {
+			for _, s := range protoFields(c.t, ss)[2] {
+				f := protoFields(c.t, s)
+				c.spans[string(f[5][0])] = f
+			}
+		}
+	}
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Grpc-Status", c.status)
+	w.Header().Set("Grpc-Message", "some message")
+}
+
+func newGRPCCollector(t *testing.T, status string) (*grpcCollector, *httptest.Server) {
+	c := &grpcCollector{t: t, status: status, spans: map[string]map[int][][]byte{}}
+	// http/2 without tls, like the collectors usually take
+	s := httptest.NewUnstartedServer(c)
+	s.Config.Protocols = new(http.Protocols)
+	s.Config.Protocols.SetUnencryptedHTTP2(true)
+	s.Start()
+	t.Cleanup(s.Close)
+	return c, s
+}
+
+func TestServeTracingGRPC(t *testing.T) {
+	col, colServer := newGRPCCollector(t, "0")
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	conf := map[string]any{
+		"host": upstream.URL,
+		"tracing": map[string]any{
+			"endpoint": colServer.URL,
+			"protocol": "grpc",
+			"headers":  map[string]any{"Authorization": "Bearer x"},
+		},
+	}
+	pc, err := getProxyConfig(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.Header.Set("Traceparent", incoming)
+	Serve(w, r, &conf)
+	if err := pc.tracer.exporter.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	server, ok := col.spans["GET default"]
+	if !ok {
+		t.Fatalf("no server span %v", col.spans)
+	}
+	if hex.EncodeToString(server[1][0]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		hex.EncodeToString(server[4][0]) != "00f067aa0ba902b7" ||
+		binary.LittleEndian.Uint64(server[6][0]) != spanKindServer {
+		t.Fatalf("bad server span %v", server)
+	}
+	if len(server[7]) != 1 || len(server[8]) != 1 ||
+		binary.LittleEndian.Uint64(server[8][0]) < binary.LittleEndian.Uint64(server[7][0]) {
+		t.Fatalf("bad span times")
+	}
+	if len(server[9]) == 0 {
+		t.Fatalf("no attributes")
+	}
+	client, ok := col.spans["GET"]
+	if !ok || string(client[4][0]) != string(server[2][0]) {
+		t.Fatalf("bad client span %v", client)
+	}
+	if col.auth != "Bearer x" {
+		t.Fatalf("bad collector auth %s", col.auth)
+	}
+}
+
+func TestSendGRPCError(t *testing.T) {
+	_, colServer := newGRPCCollector(t, "14")
+	e := &otlpExporter{
+		endpoint: colServer.URL,
+		protocol: otlpGRPC,
+		client:   &http.Client{Transport: grpcTransport(colServer.URL), Timeout: time.Second},
+	}
+	s := &span{name: "x"}
+	e.queue = []*span{s}
+	err := e.flush()
+	if err == nil || !strings.Contains(err.Error(), "grpc status 14: some message") {
+		t.Fatalf("bad err %v", err)
+	}
+}
+
+func TestEncodeKeyValue(t *testing.T) {
+	var tests = []struct {
+		value any
+		field int
+	}{
+		{"s", 1}, {false, 2}, {int64(-1), 3}, {200, 3}, {1.5, 4}, {errors.New("e"), 1},
+	}
+	for _, test := range tests {
+		kv := protoFields(t, encodeKeyValue(attribute{"k", test.value}).b)
+		if string(kv[1][0]) != "k" {
+			t.Fatalf("bad key %v", kv)
+		}
+		value := protoFields(t, kv[2][0])
+		if len(value[test.field]) != 1 {
+			t.Fatalf("bad value for %v: %v", test.value, value)
+		}
+	}
+}
@@ -21,12 +21,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var MissingConfigError error = errors.New("[tupi-proxy] Missing config")
@@ -36,60 +38,80 @@ var BadPreserveHost error = errors.New("[tupi-proxy] Bad preserve host")
 var InvalidScheme error = errors.New("Invalid scheme")
 
 type wsProxy struct {
-	destHost   string
+	route      *route
 	headerHost string
 }
 
 func (p *wsProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("ResponseWriter not Hijacker")
-		w.Write([]byte("Internal Server Error"))
-		return
-	}
-	wsDest := strings.Replace(p.destHost, "http", "ws", 1)
-	destURL := wsDest + r.URL.Path
-	dest, _ := url.Parse(destURL)
-
-	conn, _, err := hijacker.Hijack()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("Error hijacking")
-		w.Write([]byte("Internal Server Error"))
-		return
-	}
-	defer conn.Close()
 	outReq := r.Clone(r.Context())
-	outReq.URL = dest
+	p.route.rewrite.apply(outReq.URL)
+	setUpstreamURL(outReq.URL, wsURL(p.route.host))
 	outReq.Host = p.headerHost
+	p.route.forwarded.setForwarded(outReq, r)
+	p.route.requestHeaders.apply(outReq.Header, getRequestInfo(r))
+	p.route.signing.sign(outReq)
+	info := getRequestInfo(r)
+	upstreamSpan := startUpstreamSpan(outReq, r)
 
 	addr, _ := getHostPort(outReq.URL)
+	var dialSpan *span
+	if upstreamSpan != nil {
+		dialSpan = upstreamSpan.child("dial", spanKindInternal)
+		dialSpan.setAttr("network.peer.address", addr)
+	}
 	destConn, err := dial("tcp", addr)
+	if dialSpan != nil {
+		if err != nil {
+			dialSpan.setError(err.Error())
+		}
+		dialSpan.finish()
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println(fmt.Sprintf("Error remote write: %s", err.Error()))
-		w.Write([]byte("Internal Server Error"))
+		// the connection is not hijacked yet so the client gets
+		// the error response
+		handleProxyError(w, r, err)
 		return
 	}
-
 	defer destConn.Close()
+
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if errors.Is(err, http.ErrNotSupported) {
+		logRequest(r).Error("ResponseWriter not Hijacker")
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if err != nil {
+		logRequest(r).Error("Error hijacking", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	defer conn.Close()
+	info.upgraded = true
+	if addr := destConn.RemoteAddr(); addr != nil {
+		info.upstreamAddr = addr.String()
+	}
+	tunnelStart := time.Now()
+	defer func() { info.tunnelDuration = time.Since(tunnelStart) }()
+	wsTunnelsActive.add(1, info.route, info.upstream)
+	defer wsTunnelsActive.add(-1, info.route, info.upstream)
+
 	errCh := make(chan error, 2)
-	copyIO := func(dest net.Conn, source net.Conn) {
-		_, err := io.Copy(dest, source)
+	copyIO := func(dest net.Conn, source net.Conn, count *atomic.Int64) {
+		n, err := io.Copy(dest, source)
+		count.Add(n)
 		if err != nil {
-			log.Println(fmt.Sprintf("ws error: %s", err.Error()))
+			logRequest(r).Warn("ws error", "error", err)
 			errCh <- err
 		}
 	}
 
 	outReq.Write(destConn)
-	go copyIO(conn, destConn)
-	go copyIO(destConn, conn)
+	go copyIO(conn, destConn, &info.wsBytesOut)
+	go copyIO(destConn, conn, &info.wsBytesIn)
 
 	select {
 	case <-errCh:
-		log.Println("Closing ws conns")
+		logRequest(r).Debug("Closing ws conns")
 	}
 
 }
@@ -99,59 +121,149 @@ func Init(domain string, conf *map[string]any) error {
 	if c == nil {
 		return MissingConfigError
 	}
+	return storeConfig(c)
+}
 
-	h, exists := c["host"]
-	if !exists {
-		return NoHostError
+func Serve(w http.ResponseWriter, r *http.Request, conf *map[string]any) {
+	pc, err := getProxyConfig(conf)
+	if err != nil {
+		// the header must be set before the status is written
+		id := setRequestID(w, r, defaultRequestIDHeader)
+		w.WriteHeader(http.StatusInternalServerError)
+		requestLogger(&requestInfo{requestID: id}).Error("Bad config", "error", err)
+		w.Write([]byte("Internal Server Error"))
+		return
 	}
-
-	_, ok := h.(string)
-	if !ok {
-		return BadHostError
+	if pc.metrics != nil && pc.metrics.path != "" && r.URL.Path == pc.metrics.path {
+		pc.serveMetrics(w, r)
+		return
 	}
-	_, err := url.Parse(h.(string))
-	if err != nil {
-		return BadHostError
+	rw := newResponseWriter(w)
+	w = rw
+	rm := startRequestMetrics(r)
+	info := pc.trustedProxies.resolve(r)
+	info.requestID = setRequestID(w, r, pc.requestIDHeader)
+	info.requestIDHeader = pc.requestIDHeader
+	info.errorPages = pc.errorPages
+	r = withRequestInfo(r, info)
+	rt, variant := pc.matchRoute(r).pickVariant(r)
+	info.route = rt.name
+	info.upstream = rt.host.Host
+	info.responseHeaders = rt.responseHeaders
+	defer rm.finish(info, rw)
+	if pc.accessLog != nil {
+		defer pc.accessLog.log(r, info, rw, rm)
 	}
-
-	if p, exists := c["preserveHost"]; exists {
-		_, ok := p.(bool)
-		if !ok {
-			return BadPreserveHost
-		}
-
+	if pc.tracer != nil {
+		info.span = pc.tracer.startServerSpan(r, r.Method+" "+rt.name)
+		defer finishServerSpan(info, rw)
 	}
-
-	return nil
-}
-
-func Serve(w http.ResponseWriter, r *http.Request, conf *map[string]any) {
-	c := (*conf)
-	bh := c["host"].(string)
-	destBaseURL, _ := url.Parse(bh)
-	origHost := r.Host
-	host := ""
-	if preserve, exists := c["preserveHost"]; exists {
-		p := preserve.(bool)
-		if p {
-			host = origHost
-		} else {
-			host = destBaseURL.Host
+	if rt.canary != nil && rt.canary.header != "" {
+		w.Header().Set(rt.canary.header, variant)
+	}
+	if rt.ipAccess != nil && !rt.ipAccess.allowed(info) {
+		ipDenied.add(1, info.route)
+		writeError(w, r, http.StatusForbidden, "ip not allowed")
+		return
+	}
+	if rt.limits != nil {
+		if status := rt.limits.check(w, r); status != 0 {
+			writeError(w, r, status, "request too large")
+			return
 		}
 	}
+	if rt.forwardAuth != nil && !rt.forwardAuth.authorize(w, r, info) {
+		return
+	}
+	if rt.jwt != nil && !rt.jwt.authorize(w, r, info) {
+		return
+	}
+	if rt.basicAuth != nil && !rt.basicAuth.authorize(w, r, info) {
+		return
+	}
+	if rt.rateLimit != nil && !rt.rateLimit.allow(w, r, info) {
+		writeError(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+	host := rt.headerHost(r)
 
 	var proxy httpProxy
 	if !isWebSocket(r) {
-		proxy = getHttpProxy(destBaseURL, host)
+		if pc.capture != nil && pc.capture.wants(r) {
+			var done func()
+			w, done = pc.capture.start(w, r, info)
+			defer done()
+		}
+		if rt.concurrency != nil {
+			release, ok := rt.concurrency.acquire(r, info, rt.priorityClass)
+			if !ok {
+				writeError(w, r, http.StatusServiceUnavailable, "concurrency limit exceeded")
+				return
+			}
+			defer func() { release(overloaded(info)) }()
+		}
+		if rt.mirror != nil {
+			var done func()
+			w, done = rt.mirror.send(w, r, rt)
+			defer done()
+		}
+		proxy = getHttpProxy(rt, host)
 	} else {
-		proxy = getWsProxy(destBaseURL, host)
+		proxy = getWsProxy(rt, host)
 	}
 	proxy.ServeHTTP(w, r)
 }
 
-func rewriteRequest(req *httputil.ProxyRequest, url *url.URL, host string) {
-	req.SetURL(url)
+func rewriteRequest(req *httputil.ProxyRequest, rt *route, host string) {
+	rt.rewrite.apply(req.Out.URL)
+	req.SetURL(rt.host)
 	req.Out.Host = host
+	info := getRequestInfo(req.In)
+	info.upstreamStart = time.Now()
+	rt.forwarded.setForwarded(req.Out, req.In)
+	rt.requestHeaders.apply(req.Out.Header, info)
+	rt.signing.sign(req.Out)
+	ctx := httptrace.WithClientTrace(req.Out.Context(), &httptrace.ClientTrace{
+		GotConn: func(ci httptrace.GotConnInfo) {
+			info.upstreamAddr = ci.Conn.RemoteAddr().String()
+		},
+	})
+	req.Out = req.Out.WithContext(ctx)
+	if s := startUpstreamSpan(req.Out, req.In); s != nil {
+		ctx := httptrace.WithClientTrace(req.Out.Context(), s.clientTrace())
+		req.Out = req.Out.WithContext(ctx)
+	}
+	if info.capture != nil {
+		info.capture.recordUpstream(req.Out)
+	}
+}
+
+func modifyResponse(resp *http.Response, rt *route) {
+	info := getRequestInfo(resp.Request)
+	info.upstreamStatus = resp.StatusCode
+	if !info.upstreamStart.IsZero() {
+		info.upstreamTTFB = time.Since(info.upstreamStart)
+		upstreamTTFB.observe(info.upstreamTTFB.Seconds(), info.route, info.upstream)
+	}
+	// the request id was already set in the response
+	if info.requestIDHeader != "" {
+		resp.Header.Del(info.requestIDHeader)
+	}
+	if info.errorPages != nil {
+		info.errorPages.interceptResponse(resp, info)
+	}
+	rt.responseHeaders.apply(resp.Header, info)
+	if info.upstreamSpan != nil {
+		info.upstreamSpan.setAttr("http.response.status_code", resp.StatusCode)
+		info.upstreamSpan.finish()
+	}
+}
+
+// wsURL returns a copy of u with the http(s) scheme changed to ws(s)
+func wsURL(u *url.URL) *url.URL {
+	wu := *u
+	wu.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	return &wu
 }
 
 func isWebSocket(r *http.Request) bool {
@@ -185,29 +297,34 @@ type httpProxy interface {
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 }
 
-var testProxy func(url *url.URL, host string) httpProxy
+var testProxy func(rt *route, host string) httpProxy
 var testConn net.Conn
 
-func getHttpProxy(url *url.URL, host string) httpProxy {
+func getHttpProxy(rt *route, host string) httpProxy {
 	// notest
 	if testProxy != nil {
-		return testProxy(url, host)
+		return testProxy(rt, host)
 	}
 	proxy := &httputil.ReverseProxy{
 		Rewrite: func(req *httputil.ProxyRequest) {
-			rewriteRequest(req, url, host)
+			rewriteRequest(req, rt, host)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			modifyResponse(resp, rt)
+			return nil
 		},
+		ErrorHandler: handleProxyError,
 	}
 	return proxy
 }
 
-func getWsProxy(url *url.URL, host string) httpProxy {
+func getWsProxy(rt *route, host string) httpProxy {
 	// notest
 	if testProxy != nil {
-		return testProxy(url, host)
+		return testProxy(rt, host)
 	}
 	return &wsProxy{
-		destHost:   url.String(),
+		route:      rt,
 		headerHost: host,
 	}
 }
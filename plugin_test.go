@@ -28,7 +28,9 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestInit(t *testing.T) {
@@ -72,6 +74,11 @@ func TestInit(t *testing.T) {
 			map[string]any{"host": "http://host.bla", "preserveHost": true},
 			nil,
 		},
+		{
+			"bad routes",
+			map[string]any{"host": "http://host.bla", "routes": 1},
+			BadRouteError,
+		},
 	}
 
 	for _, test := range tests {
@@ -85,13 +92,13 @@ func TestInit(t *testing.T) {
 }
 
 type myProxy struct {
-	url  *url.URL
-	host string
-	pr   *httputil.ProxyRequest
+	route *route
+	host  string
+	pr    *httputil.ProxyRequest
 }
 
 func (p *myProxy) Rewrite(r *httputil.ProxyRequest) {
-	rewriteRequest(r, p.url, p.host)
+	rewriteRequest(r, p.route, p.host)
 }
 
 func (p *myProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -105,17 +112,32 @@ func (p *myProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	p.pr = pr
 }
 
+// bufferConn is a conn where what is written is kept apart from what
+// is read so the proxy copying data around does not consume what was
+// written to the conn.
 type bufferConn struct {
 	net.TCPConn
-	b bytes.Buffer
+	mu sync.Mutex
+	b  bytes.Buffer
+	w  bytes.Buffer
 }
 
 func (bc *bufferConn) Read(b []byte) (int, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
 	return bc.b.Read(b)
 }
 
 func (bc *bufferConn) Write(b []byte) (int, error) {
-	return bc.b.Write(b)
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.w.Write(b)
+}
+
+func (bc *bufferConn) written() []byte {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bytes.Clone(bc.w.Bytes())
 }
 
 func (bc *bufferConn) WriteTo(w io.Writer) (n int64, err error) {
@@ -148,17 +170,11 @@ func (h *myHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 }
 
 func newHijacker(withError bool) *myHijacker {
-	var b []byte
-	buff := bytes.NewBuffer(b)
 	destConn := bufferConn{
 		TCPConn: net.TCPConn{},
-		b:       *buff,
 	}
-	var ib []byte
-	inbuff := bytes.NewBuffer(ib)
 	inConn := bufferConn{
 		TCPConn: net.TCPConn{},
-		b:       *inbuff,
 	}
 	return &myHijacker{
 		ResponseRecorder: *httptest.NewRecorder(),
@@ -191,10 +207,10 @@ func TestServe(t *testing.T) {
 	for _, test := range tests {
 		var p *myProxy
 		t.Run(test.name, func(t *testing.T) {
-			testProxy = func(url *url.URL, host string) httpProxy {
+			testProxy = func(rt *route, host string) httpProxy {
 				p = &myProxy{
-					url:  url,
-					host: host,
+					route: rt,
+					host:  host,
 				}
 				return p
 			}
@@ -213,6 +229,54 @@ func TestServe(t *testing.T) {
 	}
 }
 
+func TestServeRoutes(t *testing.T) {
+	defer func() {
+		testProxy = nil
+	}()
+
+	conf := map[string]any{
+		"host": "http://v1.bla",
+		"routes": []any{
+			map[string]any{
+				"host": "http://v2.bla",
+				"headers": []any{
+					map[string]any{"name": "X-Api-Version", "value": "2"},
+				},
+			},
+		},
+	}
+
+	var tests = []struct {
+		name    string
+		version string
+		outHost string
+	}{
+		{"v1", "1", "v1.bla"},
+		{"v2", "2", "v2.bla"},
+	}
+
+	for _, test := range tests {
+		var p *myProxy
+		t.Run(test.name, func(t *testing.T) {
+			testProxy = func(rt *route, host string) httpProxy {
+				p = &myProxy{
+					route: rt,
+					host:  host,
+				}
+				return p
+			}
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.Header.Set("X-Api-Version", test.version)
+			Serve(w, r, &conf)
+
+			if p.pr.Out.URL.Host != test.outHost {
+				t.Fatalf("bad host %s", p.pr.Out.URL.Host)
+			}
+		})
+	}
+}
+
 func TestServeWS(t *testing.T) {
 
 	defer func() {
@@ -230,7 +294,12 @@ func TestServeWS(t *testing.T) {
 	}{
 		{
 			"test writer not hijacker",
-			func() http.ResponseWriter { return httptest.NewRecorder() },
+			func() http.ResponseWriter {
+				testDial = func(n, a string) (net.Conn, error) {
+					return &bufferConn{}, nil
+				}
+				return httptest.NewRecorder()
+			},
 			map[string]any{"host": "http://my-host.nada"},
 			func(w http.ResponseWriter) {
 				tw := w.(*httptest.ResponseRecorder)
@@ -242,7 +311,13 @@ func TestServeWS(t *testing.T) {
 		},
 		{
 			"test bad hijack",
-			func() http.ResponseWriter { return newHijacker(true) },
+			func() http.ResponseWriter {
+				h := newHijacker(true)
+				testDial = func(n, a string) (net.Conn, error) {
+					return h.destConn, nil
+				}
+				return h
+			},
 			map[string]any{"host": ""},
 			func(w http.ResponseWriter) {
 				tw := w.(*myHijacker)
@@ -264,7 +339,7 @@ func TestServeWS(t *testing.T) {
 			map[string]any{"host": "http://nada.bla"},
 			func(w http.ResponseWriter) {
 				tw := w.(*myHijacker)
-				if tw.Code != 500 {
+				if tw.Code != 502 {
 					t.Fatalf("bad code %d", tw.Code)
 				}
 			},
@@ -285,7 +360,7 @@ func TestServeWS(t *testing.T) {
 				var r []byte
 
 				for {
-					r, _ = io.ReadAll(tw.destConn)
+					r = tw.destConn.(*bufferConn).written()
 					if len(r) >= 1 {
 						if strings.Index(string(r), "Upgrade: websocket") < 0 {
 							t.Fatalf("Bad headers")
@@ -315,6 +390,38 @@ func TestServeWS(t *testing.T) {
 	}
 }
 
+func TestServeWSDialRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens on the upstream address
+	upstream := "http://" + l.Addr().String()
+	l.Close()
+
+	conf := map[string]any{"host": upstream}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Serve(w, r, &conf)
+	}))
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n" +
+		"Connection: upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("bad response %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("bad status %d", resp.StatusCode)
+	}
+}
+
 func TestGetHostPort(t *testing.T) {
 	var tests = []struct {
 		name         string
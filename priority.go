@@ -0,0 +1,189 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const defaultPriorityClass = "default"
+
+// priorities are the priority classes of the requests waiting for a
+// concurrency limiter. The class of a request comes from a header,
+// from the authenticated identity or from the route, in this order.
+type priorities struct {
+	// priority of each class. Higher goes first.
+	classes map[string]int64
+	header  string
+	// class of each identity
+	identities   map[string]string
+	defaultClass string
+}
+
+// classOf returns the priority class of a request and its priority.
+func (p *priorities) classOf(r *http.Request, info *requestInfo,
+	routeClass string) (string, int64) {
+	if p == nil {
+		return defaultPriorityClass, 0
+	}
+	if p.header != "" {
+		if class := r.Header.Get(p.header); class != "" {
+			if priority, ok := p.classes[class]; ok {
+				return class, priority
+			}
+		}
+	}
+	if class, ok := p.identities[info.identity]; ok && info.identity != "" {
+		return class, p.classes[class]
+	}
+	if routeClass != "" {
+		return routeClass, p.classes[routeClass]
+	}
+	return p.defaultClass, p.classes[p.defaultClass]
+}
+
+// has returns true if the class exists.
+func (p *priorities) has(class string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.classes[class]
+	return ok
+}
+
+// waiter is a request waiting for a slot in a limiter.
+type waiter struct {
+	ready    chan struct{}
+	priority int64
+	// order of arrival, for requests with the same priority
+	seq   uint64
+	index int
+}
+
+// waitQueue is a heap of waiters, the one with the highest priority
+// that arrived first at the top.
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int {
+	return len(q)
+}
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() any {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return w
+}
+
+// parsePriorities parses the priority classes of a concurrency config
+// like {"priorityClasses" = {"interactive" = 10, "batch" = 0}} with the
+// optional priorityHeader, identityClasses and defaultClass keys.
+func parsePriorities(c map[string]any) (*priorities, error) {
+	rawClasses, exists, err := getMap(c, "priorityClasses")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	p := &priorities{
+		classes:      map[string]int64{},
+		identities:   map[string]string{},
+		defaultClass: defaultPriorityClass,
+	}
+	for class := range rawClasses {
+		p.classes[class], _, err = getInt(rawClasses, class)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+		}
+	}
+	if _, ok := p.classes[defaultPriorityClass]; !ok {
+		p.classes[defaultPriorityClass] = 0
+	}
+
+	p.header, _, err = getString(c, "priorityHeader")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+	}
+
+	rawIdentities, _, err := getMap(c, "identityClasses")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+	}
+	for identity := range rawIdentities {
+		class, _, err := getString(rawIdentities, identity)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+		}
+		if !p.has(class) {
+			return nil, fmt.Errorf("%w: unknown priority class %s", BadConcurrencyError, class)
+		}
+		p.identities[identity] = class
+	}
+
+	defaultClass, exists, err := getString(c, "defaultClass")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadConcurrencyError, err)
+	}
+	if exists {
+		if !p.has(defaultClass) {
+			return nil, fmt.Errorf(
+				"%w: unknown priority class %s", BadConcurrencyError, defaultClass)
+		}
+		p.defaultClass = defaultClass
+	}
+	return p, nil
+}
+
+// parsePriorityClass parses the priority class of a route. The class
+// must exist in the concurrency config of the route.
+func parsePriorityClass(c map[string]any, cc *concurrency) (string, error) {
+	class, exists, err := getString(c, "priorityClass")
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", BadConcurrencyError, err)
+	}
+	if !exists {
+		return "", nil
+	}
+	if cc == nil || !cc.priorities.has(class) {
+		return "", fmt.Errorf("%w: unknown priority class %s", BadConcurrencyError, class)
+	}
+	return class, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrioritiesClassOf(t *testing.T) {
+	p := &priorities{
+		classes:      map[string]int64{"interactive": 10, "batch": 0, "default": 5},
+		header:       "X-Priority",
+		identities:   map[string]string{"reports": "batch"},
+		defaultClass: "default",
+	}
+	var tests = []struct {
+		name       string
+		p          *priorities
+		header     string
+		identity   string
+		routeClass string
+		class      string
+		priority   int64
+	}{
+		{"no priorities", nil, "interactive", "", "", "default", 0},
+		{"header", p, "interactive", "reports", "batch", "interactive", 10},
+		{"unknown header", p, "urgent", "", "", "default", 5},
+		{"identity", p, "", "reports", "interactive", "batch", 0},
+		{"route", p, "", "joe", "batch", "batch", 0},
+		{"default", p, "", "", "", "default", 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("X-Priority", test.header)
+			info := &requestInfo{identity: test.identity}
+			class, priority := test.p.classOf(r, info, test.routeClass)
+			if class != test.class || priority != test.priority {
+				t.Fatalf("bad class %s %d", class, priority)
+			}
+		})
+	}
+}
+
+func TestLimiterPriority(t *testing.T) {
+	l := newTestLimiter(1, 10)
+	ctx := context.Background()
+	l.acquire(ctx, time.Second, 0)
+
+	order := make(chan int64, 3)
+	for i, priority := range []int64{0, 10, 5} {
+		go func() {
+			if _, ok := l.acquire(ctx, time.Second, priority); ok {
+				order <- priority
+			}
+		}()
+		// wait the request to be queued so the arrival order is known
+		for {
+			l.mu.Lock()
+			n := len(l.queue)
+			l.mu.Unlock()
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for _, expected := range []int64{10, 5, 0} {
+		l.release(time.Millisecond, false)
+		if p := <-order; p != expected {
+			t.Fatalf("bad order %d, expected %d", p, expected)
+		}
+	}
+}
+
+func TestParsePriorities(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"no classes", map[string]any{}, nil},
+		{"bad classes", map[string]any{"priorityClasses": "x"}, BadConcurrencyError},
+		{"bad priority", map[string]any{"priorityClasses": map[string]any{
+			"batch": "low"}}, BadConcurrencyError},
+		{"unknown identity class", map[string]any{
+			"priorityClasses": map[string]any{"batch": 0},
+			"identityClasses": map[string]any{"reports": "bulk"}}, BadConcurrencyError},
+		{"unknown default", map[string]any{
+			"priorityClasses": map[string]any{"batch": 0},
+			"defaultClass":    "bulk"}, BadConcurrencyError},
+		{"ok", map[string]any{
+			"priorityClasses": map[string]any{"interactive": 10, "batch": 0},
+			"priorityHeader":  "X-Priority",
+			"identityClasses": map[string]any{"reports": "batch"},
+			"defaultClass":    "interactive"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parsePriorities(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestParseRoutePriorityClass(t *testing.T) {
+	conf := map[string]any{
+		"host": "http://v1.bla",
+		"concurrency": map[string]any{
+			"priorityClasses": map[string]any{"interactive": 10, "batch": 0},
+		},
+		"routes": []any{
+			map[string]any{"pathPrefix": "/reports", "priorityClass": "batch"},
+		},
+	}
+	pc, err := parseConfig(conf)
+	if err != nil {
+		t.Fatalf("bad err %s", err.Error())
+	}
+	if pc.routes[0].priorityClass != "batch" {
+		t.Fatalf("bad class %s", pc.routes[0].priorityClass)
+	}
+
+	conf["routes"] = []any{
+		map[string]any{"pathPrefix": "/reports", "priorityClass": "bulk"},
+	}
+	_, err = parseConfig(conf)
+	if !errors.Is(err, BadConcurrencyError) {
+		t.Fatalf("bad err %v", err)
+	}
+}
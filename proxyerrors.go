@@ -0,0 +1,138 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// classes of upstream errors
+const (
+	errorDNS       = "dns"
+	errorRefused   = "refused"
+	errorTimeout   = "timeout"
+	errorTLS       = "tls"
+	errorReset     = "reset"
+	errorCancelled = "cancelled"
+	errorOther     = "other"
+)
+
+// statusClientClosedRequest is the status used when the client goes
+// away before the response, like nginx does.
+const statusClientClosedRequest = 499
+
+// classifyError returns the class of an error proxying a request.
+func classifyError(r *http.Request, err error) string {
+	if errors.Is(err, context.Canceled) || errors.Is(r.Context().Err(), context.Canceled) {
+		return errorCancelled
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errorDNS
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errorTimeout
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return errorRefused
+	}
+	if isTLSError(err) {
+		return errorTLS
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errorReset
+	}
+	return errorOther
+}
+
+func isTLSError(err error) bool {
+	var recordErr tls.RecordHeaderError
+	var verifyErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &recordErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &alertErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// errorStatus returns the status sent to the client for an error class.
+func errorStatus(class string) int {
+	switch class {
+	case errorRefused:
+		return http.StatusServiceUnavailable
+	case errorTimeout:
+		return http.StatusGatewayTimeout
+	case errorCancelled:
+		return statusClientClosedRequest
+	}
+	return http.StatusBadGateway
+}
+
+// handleProxyError is the error handler of the reverse proxy. The
+// error is classified, logged and counted.
+func handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	info := getRequestInfo(r)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		// not an upstream error, the client sent too much
+		requestLogger(info).Info("request body too large", "limit", maxBytesErr.Limit)
+		writeError(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	class := recordProxyError(info, r, err)
+	status := errorStatus(class)
+	if class == errorCancelled {
+		// nobody is listening
+		w.WriteHeader(status)
+		return
+	}
+	writeError(w, r, status, "upstream error: "+class)
+}
+
+// recordProxyError logs and counts an error proxying a request and
+// returns its class.
+func recordProxyError(info *requestInfo, r *http.Request, err error) string {
+	class := classifyError(r, err)
+	info.upstreamError = class
+	upstreamErrors.add(1, info.route, info.upstream, class)
+	if info.upstreamSpan != nil {
+		info.upstreamSpan.setError(class + ": " + err.Error())
+		info.upstreamSpan.finish()
+	}
+	l := requestLogger(info)
+	if class == errorCancelled {
+		l.Info("client cancelled", "error", err)
+	} else {
+		l.Error("upstream error", "class", class, "error", err)
+	}
+	return class
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	var tests = []struct {
+		name     string
+		ctx      context.Context
+		err      error
+		expected string
+	}{
+		{"dns", context.Background(),
+			&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "x"}},
+			errorDNS},
+		{"refused", context.Background(),
+			&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			errorRefused},
+		{"timeout", context.Background(),
+			&url.Error{Op: "Get", Err: context.DeadlineExceeded}, errorTimeout},
+		{"net timeout", context.Background(),
+			&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, errorTimeout},
+		{"tls", context.Background(),
+			fmt.Errorf("bad: %w", x509.UnknownAuthorityError{}), errorTLS},
+		{"reset", context.Background(),
+			&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			errorReset},
+		{"eof", context.Background(), io.EOF, errorReset},
+		{"client cancelled", cancelled, errors.New("whatever"), errorCancelled},
+		{"other", context.Background(), errors.New("whatever"), errorOther},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil).WithContext(test.ctx)
+			if class := classifyError(r, test.err); class != test.expected {
+				t.Fatalf("bad class %s", class)
+			}
+		})
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	var tests = []struct {
+		class  string
+		status int
+	}{
+		{errorDNS, 502}, {errorRefused, 503}, {errorTimeout, 504},
+		{errorTLS, 502}, {errorReset, 502}, {errorCancelled, 499}, {errorOther, 502},
+	}
+	for _, test := range tests {
+		if errorStatus(test.class) != test.status {
+			t.Fatalf("bad status for %s", test.class)
+		}
+	}
+}
+
+func TestServeUpstreamError(t *testing.T) {
+	// a closed listener so the connection is refused
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("bad listen %s", err.Error())
+	}
+	addr := l.Addr().String()
+	l.Close()
+	testProxy = nil
+
+	conf := map[string]any{
+		"host": "http://" + addr,
+		"routes": []any{
+			map[string]any{"name": "errors-test", "pathPrefix": "/"},
+		},
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	Serve(w, r, &conf)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("bad code %d", w.Code)
+	}
+
+	var b bytes.Buffer
+	upstreamErrors.write(&b)
+	expected := fmt.Sprintf(
+		`tupi_proxy_upstream_errors_total{route="errors-test",upstream="%s",type="refused"} 1`, addr)
+	if !strings.Contains(b.String(), expected) {
+		t.Fatalf("bad metrics %s", b.String())
+	}
+}
+
+func TestServeUpstreamTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+	defer upstream.Close()
+	testProxy = nil
+
+	conf := map[string]any{"host": upstream.URL}
+	w := httptest.NewRecorder()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	Serve(w, r, &conf)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("bad code %d", w.Code)
+	}
+}
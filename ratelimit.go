@@ -0,0 +1,283 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var BadRateLimitError error = errors.New("[tupi-proxy] Bad rate limit config")
+
+const (
+	rateLimitKeyClientIP = "clientIp"
+	rateLimitKeyIdentity = "identity"
+	// prefix of the header keys, like header:X-Api-Key
+	rateLimitKeyHeader = "header:"
+
+	defaultRateLimitMaxKeys = 100000
+)
+
+// rateLimit limits the requests of each client with a token bucket.
+// Each bucket holds up to burst tokens and is refilled with requests
+// tokens per period. Each request takes one token.
+type rateLimit struct {
+	name     string
+	requests int64
+	period   time.Duration
+	burst    int64
+	// what identifies a client: clientIp, identity or header:<name>
+	key    string
+	header string
+	store  rateLimitStore
+}
+
+// rateLimitResult is the state of a bucket after a request.
+type rateLimitResult struct {
+	allowed   bool
+	remaining int64
+	// time until the next token, for denied requests
+	retryAfter time.Duration
+	// time until the bucket is full again
+	reset time.Duration
+}
+
+// rateLimitStore keeps the buckets. The in-memory store is the default
+// and a shared store may be used by many proxies.
+type rateLimitStore interface {
+	take(key string, rl *rateLimit, now time.Time) (rateLimitResult, error)
+}
+
+// clientKey returns the key of the bucket for the request.
+func (rl *rateLimit) clientKey(r *http.Request, info *requestInfo) string {
+	switch rl.key {
+	case rateLimitKeyIdentity:
+		if info.identity != "" {
+			return "id:" + info.identity
+		}
+	case rateLimitKeyHeader:
+		if v := r.Header.Get(rl.header); v != "" {
+			return "h:" + v
+		}
+	}
+	return "ip:" + info.clientIP
+}
+
+// allow takes a token for the request and sets the RateLimit headers.
+// It returns false if the request must be denied.
+func (rl *rateLimit) allow(w http.ResponseWriter, r *http.Request, info *requestInfo) bool {
+	res, err := rl.store.take(rl.clientKey(r, info), rl, time.Now())
+	if err != nil {
+		// better to let the requests pass than to deny everything
+		// because the store is down
+		requestLogger(info).Error("rate limit store error", "error", err)
+		return true
+	}
+	h := w.Header()
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d",
+		rl.requests, int64(math.Ceil(rl.period.Seconds())), rl.burst))
+	h.Set("RateLimit-Limit", strconv.FormatInt(rl.burst, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(res.remaining, 10))
+	h.Set("RateLimit-Reset", ceilSeconds(res.reset))
+	if !res.allowed {
+		h.Set("Retry-After", ceilSeconds(res.retryAfter))
+		rateLimited.add(1, info.route)
+	}
+	return res.allowed
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// interval returns the time to refill one token.
+func (rl *rateLimit) interval() time.Duration {
+	return rl.period / time.Duration(rl.requests)
+}
+
+// memoryStore is a rate limit store that keeps the buckets in memory.
+// When there are more than maxKeys buckets the least recently used
+// are removed.
+type memoryStore struct {
+	maxKeys int
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newMemoryStore(maxKeys int) *memoryStore {
+	return &memoryStore{
+		maxKeys: maxKeys,
+		buckets: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+func (ms *memoryStore) take(key string, rl *rateLimit, now time.Time) (rateLimitResult, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	burst := float64(rl.burst)
+	perToken := rl.interval()
+
+	var b *tokenBucket
+	if el, ok := ms.buckets[key]; ok {
+		ms.lru.MoveToFront(el)
+		b = el.Value.(*tokenBucket)
+		elapsed := now.Sub(b.last)
+		if elapsed > 0 {
+			b.tokens = min(burst, b.tokens+float64(elapsed)/float64(perToken))
+			b.last = now
+		}
+	} else {
+		b = &tokenBucket{key: key, tokens: burst, last: now}
+		ms.buckets[key] = ms.lru.PushFront(b)
+		for ms.lru.Len() > ms.maxKeys {
+			old := ms.lru.Back()
+			ms.lru.Remove(old)
+			delete(ms.buckets, old.Value.(*tokenBucket).key)
+		}
+	}
+
+	res := rateLimitResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.allowed = true
+	} else {
+		res.retryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	res.remaining = int64(b.tokens)
+	res.reset = time.Duration((burst - b.tokens) * float64(perToken))
+	return res, nil
+}
+
+// parseRateLimit parses the `rateLimit` key of the config like:
+// {"requests" = 100, "period" = "1m", "burst" = 20, "key" = "header:X-Api-Key"}
+// If there is no rateLimit key the inherited one is returned. name
+// identifies the limit in shared stores.
+func parseRateLimit(c map[string]any, inherited *rateLimit, name string) (*rateLimit, error) {
+	raw, exists, err := getMap(c, "rateLimit")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	if !exists {
+		return inherited, nil
+	}
+	disabled, _, err := getBool(raw, "disabled")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	if disabled {
+		return nil, nil
+	}
+
+	rl := &rateLimit{name: name, period: time.Second, key: rateLimitKeyClientIP}
+	requests, _, err := getInt(raw, "requests")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	if requests <= 0 {
+		return nil, fmt.Errorf("%w: requests must be positive", BadRateLimitError)
+	}
+	rl.requests = requests
+
+	period, exists, err := getDuration(raw, "period")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	if exists {
+		if period <= 0 {
+			return nil, fmt.Errorf("%w: period must be positive", BadRateLimitError)
+		}
+		rl.period = period
+	}
+
+	burst, exists, err := getInt(raw, "burst")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	rl.burst = requests
+	if exists {
+		if burst <= 0 {
+			return nil, fmt.Errorf("%w: burst must be positive", BadRateLimitError)
+		}
+		rl.burst = burst
+	}
+
+	key, exists, err := getString(raw, "key")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	if exists {
+		switch {
+		case key == rateLimitKeyClientIP || key == rateLimitKeyIdentity:
+			rl.key = key
+		case strings.HasPrefix(key, rateLimitKeyHeader) && len(key) > len(rateLimitKeyHeader):
+			rl.key = rateLimitKeyHeader
+			rl.header = key[len(rateLimitKeyHeader):]
+		default:
+			return nil, fmt.Errorf(
+				"%w: key must be clientIp, identity or header:<name>", BadRateLimitError)
+		}
+	}
+
+	rl.store, err = parseRateLimitStore(raw)
+	if err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// parseRateLimitStore parses the store of a rate limit. The store may
+// be memory or redis, see parseRedisStore.
+func parseRateLimitStore(c map[string]any) (rateLimitStore, error) {
+	store, _, err := getString(c, "store")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	switch store {
+	case "", "memory":
+	case "redis":
+		return parseRedisStore(c)
+	default:
+		return nil, fmt.Errorf("%w: store must be memory or redis", BadRateLimitError)
+	}
+	maxKeys, exists, err := getInt(c, "maxKeys")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	if !exists {
+		maxKeys = defaultRateLimitMaxKeys
+	}
+	if maxKeys <= 0 {
+		return nil, fmt.Errorf("%w: maxKeys must be positive", BadRateLimitError)
+	}
+	return newMemoryStore(int(maxKeys)), nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	rl := &rateLimit{requests: 10, period: time.Second, burst: 2}
+	ms := newMemoryStore(10)
+	now := time.Now()
+
+	var tests = []struct {
+		name      string
+		at        time.Duration
+		allowed   bool
+		remaining int64
+		retry     time.Duration
+	}{
+		{"first", 0, true, 1, 0},
+		{"second", 0, true, 0, 0},
+		{"empty", 0, false, 0, 100 * time.Millisecond},
+		{"half token", 50 * time.Millisecond, false, 0, 50 * time.Millisecond},
+		{"refilled", 100 * time.Millisecond, true, 0, 0},
+		{"full again", time.Hour, true, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, _ := ms.take("k", rl, now.Add(test.at))
+			if res.allowed != test.allowed || res.remaining != test.remaining {
+				t.Fatalf("bad result %+v", res)
+			}
+			if res.retryAfter != test.retry {
+				t.Fatalf("bad retry after %s", res.retryAfter)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	rl := &rateLimit{requests: 1, period: time.Hour, burst: 1}
+	ms := newMemoryStore(2)
+	now := time.Now()
+	ms.take("a", rl, now)
+	ms.take("b", rl, now)
+	// a is the most recently used now
+	ms.take("a", rl, now)
+	ms.take("c", rl, now)
+	if _, ok := ms.buckets["b"]; ok {
+		t.Fatalf("b not evicted")
+	}
+	if len(ms.buckets) != 2 || ms.lru.Len() != 2 {
+		t.Fatalf("bad size %d", len(ms.buckets))
+	}
+}
+
+func TestRateLimitClientKey(t *testing.T) {
+	info := &requestInfo{clientIP: "10.0.0.1"}
+	var tests = []struct {
+		name     string
+		rl       *rateLimit
+		identity string
+		apiKey   string
+		expected string
+	}{
+		{"client ip", &rateLimit{key: rateLimitKeyClientIP}, "", "k", "ip:10.0.0.1"},
+		{"identity", &rateLimit{key: rateLimitKeyIdentity}, "joe", "", "id:joe"},
+		{"no identity", &rateLimit{key: rateLimitKeyIdentity}, "", "", "ip:10.0.0.1"},
+		{"header", &rateLimit{key: rateLimitKeyHeader, header: "X-Api-Key"}, "", "k", "h:k"},
+		{"no header", &rateLimit{key: rateLimitKeyHeader, header: "X-Api-Key"}, "", "", "ip:10.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if test.apiKey != "" {
+				r.Header.Set("X-Api-Key", test.apiKey)
+			}
+			info.identity = test.identity
+			if k := test.rl.clientKey(r, info); k != test.expected {
+				t.Fatalf("bad key %s", k)
+			}
+		})
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	inherited := &rateLimit{}
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"not a table", map[string]any{"rateLimit": "x"}, BadRateLimitError},
+		{"no requests", map[string]any{"rateLimit": map[string]any{}}, BadRateLimitError},
+		{"bad period", map[string]any{"rateLimit": map[string]any{
+			"requests": 1, "period": "x"}}, BadRateLimitError},
+		{"bad burst", map[string]any{"rateLimit": map[string]any{
+			"requests": 1, "burst": 0}}, BadRateLimitError},
+		{"bad key", map[string]any{"rateLimit": map[string]any{
+			"requests": 1, "key": "header:"}}, BadRateLimitError},
+		{"bad max keys", map[string]any{"rateLimit": map[string]any{
+			"requests": 1, "maxKeys": -1}}, BadRateLimitError},
+		{"ok", map[string]any{"rateLimit": map[string]any{
+			"requests": 100, "period": "1m", "burst": 10, "key": "header:X-Api-Key"}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseRateLimit(test.conf, inherited, "test")
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+
+	t.Run("inherited", func(t *testing.T) {
+		rl, _ := parseRateLimit(map[string]any{}, inherited, "test")
+		if rl != inherited {
+			t.Fatalf("not inherited")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		rl, _ := parseRateLimit(map[string]any{
+			"rateLimit": map[string]any{"disabled": true}}, inherited, "test")
+		if rl != nil {
+			t.Fatalf("not disabled")
+		}
+	})
+}
+
+func TestServeRateLimit(t *testing.T) {
+	testProxy = func(rt *route, host string) httpProxy {
+		return &myProxy{route: rt, host: host}
+	}
+	defer func() { testProxy = nil }()
+
+	conf := map[string]any{
+		"host":      "http://v1.bla",
+		"rateLimit": map[string]any{"requests": 1, "period": "1h"},
+		"routes": []any{
+			map[string]any{"pathPrefix": "/free", "rateLimit": map[string]any{"disabled": true}},
+			map[string]any{"pathPrefix": "/burst", "rateLimit": map[string]any{
+				"requests": 1, "period": "1h", "burst": 2}},
+		},
+	}
+
+	var tests = []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"allowed", "/", 200},
+		{"denied", "/", 429},
+		{"not limited", "/free", 200},
+		{"route limit", "/burst", 200},
+		{"route burst", "/burst", 200},
+		{"route denied", "/burst", 429},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", test.path, nil)
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+			if test.status == http.StatusTooManyRequests {
+				if w.Header().Get("Retry-After") != "3600" {
+					t.Fatalf("bad retry after %s", w.Header().Get("Retry-After"))
+				}
+				if w.Header().Get("RateLimit-Remaining") != "0" {
+					t.Fatalf("bad remaining %s", w.Header().Get("RateLimit-Remaining"))
+				}
+			}
+		})
+	}
+}
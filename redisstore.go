@@ -0,0 +1,163 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisTimeout   = 100 * time.Millisecond
+	defaultRedisPoolSize  = 16
+	defaultRedisKeyPrefix = "tupi-proxy:ratelimit:"
+)
+
+// gcraScript implements the generic cell rate algorithm, the token
+// bucket expressed as a theoretical arrival time (tat) so there is
+// only one value to store per key. Times are in microseconds.
+//
+// KEYS[1]: the key of the client
+// ARGV[1]: time to refill one token
+// ARGV[2]: burst
+// ARGV[3]: now
+//
+// returns {allowed, remaining, retry after, reset}
+const gcraScript = `
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if not tat or tat < now then
+  tat = now
+end
+local new_tat = tat + interval
+local allow_at = new_tat - interval * burst
+if allow_at > now then
+  return {0, 0, allow_at - now, tat - now}
+end
+-- numbers are formatted with %.14g and microseconds need 16 digits
+redis.call("SET", KEYS[1], string.format("%d", new_tat), "PX", math.ceil((new_tat - now) / 1000))
+return {1, math.floor((now - allow_at) / interval), 0, new_tat - now}
+`
+
+var gcraScriptSHA = func() string {
+	h := sha1.Sum([]byte(gcraScript))
+	return hex.EncodeToString(h[:])
+}()
+
+// redisStore is a rate limit store shared by many proxies using a
+// server speaking the redis protocol. The proxies must have their
+// clocks in sync.
+type redisStore struct {
+	client *respClient
+	prefix string
+}
+
+func (rs *redisStore) take(key string, rl *rateLimit, now time.Time) (rateLimitResult, error) {
+	args := []string{
+		rs.prefix + rl.name + ":" + key,
+		strconv.FormatInt(rl.interval().Microseconds(), 10),
+		strconv.FormatInt(rl.burst, 10),
+		strconv.FormatInt(now.UnixMicro(), 10),
+	}
+	reply, err := rs.client.do(append([]string{"EVALSHA", gcraScriptSHA, "1"}, args...)...)
+	if err != nil && strings.Contains(err.Error(), "NOSCRIPT") {
+		// EVAL loads the script so the next calls use EVALSHA
+		reply, err = rs.client.do(append([]string{"EVAL", gcraScript, "1"}, args...)...)
+	}
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	values, ok := reply.([]any)
+	if !ok || len(values) != 4 {
+		return rateLimitResult{}, fmt.Errorf("%w: bad gcra reply %v", RespError, reply)
+	}
+	ints := make([]int64, 4)
+	for i, v := range values {
+		n, ok := v.(int64)
+		if !ok {
+			return rateLimitResult{}, fmt.Errorf("%w: bad gcra reply %v", RespError, reply)
+		}
+		ints[i] = n
+	}
+	return rateLimitResult{
+		allowed:    ints[0] == 1,
+		remaining:  ints[1],
+		retryAfter: time.Duration(ints[2]) * time.Microsecond,
+		reset:      time.Duration(ints[3]) * time.Microsecond,
+	}, nil
+}
+
+// redisClients are shared by configs so a config reload does not
+// open new connections.
+var redisClients = map[string]*respClient{}
+var redisClientsMutex sync.Mutex
+
+// parseRedisStore parses the `redis` key of a rate limit like:
+// {"address" = "127.0.0.1:6379", "password" = "secret", "db" = 0}
+func parseRedisStore(c map[string]any) (*redisStore, error) {
+	raw, exists, err := getMap(c, "redis")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: redis store needs the redis config", BadRateLimitError)
+	}
+	address, _, err := getString(raw, "address")
+	if err != nil || address == "" {
+		return nil, fmt.Errorf("%w: redis needs an address", BadRateLimitError)
+	}
+	password, _, err := getString(raw, "password")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	db, _, err := getInt(raw, "db")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	timeout, exists, err := getDuration(raw, "timeout")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	if !exists {
+		timeout = defaultRedisTimeout
+	}
+	prefix, exists, err := getString(raw, "keyPrefix")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRateLimitError, err)
+	}
+	if !exists {
+		prefix = defaultRedisKeyPrefix
+	}
+
+	redisClientsMutex.Lock()
+	defer redisClientsMutex.Unlock()
+	key := fmt.Sprintf("%s %s %d %s", address, password, db, timeout)
+	client, ok := redisClients[key]
+	if !ok {
+		client = newRespClient(address, password, db, timeout, defaultRedisPoolSize)
+		redisClients[key] = client
+	}
+	return &redisStore{client: client, prefix: prefix}, nil
+}
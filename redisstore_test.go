@@ -0,0 +1,197 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRedisStoreTake(t *testing.T) {
+	s := newRespServer(t, "")
+	rs := &redisStore{
+		client: newRespClient(s.addr(), "", 0, time.Second, 2),
+		prefix: defaultRedisKeyPrefix,
+	}
+	rl := &rateLimit{name: "test", requests: 10, period: time.Second, burst: 2}
+	now := time.Now()
+
+	var tests = []struct {
+		name      string
+		at        time.Duration
+		allowed   bool
+		remaining int64
+		retry     time.Duration
+	}{
+		{"first", 0, true, 1, 0},
+		{"second", 0, true, 0, 0},
+		{"empty", 0, false, 0, 100 * time.Millisecond},
+		{"half token", 50 * time.Millisecond, false, 0, 50 * time.Millisecond},
+		{"refilled", 100 * time.Millisecond, true, 0, 0},
+		{"full again", time.Hour, true, 1, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := rs.take("k", rl, now.Add(test.at))
+			if err != nil {
+				t.Fatalf("bad err %s", err.Error())
+			}
+			if res.allowed != test.allowed || res.remaining != test.remaining {
+				t.Fatalf("bad result %+v", res)
+			}
+			if res.retryAfter != test.retry {
+				t.Fatalf("bad retry after %s", res.retryAfter)
+			}
+		})
+	}
+
+	if _, ok := s.values[defaultRedisKeyPrefix+"test:k"]; !ok {
+		t.Fatalf("bad key %v", s.values)
+	}
+	// the script is sent once, then called by its sha
+	evals := 0
+	for _, c := range s.commands {
+		if c == "EVAL" {
+			evals++
+		}
+	}
+	if evals != 1 {
+		t.Fatalf("bad evals %d", evals)
+	}
+}
+
+// TestRedisStoreTakeRedis runs the gcra script in a real redis server,
+// set TUPI_REDIS_ADDR to run it.
+func TestRedisStoreTakeRedis(t *testing.T) {
+	addr := os.Getenv("TUPI_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TUPI_REDIS_ADDR not set")
+	}
+	client := newRespClient(addr, "", 0, time.Second, 2)
+	rs := &redisStore{client: client, prefix: defaultRedisKeyPrefix + "test:"}
+	rl := &rateLimit{name: strconv.FormatInt(time.Now().UnixNano(), 10),
+		requests: 10, period: time.Second, burst: 2}
+	key := rs.prefix + rl.name + ":k"
+	defer client.do("DEL", key)
+	now := time.Now()
+
+	var tests = []struct {
+		name    string
+		allowed bool
+		tat     time.Duration
+	}{
+		{"first", true, 100 * time.Millisecond},
+		{"second", true, 200 * time.Millisecond},
+		{"empty", false, 200 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := rs.take("k", rl, now)
+			if err != nil {
+				t.Fatalf("bad err %s", err.Error())
+			}
+			if res.allowed != test.allowed {
+				t.Fatalf("bad result %+v", res)
+			}
+			// the tat is stored with microsecond precision
+			reply, err := client.do("GET", key)
+			if err != nil {
+				t.Fatalf("bad err %s", err.Error())
+			}
+			expected := strconv.FormatInt(now.Add(test.tat).UnixMicro(), 10)
+			if reply != expected {
+				t.Fatalf("bad tat %v", reply)
+			}
+		})
+	}
+}
+
+func TestParseRedisStore(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"no redis", map[string]any{"store": "redis"}, BadRateLimitError},
+		{"no address", map[string]any{"store": "redis",
+			"redis": map[string]any{}}, BadRateLimitError},
+		{"bad timeout", map[string]any{"store": "redis",
+			"redis": map[string]any{"address": "127.0.0.1:6379", "timeout": "x"}}, BadRateLimitError},
+		{"bad store", map[string]any{"store": "etcd"}, BadRateLimitError},
+		{"ok", map[string]any{"store": "redis",
+			"redis": map[string]any{"address": "127.0.0.1:6379", "db": 2}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseRateLimitStore(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestServeRateLimitRedis(t *testing.T) {
+	s := newRespServer(t, "")
+	testProxy = func(rt *route, host string) httpProxy {
+		return &myProxy{route: rt, host: host}
+	}
+	defer func() { testProxy = nil }()
+
+	limit := map[string]any{
+		"requests": 1, "period": "1h", "store": "redis",
+		"redis": map[string]any{"address": s.addr()},
+	}
+	// two proxies sharing the same store
+	conf1 := map[string]any{"host": "http://v1.bla", "rateLimit": limit}
+	conf2 := map[string]any{"host": "http://v1.bla", "rateLimit": limit}
+
+	var tests = []struct {
+		name   string
+		conf   map[string]any
+		status int
+	}{
+		{"first proxy", conf1, 200},
+		{"second proxy", conf2, 429},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+		})
+	}
+
+	t.Run("store down", func(t *testing.T) {
+		s.l.Close()
+		rs := &redisStore{client: newRespClient(s.addr(), "", 0, time.Second, 1)}
+		rl := &rateLimit{requests: 1, period: time.Hour, burst: 1, store: rs}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if !rl.allow(w, r, &requestInfo{}) {
+			t.Fatalf("denied with store down")
+		}
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type ctxKey int
+
+const requestInfoKey ctxKey = 0
+
+// requestInfo is information about the client request computed
+// once when the request arrives and used by the other parts of the
+// proxy.
+type requestInfo struct {
+	// the real client ip, resolved using the trusted proxies
+	clientIP string
+	// the authenticated client, if any
+	identity string
+	// the ip of the peer that connected to us
+	peerIP string
+	// the peer is a trusted proxy
+	trustedPeer bool
+	// values of forwarding headers sent by a trusted peer
+	forwardedFor []string
+	forwarded    []string
+	proto        string
+	host         string
+	port         string
+	// method and path of the client request
+	method string
+	path   string
+	// name of the matched route
+	route           string
+	requestID       string
+	requestIDHeader string
+	// tracing spans. nil if tracing is not enabled.
+	span         *span
+	upstreamSpan *span
+	// host of the upstream chosen for the request
+	upstream      string
+	upstreamStart time.Time
+	// address of the connection to the upstream and what it answered
+	upstreamAddr   string
+	upstreamStatus int
+	upstreamTTFB   time.Duration
+	// class of the error talking to the upstream
+	upstreamError string
+	// the websocket tunnel was open
+	upgraded       bool
+	wsBytesIn      atomic.Int64
+	wsBytesOut     atomic.Int64
+	tunnelDuration time.Duration
+	// set when the request is captured for debugging
+	capture *exchange
+	// bodies for the error responses. nil if not configured.
+	errorPages *errorPages
+	// response header rules of the matched route. They are applied
+	// to the responses of the proxy too.
+	responseHeaders headerRules
+}
+
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	ctx := context.WithValue(r.Context(), requestInfoKey, info)
+	return r.WithContext(ctx)
+}
+
+// getRequestInfo returns the info for the request. Requests that did not
+// pass by Serve get an info computed without trusted proxies.
+func getRequestInfo(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		return info
+	}
+	return trustedProxies{}.resolve(r)
+}
+
+// clientIP returns the real ip of the client that sent the request.
+func clientIP(r *http.Request) string {
+	return getRequestInfo(r).clientIP
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var BadRequestIDError error = errors.New("[tupi-proxy] Bad request id config")
+
+const (
+	defaultRequestIDHeader = "X-Request-Id"
+	// ids sent by clients bigger than this are replaced
+	maxRequestIDLen = 128
+)
+
+// newRequestID returns a UUIDv7 (RFC 9562). The first 48 bits are a
+// unix timestamp in milliseconds so the ids are sortable by time.
+func newRequestID() string {
+	var u [16]byte
+	rand.Read(u[6:])
+	ms := uint64(time.Now().UnixMilli())
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], ms)
+	copy(u[:6], ts[2:])
+	u[6] = (u[6] & 0x0f) | 0x70
+	u[8] = (u[8] & 0x3f) | 0x80
+
+	var b [36]byte
+	hex.Encode(b[0:8], u[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], u[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], u[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], u[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], u[10:])
+	return string(b[:])
+}
+
+// validRequestID checks if an id sent by the client can be used. Only
+// visible ascii chars are accepted so the id is safe to be logged.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// setRequestID uses the request id sent by the client or generates
+// a new one. The id is set in the request header, so it is sent to the
+// upstream, and in the response header.
+func setRequestID(w http.ResponseWriter, r *http.Request, header string) string {
+	if header == "" {
+		return ""
+	}
+	id := r.Header.Get(header)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	r.Header.Set(header, id)
+	w.Header().Set(header, id)
+	return id
+}
+
+func parseRequestIDHeader(c map[string]any) (string, error) {
+	h, exists, err := getString(c, "requestIdHeader")
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", BadRequestIDError, err)
+	}
+	if !exists {
+		return defaultRequestIDHeader, nil
+	}
+	return h, nil
+}
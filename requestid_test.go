@@ -0,0 +1,194 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewRequestID(t *testing.T) {
+	re := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	prev := ""
+	for i := 0; i < 100; i++ {
+		id := newRequestID()
+		if !re.MatchString(id) {
+			t.Fatalf("bad uuid %s", id)
+		}
+		if seen[id] {
+			t.Fatalf("repeated id %s", id)
+		}
+		// the timestamp prefix never goes back
+		if id[:13] < prev {
+			t.Fatalf("id not sortable %s < %s", id, prev)
+		}
+		prev = id[:13]
+		seen[id] = true
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	var tests = []struct {
+		id    string
+		valid bool
+	}{
+		{"", false},
+		{"abc-123", true},
+		{"with space", false},
+		{"new\nline", false},
+		{strings.Repeat("a", maxRequestIDLen+1), false},
+	}
+	for _, test := range tests {
+		if validRequestID(test.id) != test.valid {
+			t.Fatalf("bad valid for %q", test.id)
+		}
+	}
+}
+
+func TestParseRequestIDHeader(t *testing.T) {
+	h, err := parseRequestIDHeader(map[string]any{})
+	if err != nil || h != defaultRequestIDHeader {
+		t.Fatalf("bad default %s %v", h, err)
+	}
+	_, err = parseRequestIDHeader(map[string]any{"requestIdHeader": 1})
+	if !errors.Is(err, BadRequestIDError) {
+		t.Fatalf("bad err %v", err)
+	}
+}
+
+func TestServeRequestIDBadConfig(t *testing.T) {
+	conf := map[string]any{"host": 1}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	Serve(w, r, &conf)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("bad code %d", w.Code)
+	}
+	if !validRequestID(w.Result().Header.Get(defaultRequestIDHeader)) {
+		t.Fatalf("no request id in the response")
+	}
+}
+
+func TestServeRequestID(t *testing.T) {
+	var out syncBuffer
+	log.SetOutput(&out)
+	defer func() {
+		testProxy = nil
+		log.SetOutput(os.Stderr)
+	}()
+	var p *myProxy
+	testProxy = func(rt *route, host string) httpProxy {
+		p = &myProxy{route: rt, host: host}
+		return p
+	}
+
+	var tests = []struct {
+		name     string
+		conf     map[string]any
+		header   string
+		sent     string
+		expected string
+	}{
+		{
+			"generated",
+			map[string]any{"host": "http://v1.bla"},
+			"X-Request-Id",
+			"",
+			"",
+		},
+		{
+			"sent by client",
+			map[string]any{"host": "http://v1.bla"},
+			"X-Request-Id",
+			"client-id",
+			"client-id",
+		},
+		{
+			"invalid sent by client",
+			map[string]any{"host": "http://v1.bla"},
+			"X-Request-Id",
+			"bad id",
+			"",
+		},
+		{
+			"custom header",
+			map[string]any{"host": "http://v1.bla", "requestIdHeader": "X-Trace"},
+			"X-Trace",
+			"trace-id",
+			"trace-id",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			if test.sent != "" {
+				r.Header.Set(test.header, test.sent)
+			}
+			Serve(w, r, &test.conf)
+			id := w.Header().Get(test.header)
+			if id == "" || (test.expected != "" && id != test.expected) {
+				t.Fatalf("bad response id %s", id)
+			}
+			if p.pr.Out.Header.Get(test.header) != id {
+				t.Fatalf("bad upstream id %s", p.pr.Out.Header.Get(test.header))
+			}
+
+			resp := &http.Response{
+				Header:  http.Header{test.header: []string{"upstream-id"}},
+				Request: p.pr.Out,
+			}
+			modifyResponse(resp, p.route)
+			if resp.Header.Get(test.header) != "" {
+				t.Fatalf("upstream id not removed")
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		conf := map[string]any{"host": "http://v1.bla", "requestIdHeader": ""}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		Serve(w, r, &conf)
+		if w.Header().Get(defaultRequestIDHeader) != "" {
+			t.Fatalf("id generated")
+		}
+	})
+
+	t.Run("log", func(t *testing.T) {
+		conf := map[string]any{"host": "http://v1.bla"}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		testProxy = nil
+		Serve(w, r, &conf)
+		id := w.Header().Get(defaultRequestIDHeader)
+		if !strings.Contains(out.String(), "upstream error requestId="+id) {
+			t.Fatalf("bad log %s", out.String())
+		}
+	})
+}
@@ -0,0 +1,207 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respServer is an in-process stand-in for a redis server. It knows
+// the commands used by the proxy and runs the gcra script in go.
+type respServer struct {
+	l        net.Listener
+	password string
+
+	mu       sync.Mutex
+	values   map[string]string
+	scripts  map[string]string
+	commands []string
+}
+
+func newRespServer(t *testing.T, password string) *respServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("bad listen %s", err.Error())
+	}
+	s := &respServer{
+		l:        l,
+		password: password,
+		values:   map[string]string{},
+		scripts:  map[string]string{},
+	}
+	go s.serve()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *respServer) addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *respServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *respServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := s.password == ""
+	for {
+		reply, err := readRespReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+		if cmd == "AUTH" {
+			if args[1] != s.password {
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+				continue
+			}
+			authed = true
+			conn.Write([]byte("+OK\r\n"))
+			continue
+		}
+		if !authed {
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			continue
+		}
+		conn.Write([]byte(s.exec(cmd, args[1:])))
+	}
+}
+
+func (s *respServer) exec(cmd string, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := s.values[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		s.values[args[0]] = args[1]
+		return "+OK\r\n"
+	case "EVAL":
+		h := sha1.Sum([]byte(args[0]))
+		sha := hex.EncodeToString(h[:])
+		s.scripts[sha] = args[0]
+		return s.eval(args[0], args[2:])
+	case "EVALSHA":
+		script, ok := s.scripts[args[0]]
+		if !ok {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		return s.eval(script, args[2:])
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// eval runs the gcra script. The arguments are the key and ARGV.
+func (s *respServer) eval(script string, args []string) string {
+	if script != gcraScript {
+		return "-ERR unknown script\r\n"
+	}
+	key := args[0]
+	interval, _ := strconv.ParseInt(args[1], 10, 64)
+	burst, _ := strconv.ParseInt(args[2], 10, 64)
+	now, _ := strconv.ParseInt(args[3], 10, 64)
+	tat, err := strconv.ParseInt(s.values[key], 10, 64)
+	if err != nil || tat < now {
+		tat = now
+	}
+	newTat := tat + interval
+	allowAt := newTat - interval*burst
+	if allowAt > now {
+		return fmt.Sprintf("*4\r\n:0\r\n:0\r\n:%d\r\n:%d\r\n", allowAt-now, tat-now)
+	}
+	s.values[key] = strconv.FormatInt(newTat, 10)
+	return fmt.Sprintf("*4\r\n:1\r\n:%d\r\n:0\r\n:%d\r\n", (now-allowAt)/interval, newTat-now)
+}
+
+func TestRespClientDo(t *testing.T) {
+	s := newRespServer(t, "secret")
+
+	var tests = []struct {
+		name     string
+		password string
+		args     []string
+		expected any
+		err      error
+	}{
+		{"simple string", "secret", []string{"PING"}, "PONG", nil},
+		{"nil bulk", "secret", []string{"GET", "nothing"}, nil, nil},
+		{"error", "secret", []string{"BLA"}, nil, RespError},
+		{"bad password", "wrong", []string{"PING"}, nil, RespError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newRespClient(s.addr(), test.password, 1, time.Second, 2)
+			reply, err := c.do(test.args...)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+			if reply != test.expected {
+				t.Fatalf("bad reply %v", reply)
+			}
+		})
+	}
+
+	t.Run("bulk string", func(t *testing.T) {
+		c := newRespClient(s.addr(), "secret", 0, time.Second, 2)
+		c.do("SET", "k", "a\r\nvalue")
+		reply, err := c.do("GET", "k")
+		if err != nil || reply != "a\r\nvalue" {
+			t.Fatalf("bad reply %v %v", reply, err)
+		}
+		if len(c.pool) != 1 {
+			t.Fatalf("connection not reused")
+		}
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var BadRewriteError error = errors.New("[tupi-proxy] Bad path rewrite config")
+
+// pathRewrite changes the path of the request sent to the upstream.
+// The rules are applied in the order: strip prefix, regex replace, add
+// prefix. The rules operate on the escaped path so encoded segments
+// (like %2F) are kept as they came.
+type pathRewrite struct {
+	stripPrefix string
+	addPrefix   string
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (pr *pathRewrite) isEmpty() bool {
+	return pr.stripPrefix == "" && pr.addPrefix == "" && pr.re == nil
+}
+
+// rewrite returns the new escaped path for an escaped path.
+func (pr *pathRewrite) rewrite(escaped string) string {
+	p := escaped
+	if pr.stripPrefix != "" {
+		p = stripPathPrefix(p, pr.stripPrefix)
+	}
+	if pr.re != nil {
+		p = pr.re.ReplaceAllString(p, pr.replacement)
+	}
+	if pr.addPrefix != "" {
+		p = joinPath(pr.addPrefix, p)
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// apply rewrites the path of the url.
+func (pr *pathRewrite) apply(u *url.URL) {
+	if pr == nil || pr.isEmpty() {
+		return
+	}
+	setEscapedPath(u, pr.rewrite(u.EscapedPath()))
+}
+
+// setEscapedPath sets both Path and RawPath for an escaped path.
+// If the escaped path is invalid the url is not changed.
+func setEscapedPath(u *url.URL, escaped string) {
+	p, err := url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+	u.Path = p
+	u.RawPath = ""
+	if u.EscapedPath() != escaped {
+		u.RawPath = escaped
+	}
+}
+
+// stripPathPrefix removes a prefix from the path only if the prefix
+// is whole path segments, ie: /api is stripped from /api/x but not
+// from /apix
+func stripPathPrefix(p, prefix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if p == prefix {
+		return "/"
+	}
+	if strings.HasPrefix(p, prefix+"/") {
+		return p[len(prefix):]
+	}
+	return p
+}
+
+func joinPath(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// setUpstreamURL changes the scheme and host of u to the ones of
+// target and prepends the target path to the path of u. This is the
+// same done by httputil.ProxyRequest.SetURL, except the query, that
+// is kept as it is.
+func setUpstreamURL(u *url.URL, target *url.URL) {
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	if target.Path == "" && target.RawPath == "" {
+		return
+	}
+	setEscapedPath(u, joinPath(target.EscapedPath(), u.EscapedPath()))
+}
+
+// parsePathRewrite parses the stripPrefix, rewritePath and addPrefix
+// keys. If none of them is in the config the inherited rewrite is
+// returned.
+func parsePathRewrite(c map[string]any, inherited *pathRewrite) (*pathRewrite, error) {
+	pr := &pathRewrite{}
+	stripExists, addExists := false, false
+	var err error
+	pr.stripPrefix, stripExists, err = getString(c, "stripPrefix")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRewriteError, err)
+	}
+	pr.addPrefix, addExists, err = getString(c, "addPrefix")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRewriteError, err)
+	}
+
+	rw, exists, err := getMap(c, "rewritePath")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRewriteError, err)
+	}
+	if !exists {
+		if !stripExists && !addExists {
+			return inherited, nil
+		}
+		return pr, nil
+	}
+	rawRe, _, err := getString(rw, "regex")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRewriteError, err)
+	}
+	if rawRe == "" {
+		return nil, fmt.Errorf("%w: rewritePath needs a regex", BadRewriteError)
+	}
+	pr.re, err = regexp.Compile(rawRe)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRewriteError, err)
+	}
+	pr.replacement, _, err = getString(rw, "replacement")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRewriteError, err)
+	}
+	return pr, nil
+}
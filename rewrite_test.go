@@ -0,0 +1,207 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParsePathRewrite(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{
+			"bad strip prefix",
+			map[string]any{"stripPrefix": 1},
+			BadRewriteError,
+		},
+		{
+			"rewrite without regex",
+			map[string]any{"rewritePath": map[string]any{"replacement": "/x"}},
+			BadRewriteError,
+		},
+		{
+			"bad regex",
+			map[string]any{"rewritePath": map[string]any{"regex": "(("}},
+			BadRewriteError,
+		},
+		{
+			"ok",
+			map[string]any{
+				"stripPrefix": "/api",
+				"rewritePath": map[string]any{
+					"regex":       "^/users/(\\d+)$",
+					"replacement": "/v2/accounts/$1",
+				},
+			},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parsePathRewrite(test.conf, nil)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestPathRewrite(t *testing.T) {
+	var tests = []struct {
+		name        string
+		conf        map[string]any
+		path        string
+		outPath     string
+		outEscaped  string
+		upstreamURL string
+	}{
+		{
+			"no rules",
+			map[string]any{},
+			"/a/b",
+			"/a/b",
+			"/a/b",
+			"http://up.bla",
+		},
+		{
+			"strip prefix",
+			map[string]any{"stripPrefix": "/api"},
+			"/api/users",
+			"/users",
+			"/users",
+			"http://up.bla",
+		},
+		{
+			"strip whole path",
+			map[string]any{"stripPrefix": "/api/"},
+			"/api",
+			"/",
+			"/",
+			"http://up.bla",
+		},
+		{
+			"strip only segments",
+			map[string]any{"stripPrefix": "/api"},
+			"/apiary",
+			"/apiary",
+			"/apiary",
+			"http://up.bla",
+		},
+		{
+			"add prefix",
+			map[string]any{"addPrefix": "/v1"},
+			"/users",
+			"/v1/users",
+			"/v1/users",
+			"http://up.bla",
+		},
+		{
+			"regex with capture groups",
+			map[string]any{
+				"stripPrefix": "/api",
+				"rewritePath": map[string]any{
+					"regex":       "^/users/(\\d+)$",
+					"replacement": "/v2/accounts/$1",
+				},
+			},
+			"/api/users/10",
+			"/v2/accounts/10",
+			"/v2/accounts/10",
+			"http://up.bla",
+		},
+		{
+			"encoded segments",
+			map[string]any{"stripPrefix": "/api", "addPrefix": "/v1"},
+			"/api/files/a%2Fb",
+			"/v1/files/a/b",
+			"/v1/files/a%2Fb",
+			"http://up.bla",
+		},
+		{
+			"upstream with path",
+			map[string]any{"stripPrefix": "/api"},
+			"/api/files/a%2Fb",
+			"/base/files/a/b",
+			"/base/files/a%2Fb",
+			"http://up.bla/base",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rw, err := parsePathRewrite(test.conf, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			up, _ := url.Parse(test.upstreamURL)
+			rt := &route{host: up, rewrite: rw}
+
+			// http
+			r, _ := http.NewRequest("GET", "http://the.site"+test.path+"?a=1", nil)
+			pr := &httputil.ProxyRequest{In: r, Out: r.Clone(r.Context())}
+			rewriteRequest(pr, rt, "")
+			if pr.Out.URL.Path != test.outPath {
+				t.Fatalf("bad path %s", pr.Out.URL.Path)
+			}
+			if pr.Out.URL.EscapedPath() != test.outEscaped {
+				t.Fatalf("bad escaped path %s", pr.Out.URL.EscapedPath())
+			}
+			if pr.Out.URL.RawQuery != "a=1" {
+				t.Fatalf("bad query %s", pr.Out.URL.RawQuery)
+			}
+
+			// ws
+			h := newHijacker(false)
+			testDial = func(n, a string) (net.Conn, error) {
+				return h.destConn, nil
+			}
+			defer func() {
+				testDial = nil
+			}()
+			wr, _ := http.NewRequest("GET", "http://the.site"+test.path+"?a=1", nil)
+			p := &wsProxy{route: rt}
+			p.ServeHTTP(h, wr)
+			written := string(h.destConn.(*bufferConn).written())
+			expected := "GET " + test.outEscaped + "?a=1 HTTP/1.1"
+			if !strings.HasPrefix(written, expected) {
+				t.Fatalf("bad ws request %s", written)
+			}
+		})
+	}
+}
+
+func TestWsURL(t *testing.T) {
+	u, _ := url.Parse("https://up.bla/x")
+	wu := wsURL(u)
+	if wu.String() != "wss://up.bla/x" {
+		t.Fatalf("bad ws url %s", wu.String())
+	}
+	if u.Scheme != "https" {
+		t.Fatalf("original url changed")
+	}
+}
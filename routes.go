@@ -0,0 +1,462 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var BadRouteError error = errors.New("[tupi-proxy] Bad route config")
+
+// route is a destination for requests. A request is sent to the
+// first route (in priority order) whose predicates all match it.
+type route struct {
+	name            string
+	host            *url.URL
+	preserveHost    bool
+	hasPreserveHost bool
+	priority        int64
+	predicates      []predicate
+	rewrite         *pathRewrite
+	canary          *canary
+	mirror          *mirror
+	forwarded       forwardedHeaders
+	requestHeaders  headerRules
+	responseHeaders headerRules
+	rateLimit       *rateLimit
+	concurrency     *concurrency
+	priorityClass   string
+	ipAccess        *ipAccess
+	limits          *requestLimits
+	forwardAuth     *forwardAuth
+	jwt             *jwtAuth
+	basicAuth       *basicAuth
+	signing         *requestSigner
+}
+
+// matches returns true if all predicates of the route match the request.
+func (rt *route) matches(r *http.Request) bool {
+	for _, p := range rt.predicates {
+		if !p.match(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// headerHost returns the value for the Host header of the request
+// sent to the upstream.
+func (rt *route) headerHost(r *http.Request) string {
+	if !rt.hasPreserveHost {
+		return ""
+	}
+	if rt.preserveHost {
+		return r.Host
+	}
+	return rt.host.Host
+}
+
+// matchRoute returns the route for the request. If no route matches
+// the default route is returned.
+func (pc *proxyConfig) matchRoute(r *http.Request) *route {
+	for _, rt := range pc.routes {
+		if rt.matches(r) {
+			return rt
+		}
+	}
+	return pc.defaultRoute
+}
+
+type predicate interface {
+	match(r *http.Request) bool
+}
+
+type methodPredicate struct {
+	methods []string
+}
+
+func (p methodPredicate) match(r *http.Request) bool {
+	for _, m := range p.methods {
+		if m == r.Method {
+			return true
+		}
+	}
+	return false
+}
+
+type pathPrefixPredicate struct {
+	prefix string
+}
+
+func (p pathPrefixPredicate) match(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, p.prefix)
+}
+
+type pathRegexPredicate struct {
+	re *regexp.Regexp
+}
+
+func (p pathRegexPredicate) match(r *http.Request) bool {
+	return p.re.MatchString(r.URL.Path)
+}
+
+type valueMatchKind int
+
+const (
+	matchExact valueMatchKind = iota
+	matchRegex
+	matchPresent
+	matchAbsent
+)
+
+// valueMatch matches a named value - a header, a query param or a cookie.
+type valueMatch struct {
+	name  string
+	kind  valueMatchKind
+	value string
+	re    *regexp.Regexp
+}
+
+func (m valueMatch) test(values []string) bool {
+	switch m.kind {
+	case matchPresent:
+		return len(values) > 0
+	case matchAbsent:
+		return len(values) == 0
+	}
+	for _, v := range values {
+		if m.kind == matchExact && v == m.value {
+			return true
+		}
+		if m.kind == matchRegex && m.re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+type headerPredicate struct {
+	valueMatch
+}
+
+func (p headerPredicate) match(r *http.Request) bool {
+	return p.test(r.Header.Values(p.name))
+}
+
+type queryPredicate struct {
+	valueMatch
+}
+
+func (p queryPredicate) match(r *http.Request) bool {
+	return p.test(r.URL.Query()[p.name])
+}
+
+type cookiePredicate struct {
+	valueMatch
+}
+
+func (p cookiePredicate) match(r *http.Request) bool {
+	var values []string
+	for _, c := range r.Cookies() {
+		if c.Name == p.name {
+			values = append(values, c.Value)
+		}
+	}
+	return p.test(values)
+}
+
+// parseRoutes parses the `routes` key of the config. The returned
+// routes are sorted by priority, higher first. Routes with the same
+// priority keep the config order.
+func parseRoutes(c map[string]any, defaultRoute *route) ([]*route, error) {
+	rawRoutes, _, err := getMapList(c, "routes")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadRouteError, err)
+	}
+	routes := make([]*route, 0, len(rawRoutes))
+	for i, rr := range rawRoutes {
+		rt, err := parseRoute(rr, defaultRoute, fmt.Sprintf("route-%d", i))
+		if err != nil {
+			return nil, fmt.Errorf("%w: route %d: %w", BadRouteError, i, err)
+		}
+		routes = append(routes, rt)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].priority > routes[j].priority
+	})
+	return routes, nil
+}
+
+// parseRoute parses a route. defaultName is used if the route has no name.
+func parseRoute(c map[string]any, defaultRoute *route, defaultName string) (*route, error) {
+	rt := &route{
+		host:            defaultRoute.host,
+		preserveHost:    defaultRoute.preserveHost,
+		hasPreserveHost: defaultRoute.hasPreserveHost,
+	}
+	name, exists, err := getString(c, "name")
+	if err != nil {
+		return nil, err
+	}
+	if !exists || name == "" {
+		name = defaultName
+	}
+	rt.name = name
+
+	h, exists, err := getString(c, "host")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		u, err := url.Parse(h)
+		if err != nil {
+			return nil, BadHostError
+		}
+		rt.host = u
+	}
+
+	p, exists, err := getBool(c, "preserveHost")
+	if err != nil {
+		return nil, BadPreserveHost
+	}
+	if exists {
+		rt.preserveHost = p
+		rt.hasPreserveHost = true
+	}
+
+	rt.rewrite, err = parsePathRewrite(c, defaultRoute.rewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.canary, err = parseCanary(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.forwarded, err = parseForwardedHeaders(c, defaultRoute.forwarded)
+	if err != nil {
+		return nil, err
+	}
+
+	// the route rules are applied after the top level rules
+	reqRules, err := parseHeaderRules(c, "requestHeaders")
+	if err != nil {
+		return nil, err
+	}
+	rt.requestHeaders = append(append(headerRules{}, defaultRoute.requestHeaders...), reqRules...)
+	respRules, err := parseHeaderRules(c, "responseHeaders")
+	if err != nil {
+		return nil, err
+	}
+	rt.responseHeaders = append(append(headerRules{}, defaultRoute.responseHeaders...), respRules...)
+
+	rt.mirror, err = parseMirror(c, defaultRoute.mirror)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.ipAccess, err = parseIPAccess(c, defaultRoute.ipAccess)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.limits, err = parseRequestLimits(c, defaultRoute.limits)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.forwardAuth, err = parseForwardAuth(c, defaultRoute.forwardAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.jwt, err = parseJWT(c, defaultRoute.jwt)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.basicAuth, err = parseBasicAuth(c, defaultRoute.basicAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.signing, err = parseSigning(c, defaultRoute.signing)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.rateLimit, err = parseRateLimit(c, defaultRoute.rateLimit, rt.name)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.concurrency, err = parseConcurrency(c, defaultRoute.concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.priorityClass, err = parsePriorityClass(c, rt.concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.priority, _, err = getInt(c, "priority")
+	if err != nil {
+		return nil, err
+	}
+
+	rt.predicates, err = parsePredicates(c)
+	if err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// parsePredicates parses the request predicates of a config table:
+// methods, pathPrefix, pathRegex, headers, query and cookies.
+func parsePredicates(c map[string]any) ([]predicate, error) {
+	var predicates []predicate
+	methods, exists, err := getStringList(c, "methods")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		for i, m := range methods {
+			methods[i] = strings.ToUpper(m)
+		}
+		predicates = append(predicates, methodPredicate{methods: methods})
+	}
+
+	prefix, exists, err := getString(c, "pathPrefix")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		predicates = append(predicates, pathPrefixPredicate{prefix: prefix})
+	}
+
+	pathRe, exists, err := getString(c, "pathRegex")
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		re, err := regexp.Compile(pathRe)
+		if err != nil {
+			return nil, fmt.Errorf("%w: pathRegex: %w", BadConfigValue, err)
+		}
+		predicates = append(predicates, pathRegexPredicate{re: re})
+	}
+
+	headers, err := parseValueMatches(c, "headers")
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range headers {
+		m.name = http.CanonicalHeaderKey(m.name)
+		predicates = append(predicates, headerPredicate{m})
+	}
+
+	query, err := parseValueMatches(c, "query")
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range query {
+		predicates = append(predicates, queryPredicate{m})
+	}
+
+	cookies, err := parseValueMatches(c, "cookies")
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range cookies {
+		predicates = append(predicates, cookiePredicate{m})
+	}
+	return predicates, nil
+}
+
+// parseValueMatches parses a list of value matches like:
+// [{"name" = "X-Api-Version", "value" = "2"}, {"name" = "X-Other", "present" = true}]
+func parseValueMatches(c map[string]any, key string) ([]valueMatch, error) {
+	raw, _, err := getMapList(c, key)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]valueMatch, 0, len(raw))
+	for _, rm := range raw {
+		name, exists, err := getString(rm, "name")
+		if err != nil {
+			return nil, err
+		}
+		if !exists || name == "" {
+			return nil, fmt.Errorf("%w: %s needs a name", BadConfigValue, key)
+		}
+		m := valueMatch{name: name}
+		n := 0
+
+		value, exists, err := getString(rm, "value")
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			m.kind = matchExact
+			m.value = value
+			n++
+		}
+
+		rawRe, exists, err := getString(rm, "regex")
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			re, err := regexp.Compile(rawRe)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s regex: %w", BadConfigValue, key, err)
+			}
+			m.kind = matchRegex
+			m.re = re
+			n++
+		}
+
+		present, exists, err := getBool(rm, "present")
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			m.kind = matchAbsent
+			if present {
+				m.kind = matchPresent
+			}
+			n++
+		}
+
+		if n != 1 {
+			return nil, fmt.Errorf(
+				"%w: %s %s needs exactly one of value, regex or present",
+				BadConfigValue, key, name)
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
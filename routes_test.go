@@ -0,0 +1,287 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{
+			"no routes",
+			map[string]any{"host": "http://v1.bla"},
+			nil,
+		},
+		{
+			"routes not a list",
+			map[string]any{"host": "http://v1.bla", "routes": "x"},
+			BadRouteError,
+		},
+		{
+			"bad route host",
+			map[string]any{"host": "http://v1.bla", "routes": []any{
+				map[string]any{"host": "bad://sdf.xx:jj?"},
+			}},
+			BadHostError,
+		},
+		{
+			"bad priority",
+			map[string]any{"host": "http://v1.bla", "routes": []any{
+				map[string]any{"priority": "high"},
+			}},
+			BadConfigValue,
+		},
+		{
+			"bad path regex",
+			map[string]any{"host": "http://v1.bla", "routes": []any{
+				map[string]any{"pathRegex": "(("},
+			}},
+			BadConfigValue,
+		},
+		{
+			"header without name",
+			map[string]any{"host": "http://v1.bla", "routes": []any{
+				map[string]any{"headers": []any{
+					map[string]any{"value": "2"},
+				}},
+			}},
+			BadConfigValue,
+		},
+		{
+			"header with value and regex",
+			map[string]any{"host": "http://v1.bla", "routes": []any{
+				map[string]any{"headers": []any{
+					map[string]any{"name": "X-Api-Version", "value": "2", "regex": "2"},
+				}},
+			}},
+			BadConfigValue,
+		},
+		{
+			"ok",
+			map[string]any{"host": "http://v1.bla", "routes": []any{
+				map[string]any{
+					"host":     "http://v2.bla",
+					"priority": int64(10),
+					"methods":  []any{"get"},
+					"headers": []any{
+						map[string]any{"name": "X-Api-Version", "value": "2"},
+					},
+					"query": []any{
+						map[string]any{"name": "debug", "present": true},
+					},
+					"cookies": []any{
+						map[string]any{"name": "beta", "regex": "^y"},
+					},
+				},
+			}},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseConfig(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestParseRouteInheritance(t *testing.T) {
+	pc, err := parseConfig(map[string]any{
+		"host":        "http://v1.bla",
+		"stripPrefix": "/api",
+		"mirror":      map[string]any{"hosts": []any{"http://shadow.bla"}},
+		"routes": []any{
+			map[string]any{"name": "inherits"},
+			map[string]any{"name": "own", "addPrefix": "/v2"},
+			map[string]any{"name": "off", "stripPrefix": "",
+				"mirror": map[string]any{"disabled": true}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := map[string]*route{}
+	for _, rt := range pc.routes {
+		routes[rt.name] = rt
+	}
+	var tests = []struct {
+		route  string
+		path   string
+		mirror bool
+	}{
+		{"inherits", "/users", true},
+		{"own", "/v2/api/users", true},
+		{"off", "/api/users", false},
+	}
+	for _, test := range tests {
+		t.Run(test.route, func(t *testing.T) {
+			rt := routes[test.route]
+			u := &url.URL{Path: "/api/users"}
+			rt.rewrite.apply(u)
+			if u.Path != test.path {
+				t.Fatalf("bad path %s", u.Path)
+			}
+			if (rt.mirror == pc.defaultRoute.mirror) != test.mirror {
+				t.Fatalf("bad mirror %v", rt.mirror)
+			}
+		})
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	conf := map[string]any{
+		"host": "http://v1.bla",
+		"routes": []any{
+			map[string]any{
+				"name": "v2",
+				"host": "http://v2.bla",
+				"headers": []any{
+					map[string]any{"name": "x-api-version", "value": "2"},
+				},
+			},
+			map[string]any{
+				"name":     "v3",
+				"host":     "http://v3.bla",
+				"priority": int64(10),
+				"headers": []any{
+					map[string]any{"name": "X-Api-Version", "regex": "^3"},
+				},
+			},
+			map[string]any{
+				"name":       "admin",
+				"host":       "http://admin.bla",
+				"priority":   int64(5),
+				"methods":    []any{"POST"},
+				"pathPrefix": "/admin",
+				"cookies": []any{
+					map[string]any{"name": "session", "present": true},
+				},
+			},
+			map[string]any{
+				"name":      "debug",
+				"host":      "http://debug.bla",
+				"pathRegex": "^/users/\\d+$",
+				"query": []any{
+					map[string]any{"name": "debug", "value": "1"},
+					map[string]any{"name": "trace", "present": false},
+				},
+			},
+		},
+	}
+	pc, err := parseConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name      string
+		reqFn     func() *http.Request
+		routeName string
+	}{
+		{
+			"default route",
+			func() *http.Request {
+				r, _ := http.NewRequest("GET", "/", nil)
+				return r
+			},
+			"default",
+		},
+		{
+			"header exact",
+			func() *http.Request {
+				r, _ := http.NewRequest("GET", "/", nil)
+				r.Header.Set("X-Api-Version", "2")
+				return r
+			},
+			"v2",
+		},
+		{
+			"header regex",
+			func() *http.Request {
+				r, _ := http.NewRequest("GET", "/", nil)
+				r.Header.Set("X-Api-Version", "3.1")
+				return r
+			},
+			"v3",
+		},
+		{
+			"all predicates must match",
+			func() *http.Request {
+				r, _ := http.NewRequest("GET", "/admin/users", nil)
+				r.AddCookie(&http.Cookie{Name: "session", Value: "x"})
+				return r
+			},
+			"default",
+		},
+		{
+			"method, path and cookie",
+			func() *http.Request {
+				r, _ := http.NewRequest("POST", "/admin/users", nil)
+				r.AddCookie(&http.Cookie{Name: "session", Value: "x"})
+				return r
+			},
+			"admin",
+		},
+		{
+			"priority",
+			func() *http.Request {
+				r, _ := http.NewRequest("POST", "/admin/users", nil)
+				r.AddCookie(&http.Cookie{Name: "session", Value: "x"})
+				r.Header.Set("X-Api-Version", "3")
+				return r
+			},
+			"v3",
+		},
+		{
+			"query",
+			func() *http.Request {
+				r, _ := http.NewRequest("GET", "/users/10?debug=1", nil)
+				return r
+			},
+			"debug",
+		},
+		{
+			"query absent",
+			func() *http.Request {
+				r, _ := http.NewRequest("GET", "/users/10?debug=1&trace=1", nil)
+				return r
+			},
+			"default",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rt := pc.matchRoute(test.reqFn())
+			if rt.name != test.routeName {
+				t.Fatalf("bad route %s", rt.name)
+			}
+		})
+	}
+}
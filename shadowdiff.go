@@ -0,0 +1,340 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var BadCompareError error = errors.New("[tupi-proxy] Bad shadow compare config")
+
+const (
+	compareBodyNone = "none"
+	compareBodyHash = "hash"
+	compareBodyJSON = "json"
+
+	defaultCompareMaxBody = 1024 * 1024
+	// max number of differences reported for a json body
+	maxJSONDiffs = 20
+)
+
+// shadowCompare compares the response of a shadow upstream with the
+// response of the primary upstream and logs the mismatches.
+type shadowCompare struct {
+	headers []string
+	// how bodies are compared: none, hash or json
+	body        string
+	ignorePaths [][]string
+	// bodies bigger than this are compared only by hash
+	maxBody int64
+}
+
+// capturedResponse is what is compared from a response.
+type capturedResponse struct {
+	status    int
+	header    http.Header
+	hash      []byte
+	body      []byte
+	truncated bool
+}
+
+// responseRecorder is a response writer that captures the response
+// while it is written to the client.
+type responseRecorder struct {
+	*responseWriter
+	resp capturedResponse
+	h    hash.Hash
+	done chan struct{}
+	once sync.Once
+}
+
+func newResponseRecorder(w http.ResponseWriter, maxBody int64) *responseRecorder {
+	return &responseRecorder{
+		responseWriter: newRecordingWriter(w, maxBody),
+		h:              sha256.New(),
+		done:           make(chan struct{}),
+	}
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rr.responseWriter.Write(b)
+	rr.h.Write(b[:n])
+	return n, err
+}
+
+// finish must be called when the response is done.
+func (rr *responseRecorder) finish() {
+	rr.once.Do(func() {
+		rr.resp.status, rr.resp.header = rr.response()
+		body, _, truncated := rr.body.content()
+		rr.resp.truncated = truncated
+		if !truncated {
+			rr.resp.body = body
+		}
+		rr.resp.hash = rr.h.Sum(nil)
+		close(rr.done)
+	})
+}
+
+func readShadowResponse(resp *http.Response, maxBody int64) (*capturedResponse, error) {
+	cr := &capturedResponse{
+		status: resp.StatusCode,
+		header: resp.Header,
+	}
+	h := sha256.New()
+	body := &prefixBuffer{limit: maxBody}
+	_, err := io.Copy(io.MultiWriter(h, body), resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	cr.hash = h.Sum(nil)
+	b, _, truncated := body.content()
+	cr.truncated = truncated
+	if !truncated {
+		cr.body = b
+	}
+	return cr, nil
+}
+
+// mismatch is what is logged when the responses differ.
+type mismatch struct {
+	Status  []int
+	Headers map[string][2]string
+	Body    string
+	Paths   []string
+}
+
+// diff returns the differences between the primary and the shadow
+// responses. It returns nil if the responses match.
+func (sc *shadowCompare) diff(primary, shadow *capturedResponse) *mismatch {
+	m := &mismatch{}
+	differ := false
+	if primary.status != shadow.status {
+		m.Status = []int{primary.status, shadow.status}
+		differ = true
+	}
+	for _, name := range sc.headers {
+		pv := primary.header.Get(name)
+		sv := shadow.header.Get(name)
+		if pv != sv {
+			if m.Headers == nil {
+				m.Headers = make(map[string][2]string)
+			}
+			m.Headers[name] = [2]string{pv, sv}
+			differ = true
+		}
+	}
+
+	switch sc.body {
+	case compareBodyHash:
+		if !bytes.Equal(primary.hash, shadow.hash) {
+			m.Body = "hash differs"
+			differ = true
+		}
+	case compareBodyJSON:
+		if bytes.Equal(primary.hash, shadow.hash) {
+			break
+		}
+		if primary.truncated || shadow.truncated {
+			m.Body = "hash differs"
+			differ = true
+			break
+		}
+		paths, err := sc.jsonDiff(primary.body, shadow.body)
+		if err != nil {
+			m.Body = "invalid json"
+			differ = true
+			break
+		}
+		if len(paths) > 0 {
+			m.Body = "json differs"
+			m.Paths = paths
+			differ = true
+		}
+	}
+	if !differ {
+		return nil
+	}
+	return m
+}
+
+func (sc *shadowCompare) compare(info *requestInfo, host string,
+	primary, shadow *capturedResponse) {
+	m := sc.diff(primary, shadow)
+	if m == nil {
+		return
+	}
+	shadowMismatches.add(1, host)
+	requestLogger(info).Warn("shadow mismatch",
+		"method", info.method, "path", info.path, "shadow", host,
+		"status", m.Status, "headers", m.Headers, "body", m.Body,
+		"jsonPaths", m.Paths)
+}
+
+// jsonDiff returns the paths where the two json documents differ.
+func (sc *shadowCompare) jsonDiff(a, b []byte) ([]string, error) {
+	var da, db any
+	if err := json.Unmarshal(a, &da); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &db); err != nil {
+		return nil, err
+	}
+	var diffs []string
+	sc.walkJSON(da, db, nil, &diffs)
+	return diffs, nil
+}
+
+func (sc *shadowCompare) walkJSON(a, b any, path []string, diffs *[]string) {
+	if len(*diffs) >= maxJSONDiffs || sc.isIgnored(path) {
+		return
+	}
+	switch va := a.(type) {
+	case map[string]any:
+		vb, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		// sorted so the same diffs are reported when there are
+		// more than maxJSONDiffs
+		keys := make([]string, 0, len(va)+len(vb))
+		for k := range va {
+			keys = append(keys, k)
+		}
+		for k := range vb {
+			if _, exists := va[k]; !exists {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sc.walkJSON(va[k], vb[k], appendPath(path, k), diffs)
+		}
+		return
+	case []any:
+		vb, ok := b.([]any)
+		if !ok {
+			break
+		}
+		n := max(len(va), len(vb))
+		for i := 0; i < n; i++ {
+			var ia, ib any
+			if i < len(va) {
+				ia = va[i]
+			}
+			if i < len(vb) {
+				ib = vb[i]
+			}
+			sc.walkJSON(ia, ib, appendPath(path, strconv.Itoa(i)), diffs)
+		}
+		return
+	default:
+		if a == b {
+			return
+		}
+	}
+	p := strings.Join(path, ".")
+	if p == "" {
+		p = "."
+	}
+	*diffs = append(*diffs, p)
+}
+
+func appendPath(path []string, key string) []string {
+	np := make([]string, len(path), len(path)+1)
+	copy(np, path)
+	return append(np, key)
+}
+
+// isIgnored returns true if the path is one of the ignored paths or
+// is inside one of them. `*` matches any key or index.
+func (sc *shadowCompare) isIgnored(path []string) bool {
+	for _, ip := range sc.ignorePaths {
+		if len(ip) > len(path) {
+			continue
+		}
+		match := true
+		for i, seg := range ip {
+			if seg != "*" && seg != path[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func parseShadowCompare(c map[string]any) (*shadowCompare, error) {
+	raw, exists, err := getMap(c, "compare")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCompareError, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	sc := &shadowCompare{
+		body:    compareBodyHash,
+		maxBody: defaultCompareMaxBody,
+	}
+	sc.headers, _, err = getStringList(raw, "headers")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCompareError, err)
+	}
+
+	body, exists, err := getString(raw, "body")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCompareError, err)
+	}
+	if exists {
+		if body != compareBodyNone && body != compareBodyHash && body != compareBodyJSON {
+			return nil, fmt.Errorf("%w: body must be none, hash or json", BadCompareError)
+		}
+		sc.body = body
+	}
+
+	ignore, _, err := getStringList(raw, "ignorePaths")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCompareError, err)
+	}
+	for _, p := range ignore {
+		sc.ignorePaths = append(sc.ignorePaths, strings.Split(p, "."))
+	}
+
+	maxBody, exists, err := getInt(raw, "maxBodySize")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadCompareError, err)
+	}
+	if exists {
+		sc.maxBody = maxBody
+	}
+	return sc, nil
+}
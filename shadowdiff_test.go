@@ -0,0 +1,258 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseShadowCompare(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{
+			"no compare",
+			map[string]any{},
+			nil,
+		},
+		{
+			"bad body",
+			map[string]any{"compare": map[string]any{"body": "xml"}},
+			BadCompareError,
+		},
+		{
+			"bad headers",
+			map[string]any{"compare": map[string]any{"headers": "x"}},
+			BadCompareError,
+		},
+		{
+			"ok",
+			map[string]any{"compare": map[string]any{
+				"body":        "json",
+				"headers":     []any{"Content-Type"},
+				"ignorePaths": []any{"meta.requestId", "items.*.ts"},
+			}},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseShadowCompare(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestJSONDiff(t *testing.T) {
+	sc, _ := parseShadowCompare(map[string]any{"compare": map[string]any{
+		"body":        "json",
+		"ignorePaths": []any{"meta.requestId", "items.*.ts"},
+	}})
+
+	var tests = []struct {
+		name  string
+		a     string
+		b     string
+		paths []string
+	}{
+		{
+			"equal",
+			`{"a": 1, "b": [1, 2]}`,
+			`{"b": [1, 2], "a": 1}`,
+			nil,
+		},
+		{
+			"ignored paths",
+			`{"meta": {"requestId": "1"}, "items": [{"ts": 1, "v": 1}]}`,
+			`{"meta": {"requestId": "2"}, "items": [{"ts": 2, "v": 1}]}`,
+			nil,
+		},
+		{
+			"differences",
+			`{"a": 1, "b": [1, 2], "c": {"d": "x"}, "e": 1}`,
+			`{"a": 2, "b": [1], "c": {"d": "x", "f": 1}, "e": {}}`,
+			[]string{"a", "b.1", "c.f", "e"},
+		},
+		{
+			"root",
+			`1`,
+			`2`,
+			[]string{"."},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			paths, err := sc.jsonDiff([]byte(test.a), []byte(test.b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, test.paths) {
+				t.Fatalf("bad paths %v", paths)
+			}
+		})
+	}
+}
+
+func TestJSONDiffMaxDiffs(t *testing.T) {
+	sc, _ := parseShadowCompare(map[string]any{"compare": map[string]any{"body": "json"}})
+	a := map[string]any{}
+	b := map[string]any{}
+	var expected []string
+	for i := 0; i < maxJSONDiffs+10; i++ {
+		k := fmt.Sprintf("k%02d", i)
+		a[k] = i
+		b[k] = i + 1
+		if i < maxJSONDiffs {
+			expected = append(expected, k)
+		}
+	}
+	ba, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	// the same diffs are reported every time
+	for i := 0; i < 10; i++ {
+		paths, err := sc.jsonDiff(ba, bb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Fatalf("bad paths %v", paths)
+		}
+	}
+}
+
+func TestShadowCompareDiff(t *testing.T) {
+	sc, _ := parseShadowCompare(map[string]any{"compare": map[string]any{
+		"headers": []any{"Content-Type"},
+	}})
+	rec := newResponseRecorder(httptest.NewRecorder(), 10)
+	rec.Header().Set("Content-Type", "text/plain")
+	rec.Write([]byte("hello"))
+	rec.finish()
+
+	shadow := &capturedResponse{
+		status: http.StatusOK,
+		header: http.Header{"Content-Type": []string{"text/plain"}},
+		hash:   rec.resp.hash,
+	}
+	if m := sc.diff(&rec.resp, shadow); m != nil {
+		t.Fatalf("bad mismatch %v", m)
+	}
+
+	shadow.status = http.StatusNotFound
+	shadow.header = http.Header{"Content-Type": []string{"text/html"}}
+	shadow.hash = []byte("x")
+	m := sc.diff(&rec.resp, shadow)
+	if m == nil {
+		t.Fatalf("no mismatch")
+	}
+	if m.Status[1] != http.StatusNotFound || m.Headers["Content-Type"][1] != "text/html" ||
+		m.Body != "hash differs" {
+		t.Fatalf("bad mismatch %v", m)
+	}
+}
+
+// syncBuffer is a buffer safe to be used as log output
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(b []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.b.Write(b)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.b.String()
+}
+
+func TestServeShadowCompare(t *testing.T) {
+	var out syncBuffer
+	log.SetOutput(&out)
+	defer func() {
+		testProxy = nil
+		log.SetOutput(os.Stderr)
+	}()
+
+	shadow := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": 1, "name": "b"}`))
+		}))
+	defer shadow.Close()
+
+	testProxy = func(rt *route, host string) httpProxy {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": 2, "name": "a"}`))
+		})
+	}
+
+	conf := map[string]any{
+		"host": "http://v1.bla",
+		"mirror": map[string]any{
+			"hosts": []any{shadow.URL},
+			"compare": map[string]any{
+				"headers":     []any{"Content-Type"},
+				"body":        "json",
+				"ignorePaths": []any{"id"},
+			},
+		},
+	}
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/users", nil)
+	Serve(w, r, &conf)
+	if w.Body.String() != `{"id": 2, "name": "a"}` {
+		t.Fatalf("bad primary body %s", w.Body.String())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(out.String(), "shadow mismatch") {
+		if time.Now().After(deadline) {
+			t.Fatalf("mismatch not logged %s", out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	logged := out.String()
+	if !strings.Contains(logged, "jsonPaths=[name]") {
+		t.Fatalf("bad mismatch log %s", logged)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var BadSigningError error = errors.New("[tupi-proxy] Bad request signing config")
+
+const (
+	defaultSigningHeader  = "X-Tupi-Signature"
+	defaultSigningFormat  = `keyId="{keyId}", timestamp="{timestamp}", headers="{headers}", signature="{signature}"`
+	defaultSigningMaxBody = 10 * 1024 * 1024
+)
+
+// signingVars are the values available to the signature header format.
+var signingVars = []string{"{keyId}", "{timestamp}", "{headers}", "{digest}", "{signature}"}
+
+// requestSigner signs the requests sent to the upstreams with a hmac
+// key so the upstreams know the requests came through the proxy. The
+// signed string is the method, the uri, the timestamp, the hex sha256
+// of the body and the signed headers, one per line.
+type requestSigner struct {
+	keyID  string
+	secret []byte
+	// lower case names of the signed headers
+	headers []string
+	// header with the signature
+	header string
+	format string
+	// bodies are read to be signed
+	maxBody int64
+}
+
+// sign adds the signature header to the request. The body of the
+// request is read and replaced. If the body can't be read the request
+// body fails so the upstream request fails.
+func (rs *requestSigner) sign(req *http.Request) {
+	if rs == nil {
+		return
+	}
+	req.Header.Del(rs.header)
+	digest, err := rs.bodyDigest(req)
+	if err != nil {
+		req.Body = readCloser{errorReader{err}, req.Body}
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := base64.StdEncoding.EncodeToString(rs.signature(req, ts, digest))
+	value := strings.NewReplacer(
+		"{keyId}", rs.keyID,
+		"{timestamp}", ts,
+		"{headers}", strings.Join(rs.headers, " "),
+		"{digest}", digest,
+		"{signature}", signature,
+	).Replace(rs.format)
+	req.Header.Set(rs.header, value)
+}
+
+// signature returns the hmac of the string to sign.
+func (rs *requestSigner) signature(req *http.Request, ts, digest string) []byte {
+	mac := hmac.New(sha256.New, rs.secret)
+	io.WriteString(mac, req.Method+"\n")
+	io.WriteString(mac, req.URL.RequestURI()+"\n")
+	io.WriteString(mac, ts+"\n")
+	io.WriteString(mac, digest+"\n")
+	for _, h := range rs.headers {
+		v := strings.Join(req.Header.Values(h), ", ")
+		if h == "host" {
+			v = req.Host
+			if v == "" {
+				v = req.URL.Host
+			}
+		}
+		io.WriteString(mac, h+":"+v+"\n")
+	}
+	return mac.Sum(nil)
+}
+
+// bodyDigest returns the hex sha256 of the request body.
+func (rs *requestSigner) bodyDigest(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	if req.ContentLength > rs.maxBody {
+		return "", &http.MaxBytesError{Limit: rs.maxBody}
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, rs.maxBody+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(body)) > rs.maxBody {
+		return "", &http.MaxBytesError{Limit: rs.maxBody}
+	}
+	req.Body = readCloser{bytes.NewReader(body), req.Body}
+	req.ContentLength = int64(len(body))
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type errorReader struct {
+	err error
+}
+
+func (er errorReader) Read([]byte) (int, error) {
+	return 0, er.err
+}
+
+// parseSigning parses the `signing` key of the config like:
+// {"keyId" = "2024-06", "secretFile" = "/etc/tupi/signing.key", "headers" = ["Host", "Content-Type"]}
+// If there is no signing key the inherited one is returned.
+func parseSigning(c map[string]any, inherited *requestSigner) (*requestSigner, error) {
+	raw, exists, err := getMap(c, "signing")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadSigningError, err)
+	}
+	if !exists {
+		return inherited, nil
+	}
+	disabled, _, err := getBool(raw, "disabled")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadSigningError, err)
+	}
+	if disabled {
+		return nil, nil
+	}
+
+	rs := &requestSigner{
+		headers: []string{"host"},
+		header:  defaultSigningHeader,
+		format:  defaultSigningFormat,
+		maxBody: defaultSigningMaxBody,
+	}
+	rs.keyID, _, err = getString(raw, "keyId")
+	if err != nil || rs.keyID == "" {
+		return nil, fmt.Errorf("%w: needs a keyId", BadSigningError)
+	}
+	secret, _, err := getString(raw, "secret")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadSigningError, err)
+	}
+	secretFile, _, err := getString(raw, "secretFile")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadSigningError, err)
+	}
+	if (secret == "") == (secretFile == "") {
+		return nil, fmt.Errorf("%w: needs a secret or a secretFile", BadSigningError)
+	}
+	if secretFile != "" {
+		b, err := os.ReadFile(secretFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", BadSigningError, err)
+		}
+		secret = strings.TrimSpace(string(b))
+		if secret == "" {
+			return nil, fmt.Errorf("%w: empty secretFile", BadSigningError)
+		}
+	}
+	rs.secret = []byte(secret)
+
+	headers, exists, err := getStringList(raw, "headers")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadSigningError, err)
+	}
+	if exists {
+		rs.headers = make([]string, 0, len(headers))
+		for _, h := range headers {
+			rs.headers = append(rs.headers, strings.ToLower(h))
+		}
+	}
+
+	header, exists, err := getString(raw, "header")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadSigningError, err)
+	}
+	if exists {
+		if header == "" {
+			return nil, fmt.Errorf("%w: empty header", BadSigningError)
+		}
+		rs.header = header
+	}
+
+	format, exists, err := getString(raw, "format")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadSigningError, err)
+	}
+	if exists {
+		if !strings.Contains(format, "{signature}") {
+			return nil, fmt.Errorf("%w: format needs {signature}", BadSigningError)
+		}
+		rest := format
+		for _, v := range signingVars {
+			rest = strings.ReplaceAll(rest, v, "")
+		}
+		if strings.Contains(rest, "{") {
+			return nil, fmt.Errorf("%w: unknown variable in %s", BadSigningError, format)
+		}
+		rs.format = format
+	}
+
+	maxBody, exists, err := getInt(raw, "maxBodySize")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadSigningError, err)
+	}
+	if exists {
+		if maxBody < 0 {
+			return nil, fmt.Errorf("%w: maxBodySize can't be negative", BadSigningError)
+		}
+		rs.maxBody = maxBody
+	}
+	return rs, nil
+}
@@ -0,0 +1,216 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var signatureRegexp = regexp.MustCompile(
+	`^keyId="([^"]*)", timestamp="(\d+)", headers="([^"]*)", signature="([^"]*)"$`)
+
+// verifySignature verifies a signature like an upstream would.
+func verifySignature(r *http.Request, secret string, body []byte) bool {
+	m := signatureRegexp.FindStringSubmatch(r.Header.Get("X-Tupi-Signature"))
+	if m == nil {
+		return false
+	}
+	sum := sha256.Sum256(body)
+	s := r.Method + "\n" + r.URL.RequestURI() + "\n" + m[2] + "\n" + hex.EncodeToString(sum[:]) + "\n"
+	for _, h := range strings.Fields(m[3]) {
+		v := strings.Join(r.Header.Values(h), ", ")
+		if h == "host" {
+			v = r.Host
+		}
+		s += h + ":" + v + "\n"
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(s))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return m[1] == "k1" && hmac.Equal([]byte(m[4]), []byte(expected))
+}
+
+func TestRequestSignerSign(t *testing.T) {
+	rs := &requestSigner{
+		keyID:   "k1",
+		secret:  []byte("the secret"),
+		headers: []string{"host", "content-type", "x-missing"},
+		header:  defaultSigningHeader,
+		format:  defaultSigningFormat,
+		maxBody: 10,
+	}
+	r := httptest.NewRequest("POST", "http://up.bla/a%2Fb?x=1", strings.NewReader("the body"))
+	r.Header.Set("Content-Type", "text/plain")
+	r.Header.Set("X-Tupi-Signature", "forged")
+	r.ContentLength = -1
+	rs.sign(r)
+	if r.ContentLength != 8 {
+		t.Fatalf("bad content length %d", r.ContentLength)
+	}
+	body, _ := io.ReadAll(r.Body)
+	if string(body) != "the body" {
+		t.Fatalf("bad body %s", string(body))
+	}
+	if !verifySignature(r, "the secret", body) {
+		t.Fatalf("bad signature %s", r.Header.Get("X-Tupi-Signature"))
+	}
+	r.Header.Set("Content-Type", "text/html")
+	if verifySignature(r, "the secret", body) {
+		t.Fatalf("changed header verified")
+	}
+
+	t.Run("big body", func(t *testing.T) {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", 11)))
+		r.ContentLength = -1
+		rs.sign(r)
+		_, err := io.ReadAll(r.Body)
+		var maxBytesErr *http.MaxBytesError
+		if !errors.As(err, &maxBytesErr) {
+			t.Fatalf("bad err %v", err)
+		}
+		if r.Header.Get("X-Tupi-Signature") != "" {
+			t.Fatalf("signed")
+		}
+	})
+
+	t.Run("format", func(t *testing.T) {
+		rs := *rs
+		rs.format = "v1:{keyId}:{digest}:{signature}"
+		r := httptest.NewRequest("GET", "/", nil)
+		rs.sign(r)
+		if !strings.HasPrefix(r.Header.Get("X-Tupi-Signature"),
+			"v1:k1:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855:") {
+			t.Fatalf("bad header %s", r.Header.Get("X-Tupi-Signature"))
+		}
+	})
+}
+
+func TestServeSigning(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if !verifySignature(r, "the secret", body) {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}))
+	defer upstream.Close()
+
+	conf := map[string]any{
+		"host": upstream.URL,
+		"signing": map[string]any{
+			"keyId": "k1", "secret": "the secret", "headers": []any{"Host", "X-Request-Id"},
+			"maxBodySize": 100,
+		},
+	}
+	var tests = []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"no body", "", 200},
+		{"body", "the body", 200},
+		{"big body", strings.Repeat("a", 101), 413},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/some/path?a=b", strings.NewReader(test.body))
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("bad code %d", w.Code)
+			}
+		})
+	}
+
+	t.Run("websocket", func(t *testing.T) {
+		defer func() { testDial = nil }()
+		h := newHijacker(false)
+		testDial = func(n, a string) (net.Conn, error) {
+			return h.destConn, nil
+		}
+		r, _ := http.NewRequest("GET", "/ws", nil)
+		r.Header.Set("Connection", "upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		go Serve(h, r, &conf)
+		var written []byte
+		for len(written) == 0 {
+			written = h.destConn.(*bufferConn).written()
+		}
+		h.destConn.Close()
+		h.inConn.Close()
+		if !strings.Contains(string(written), "X-Tupi-Signature: keyId=\"k1\"") {
+			t.Fatalf("handshake not signed %s", string(written))
+		}
+	})
+}
+
+func TestParseSigning(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, []byte("the secret\n"), 0o600)
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"not a table", map[string]any{"signing": "x"}, BadSigningError},
+		{"no key id", map[string]any{"signing": map[string]any{"secret": "s"}}, BadSigningError},
+		{"no secret", map[string]any{"signing": map[string]any{"keyId": "k1"}}, BadSigningError},
+		{"secret and file", map[string]any{"signing": map[string]any{
+			"keyId": "k1", "secret": "s", "secretFile": secretFile}}, BadSigningError},
+		{"missing file", map[string]any{"signing": map[string]any{
+			"keyId": "k1", "secretFile": secretFile + ".missing"}}, BadSigningError},
+		{"no signature in format", map[string]any{"signing": map[string]any{
+			"keyId": "k1", "secret": "s", "format": "{keyId}"}}, BadSigningError},
+		{"unknown variable", map[string]any{"signing": map[string]any{
+			"keyId": "k1", "secret": "s", "format": "{signature} {nonce}"}}, BadSigningError},
+		{"bad headers", map[string]any{"signing": map[string]any{
+			"keyId": "k1", "secret": "s", "headers": "Host"}}, BadSigningError},
+		{"ok", map[string]any{"signing": map[string]any{
+			"keyId": "k1", "secretFile": secretFile, "header": "Signature",
+			"format": "{keyId};{timestamp};{signature}"}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseSigning(test.conf, nil)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+
+	t.Run("secret file", func(t *testing.T) {
+		rs, _ := parseSigning(map[string]any{"signing": map[string]any{
+			"keyId": "k1", "secretFile": secretFile}}, nil)
+		if string(rs.secret) != "the secret" {
+			t.Fatalf("bad secret %q", rs.secret)
+		}
+	})
+}
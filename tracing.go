@@ -0,0 +1,662 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var BadTracingError error = errors.New("[tupi-proxy] Bad tracing config")
+
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusUnset = 0
+	spanStatusError = 2
+
+	defaultServiceName  = "tupi-proxy"
+	defaultBatchSize    = 512
+	defaultBatchTimeout = 5 * time.Second
+
+	otlpHTTPJSON = "http/json"
+	otlpGRPC     = "grpc"
+	// spans are dropped if the queue is bigger than this
+	maxQueuedSpans = 4096
+)
+
+// tracer creates spans for the proxied requests and exports them to an
+// OpenTelemetry collector using OTLP over http with json encoding or
+// grpc.
+type tracer struct {
+	serviceName string
+	// ratio of new traces sampled. From 0 to 1. When the client sends a
+	// traceparent its sampled flag is used.
+	sampleRate float64
+	exporter   *otlpExporter
+}
+
+// spanContext is what is propagated in the traceparent and tracestate
+// headers (W3C Trace Context).
+type spanContext struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	sampled    bool
+	traceState string
+}
+
+// parseTraceparent parses a traceparent header like
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(v string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// version 00 has exactly 4 parts. Future versions may have more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	sc.sampled = flags[0]&0x01 == 0x01
+	return sc, true
+}
+
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s",
+		hex.EncodeToString(sc.traceID[:]), hex.EncodeToString(sc.spanID[:]), flags)
+}
+
+// inject sets the trace context headers in a request sent to the upstream.
+func (sc spanContext) inject(h http.Header) {
+	h.Set("Traceparent", sc.traceparent())
+	if sc.traceState != "" {
+		h.Set("Tracestate", sc.traceState)
+	} else {
+		h.Del("Tracestate")
+	}
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+type span struct {
+	tracer   *tracer
+	ctx      spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu        sync.Mutex
+	end       time.Time
+	attrs     []attribute
+	status    int
+	statusMsg string
+	ended     bool
+	children  []*span
+}
+
+func newSpanID() [8]byte {
+	var id [8]byte
+	for id == [8]byte{} {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newTraceID() [16]byte {
+	var id [16]byte
+	for id == [16]byte{} {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// startServerSpan starts the span for a request received by the proxy.
+// If the request has a valid traceparent the span is part of that trace.
+func (t *tracer) startServerSpan(r *http.Request, name string) *span {
+	s := &span{
+		tracer: t,
+		name:   name,
+		kind:   spanKindServer,
+		start:  time.Now(),
+	}
+	parent, ok := parseTraceparent(r.Header.Get("Traceparent"))
+	if ok {
+		s.ctx.traceID = parent.traceID
+		s.ctx.sampled = parent.sampled
+		s.ctx.traceState = r.Header.Get("Tracestate")
+		s.parentID = parent.spanID
+	} else {
+		s.ctx.traceID = newTraceID()
+		s.ctx.sampled = t.sampleTrace(s.ctx.traceID)
+	}
+	s.ctx.spanID = newSpanID()
+	return s
+}
+
+// sampleTrace decides if a new trace is sampled based on its id, so
+// the decision is the same for everyone using the same ratio.
+func (t *tracer) sampleTrace(traceID [16]byte) bool {
+	if t.sampleRate >= 1 {
+		return true
+	}
+	if t.sampleRate <= 0 {
+		return false
+	}
+	n := binary.BigEndian.Uint64(traceID[8:]) >> 1
+	return float64(n) < t.sampleRate*float64(uint64(1)<<63)
+}
+
+func (s *span) child(name string, kind int) *span {
+	c := &span{
+		tracer:   s.tracer,
+		ctx:      s.ctx,
+		parentID: s.ctx.spanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+	c.ctx.spanID = newSpanID()
+	s.mu.Lock()
+	s.children = append(s.children, c)
+	s.mu.Unlock()
+	return c
+}
+
+func (s *span) setAttr(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+func (s *span) setError(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = spanStatusError
+	s.statusMsg = msg
+}
+
+// finish ends the span and the children not ended yet. Sampled spans
+// are exported.
+func (s *span) finish() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	children := s.children
+	s.mu.Unlock()
+
+	for _, c := range children {
+		c.finish()
+	}
+	if s.ctx.sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.export(s)
+	}
+}
+
+// clientTrace returns a trace that creates child spans for the dial,
+// the tls handshake and the wait for the first byte of the response.
+func (s *span) clientTrace() *httptrace.ClientTrace {
+	var mu sync.Mutex
+	dials := map[string]*span{}
+	var tlsSpan, firstByte *span
+
+	return &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			d := s.child("dial", spanKindInternal)
+			d.setAttr("network.peer.address", addr)
+			mu.Lock()
+			dials[network+addr] = d
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			d := dials[network+addr]
+			mu.Unlock()
+			if d == nil {
+				return
+			}
+			if err != nil {
+				d.setError(err.Error())
+			}
+			d.finish()
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsSpan = s.child("tls handshake", spanKindInternal)
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			t := tlsSpan
+			mu.Unlock()
+			if t == nil {
+				return
+			}
+			if err != nil {
+				t.setError(err.Error())
+			}
+			t.finish()
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			mu.Lock()
+			firstByte = s.child("first byte", spanKindInternal)
+			mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			fb := firstByte
+			mu.Unlock()
+			if fb != nil {
+				fb.finish()
+			}
+		},
+	}
+}
+
+// startUpstreamSpan starts the client span for the request sent to the
+// upstream, and propagates the trace context to the upstream.
+func startUpstreamSpan(out *http.Request, in *http.Request) *span {
+	info := getRequestInfo(in)
+	if info.span == nil {
+		return nil
+	}
+	s := info.span.child(out.Method, spanKindClient)
+	s.setAttr("http.request.method", out.Method)
+	s.setAttr("server.address", out.URL.Host)
+	s.setAttr("url.full", out.URL.String())
+	s.ctx.inject(out.Header)
+	info.upstreamSpan = s
+	return s
+}
+
+// finishServerSpan ends the span for the request received by the proxy.
+func finishServerSpan(info *requestInfo, rw *responseWriter) {
+	s := info.span
+	s.setAttr("http.request.method", info.method)
+	s.setAttr("url.path", info.path)
+	s.setAttr("http.route", info.route)
+	s.setAttr("client.address", info.clientIP)
+	if rw.status != 0 {
+		s.setAttr("http.response.status_code", rw.status)
+	}
+	if rw.status >= 500 {
+		s.setError(http.StatusText(rw.status))
+	}
+	s.finish()
+}
+
+// otlpExporter sends spans in batches to an OTLP endpoint using http
+// with json encoding or grpc.
+type otlpExporter struct {
+	endpoint     string
+	protocol     string
+	headers      map[string]string
+	serviceName  string
+	batchSize    int
+	batchTimeout time.Duration
+	client       *http.Client
+
+	mu       sync.Mutex
+	queue    []*span
+	flushC   chan struct{}
+	stopC    chan struct{}
+	once     sync.Once
+	stopOnce sync.Once
+}
+
+// exporters are shared by configs with the same endpoint so config
+// reloads do not leave exporters behind.
+var exporters = map[string]*otlpExporter{}
+var exportersMutex sync.Mutex
+
+func getExporter(endpoint, protocol, serviceName string, headers map[string]string,
+	batchSize int, batchTimeout time.Duration) *otlpExporter {
+	exportersMutex.Lock()
+	defer exportersMutex.Unlock()
+	key := endpoint + " " + serviceName
+	if e, ok := exporters[key]; ok {
+		if e.protocol == protocol && e.batchSize == batchSize && e.batchTimeout == batchTimeout &&
+			maps.Equal(e.headers, headers) {
+			return e
+		}
+		// the config changed in a reload
+		e.stop()
+	}
+	e := &otlpExporter{
+		endpoint:     endpoint,
+		protocol:     protocol,
+		headers:      headers,
+		serviceName:  serviceName,
+		batchSize:    batchSize,
+		batchTimeout: batchTimeout,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		flushC:       make(chan struct{}, 1),
+		stopC:        make(chan struct{}),
+	}
+	if protocol == otlpGRPC {
+		e.client.Transport = grpcTransport(endpoint)
+	}
+	exporters[key] = e
+	return e
+}
+
+// stop sends the queued spans and stops the exporter.
+func (e *otlpExporter) stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopC)
+	})
+}
+
+func (e *otlpExporter) export(s *span) {
+	e.once.Do(func() {
+		go e.run()
+	})
+	e.mu.Lock()
+	if len(e.queue) >= maxQueuedSpans {
+		e.mu.Unlock()
+		return
+	}
+	e.queue = append(e.queue, s)
+	full := len(e.queue) >= e.batchSize
+	e.mu.Unlock()
+	select {
+	case <-e.stopC:
+		// spans of requests still using an old config
+		go e.flush()
+		return
+	default:
+	}
+	if full {
+		select {
+		case e.flushC <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(e.batchTimeout)
+	defer ticker.Stop()
+	for {
+		stopped := false
+		select {
+		case <-ticker.C:
+		case <-e.flushC:
+		case <-e.stopC:
+			stopped = true
+		}
+		if err := e.flush(); err != nil {
+			slog.Error("tracing export error", "error", err)
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// flush sends the queued spans to the collector
+func (e *otlpExporter) flush() error {
+	e.mu.Lock()
+	spans := e.queue
+	e.queue = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.client.Timeout)
+	defer cancel()
+	if e.protocol == otlpGRPC {
+		return e.sendGRPC(ctx, spans)
+	}
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// OTLP json encoding. See
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpValue(v any) map[string]any {
+	switch val := v.(type) {
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(val)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(val, 10)}
+	case bool:
+		return map[string]any{"boolValue": val}
+	case float64:
+		return map[string]any{"doubleValue": val}
+	}
+	return map[string]any{"stringValue": fmt.Sprint(v)}
+}
+
+func (e *otlpExporter) request(spans []*span) otlpRequest {
+	ospans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		os := otlpSpan{
+			TraceID:           hex.EncodeToString(s.ctx.traceID[:]),
+			SpanID:            hex.EncodeToString(s.ctx.spanID[:]),
+			TraceState:        s.ctx.traceState,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: s.status, Message: s.statusMsg},
+		}
+		if s.parentID != [8]byte{} {
+			os.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			os.Attributes = append(os.Attributes, otlpAttribute{a.key, otlpValue(a.value)})
+		}
+		s.mu.Unlock()
+		ospans = append(ospans, os)
+	}
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpAttribute{
+				{"service.name", otlpValue(e.serviceName)},
+			}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "tupi-proxy"},
+				Spans: ospans,
+			}},
+		}},
+	}
+}
+
+func parseTracing(c map[string]any) (*tracer, error) {
+	raw, exists, err := getMap(c, "tracing")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadTracingError, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	endpoint, _, err := getString(raw, "endpoint")
+	if err != nil || endpoint == "" {
+		return nil, fmt.Errorf("%w: missing endpoint", BadTracingError)
+	}
+
+	protocol, exists, err := getString(raw, "protocol")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadTracingError, err)
+	}
+	if !exists {
+		protocol = otlpHTTPJSON
+	}
+	if protocol != otlpHTTPJSON && protocol != otlpGRPC {
+		return nil, fmt.Errorf("%w: unknown protocol %s", BadTracingError, protocol)
+	}
+
+	t := &tracer{serviceName: defaultServiceName, sampleRate: 1}
+	rate, exists, err := getFloat(raw, "sampleRate")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadTracingError, err)
+	}
+	if exists {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("%w: sampleRate must be between 0 and 1", BadTracingError)
+		}
+		t.sampleRate = rate
+	}
+	name, exists, err := getString(raw, "serviceName")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadTracingError, err)
+	}
+	if exists {
+		t.serviceName = name
+	}
+
+	headers := map[string]string{}
+	pairs, err := sortedStringMap(raw, "headers")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadTracingError, err)
+	}
+	for _, kv := range pairs {
+		headers[kv[0]] = kv[1]
+	}
+
+	batchSize, exists, err := getInt(raw, "batchSize")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadTracingError, err)
+	}
+	if !exists || batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	batchTimeout, exists, err := getDuration(raw, "batchTimeout")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadTracingError, err)
+	}
+	if !exists || batchTimeout <= 0 {
+		batchTimeout = defaultBatchTimeout
+	}
+	t.exporter = getExporter(endpoint, protocol, t.serviceName, headers, int(batchSize), batchTimeout)
+	return t, nil
+}
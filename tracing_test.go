@@ -0,0 +1,289 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	var tests = []struct {
+		name    string
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"ok sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"ok not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xx", true, true},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"extra part v00", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xx", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"bad hex", "00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01", false, false},
+		{"short", "00-4bf92f-00f067aa0ba902b7-01", false, false},
+		{"empty", "", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sc, ok := parseTraceparent(test.value)
+			if ok != test.ok {
+				t.Fatalf("bad ok %t", ok)
+			}
+			if ok && sc.sampled != test.sampled {
+				t.Fatalf("bad sampled %t", sc.sampled)
+			}
+			if ok && test.value[:2] == "00" && sc.traceparent() != test.value {
+				t.Fatalf("bad traceparent %s", sc.traceparent())
+			}
+		})
+	}
+}
+
+func TestSampleTrace(t *testing.T) {
+	var tests = []struct {
+		rate float64
+		min  int
+		max  int
+	}{
+		{0, 0, 0},
+		{1, 1000, 1000},
+		{0.25, 180, 320},
+	}
+	for _, test := range tests {
+		tr := &tracer{sampleRate: test.rate}
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if tr.sampleTrace(newTraceID()) {
+				n++
+			}
+		}
+		if n < test.min || n > test.max {
+			t.Fatalf("bad sampled count for %f: %d", test.rate, n)
+		}
+	}
+}
+
+func TestParseTracing(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"no tracing", map[string]any{}, nil},
+		{"not a table", map[string]any{"tracing": 1}, BadTracingError},
+		{"no endpoint", map[string]any{"tracing": map[string]any{}}, BadTracingError},
+		{"bad protocol", map[string]any{"tracing": map[string]any{
+			"endpoint": "http://localhost:4317", "protocol": "http/protobuf"}}, BadTracingError},
+		{"grpc", map[string]any{"tracing": map[string]any{
+			"endpoint": "http://localhost:4317", "protocol": "grpc"}}, nil},
+		{"bad rate", map[string]any{"tracing": map[string]any{
+			"endpoint": "http://localhost:4318/v1/traces", "sampleRate": 2}}, BadTracingError},
+		{"bad batch timeout", map[string]any{"tracing": map[string]any{
+			"endpoint": "http://localhost:4318/v1/traces", "batchTimeout": "x"}}, BadTracingError},
+		{"ok", map[string]any{"tracing": map[string]any{
+			"endpoint":   "http://localhost:4318/v1/traces",
+			"protocol":   "http/json",
+			"sampleRate": 0.1,
+			"headers":    map[string]any{"Authorization": "Bearer x"},
+		}}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTracing(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestGetExporterReload(t *testing.T) {
+	endpoint := "http://localhost:4318/v1/traces-reload"
+	headers := map[string]string{"Authorization": "Bearer x"}
+	e := getExporter(endpoint, otlpHTTPJSON, "svc", headers, 10, time.Second)
+	if getExporter(endpoint, otlpHTTPJSON, "svc", map[string]string{"Authorization": "Bearer x"},
+		10, time.Second) != e {
+		t.Fatalf("exporter not shared")
+	}
+	var tests = []struct {
+		name         string
+		headers      map[string]string
+		batchSize    int
+		batchTimeout time.Duration
+	}{
+		{"headers", map[string]string{"Authorization": "Bearer y"}, 10, time.Second},
+		{"batch size", headers, 20, time.Second},
+		{"batch timeout", headers, 10, 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ne := getExporter(endpoint, otlpHTTPJSON, "svc", test.headers,
+				test.batchSize, test.batchTimeout)
+			if ne == e {
+				t.Fatalf("exporter not replaced")
+			}
+			select {
+			case <-e.stopC:
+			default:
+				t.Fatalf("old exporter not stopped")
+			}
+			e = ne
+		})
+	}
+	if getExporter(endpoint, otlpGRPC, "svc", headers, 10, 2*time.Second) == e {
+		t.Fatalf("exporter not replaced for the protocol")
+	}
+}
+
+// collector is a stand-in for an OpenTelemetry collector
+type collector struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+	auth  string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req otlpRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.auth = r.Header.Get("Authorization")
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func (c *collector) byName() map[string]otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := map[string]otlpSpan{}
+	for _, s := range c.spans {
+		m[s.Name] = s
+	}
+	return m
+}
+
+func TestServeTracing(t *testing.T) {
+	col := &collector{}
+	colServer := httptest.NewServer(col)
+	defer colServer.Close()
+
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			upstreamTraceparent = r.Header.Get("Traceparent")
+			w.WriteHeader(http.StatusCreated)
+		}))
+	defer upstream.Close()
+
+	conf := map[string]any{
+		"host": upstream.URL,
+		"tracing": map[string]any{
+			"endpoint": colServer.URL,
+			"headers":  map[string]any{"Authorization": "Bearer x"},
+		},
+	}
+	pc, err := getProxyConfig(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/x", nil)
+	r.Header.Set("Traceparent", incoming)
+	Serve(w, r, &conf)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bad status %d", w.Code)
+	}
+	err = pc.tracer.exporter.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := col.byName()
+	server, ok := spans["GET default"]
+	if !ok {
+		t.Fatalf("no server span %v", spans)
+	}
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		server.ParentSpanID != "00f067aa0ba902b7" || server.Kind != spanKindServer {
+		t.Fatalf("bad server span %v", server)
+	}
+	client, ok := spans["GET"]
+	if !ok || client.ParentSpanID != server.SpanID || client.Kind != spanKindClient {
+		t.Fatalf("bad client span %v", client)
+	}
+	for _, name := range []string{"dial", "first byte"} {
+		s, ok := spans[name]
+		if !ok || s.ParentSpanID != client.SpanID {
+			t.Fatalf("bad %s span %v", name, s)
+		}
+	}
+	sc, ok := parseTraceparent(upstreamTraceparent)
+	if !ok || hex.EncodeToString(sc.spanID[:]) != client.SpanID {
+		t.Fatalf("bad upstream traceparent %s", upstreamTraceparent)
+	}
+	if col.auth != "Bearer x" {
+		t.Fatalf("bad collector auth %s", col.auth)
+	}
+}
+
+func TestServeTracingNotSampled(t *testing.T) {
+	col := &collector{}
+	colServer := httptest.NewServer(col)
+	defer colServer.Close()
+
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			upstreamTraceparent = r.Header.Get("Traceparent")
+		}))
+	defer upstream.Close()
+
+	conf := map[string]any{
+		"host": upstream.URL,
+		"tracing": map[string]any{
+			"endpoint":   colServer.URL,
+			"sampleRate": 0,
+		},
+	}
+	pc, _ := getProxyConfig(&conf)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/x", nil)
+	Serve(w, r, &conf)
+	pc.tracer.exporter.flush()
+	if len(col.byName()) != 0 {
+		t.Fatalf("not sampled spans exported")
+	}
+	sc, ok := parseTraceparent(upstreamTraceparent)
+	if !ok || sc.sampled {
+		t.Fatalf("bad upstream traceparent %s", upstreamTraceparent)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var BadTrustedProxiesError error = errors.New("[tupi-proxy] Bad trusted proxies config")
+
+// trustedProxies are the networks of proxies (like load balancers) that
+// are in front of us. Forwarding headers are honoured only if sent by
+// a trusted proxy.
+type trustedProxies []netip.Prefix
+
+func (tp trustedProxies) contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range tp {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the info about the client for a request. If the peer is
+// a trusted proxy the client ip is the rightmost untrusted hop of the
+// forwarding headers.
+func (tp trustedProxies) resolve(r *http.Request) *requestInfo {
+	peer := remoteIP(r)
+	info := &requestInfo{
+		clientIP: peer,
+		peerIP:   peer,
+		host:     r.Host,
+		proto:    "http",
+		method:   r.Method,
+		path:     r.URL.Path,
+	}
+	if r.TLS != nil {
+		info.proto = "https"
+	}
+	if !tp.contains(peer) {
+		info.port = requestPort(r, info.proto)
+		return info
+	}
+
+	info.trustedPeer = true
+	info.forwardedFor = headerList(r.Header, "X-Forwarded-For")
+	info.forwarded = headerList(r.Header, "Forwarded")
+	if v := r.Header.Get("X-Forwarded-Proto"); v != "" {
+		info.proto = v
+	}
+	if v := r.Header.Get("X-Forwarded-Host"); v != "" {
+		info.host = v
+	}
+	info.port = r.Header.Get("X-Forwarded-Port")
+	if info.port == "" {
+		info.port = requestPort(r, info.proto)
+	}
+
+	chain := info.forwardedFor
+	if len(chain) == 0 {
+		chain = forwardedForNodes(info.forwarded)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := normalizeIP(chain[i])
+		if ip == "" {
+			break
+		}
+		info.clientIP = ip
+		if !tp.contains(ip) {
+			break
+		}
+	}
+	return info
+}
+
+// headerList returns the comma separated values of all the header lines.
+func headerList(h http.Header, name string) []string {
+	var l []string
+	for _, v := range h.Values(name) {
+		for _, i := range strings.Split(v, ",") {
+			i = strings.TrimSpace(i)
+			if i != "" {
+				l = append(l, i)
+			}
+		}
+	}
+	return l
+}
+
+// forwardedForNodes returns the `for` nodes of Forwarded elements.
+func forwardedForNodes(elements []string) []string {
+	var nodes []string
+	for _, e := range elements {
+		for _, pair := range strings.Split(e, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(k, "for") {
+				nodes = append(nodes, strings.Trim(v, `"`))
+			}
+		}
+	}
+	return nodes
+}
+
+// normalizeIP returns the ip of a node that may have port and brackets.
+// It returns an empty string if the node is not an ip.
+func normalizeIP(node string) string {
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr().Unmap().String()
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	addr, err := netip.ParseAddr(node)
+	if err != nil {
+		return ""
+	}
+	return addr.Unmap().String()
+}
+
+func parseTrustedProxies(c map[string]any) (trustedProxies, error) {
+	raw, _, err := getStringList(c, "trustedProxies")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", BadTrustedProxiesError, err)
+	}
+	var tp trustedProxies
+	for _, s := range raw {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", BadTrustedProxiesError, s)
+		}
+		tp = append(tp, p)
+	}
+	return tp, nil
+}
+
+// parsePrefix parses a cidr. A single ip is taken as a network with
+// only that ip.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return p, err
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	var tests = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{"none", map[string]any{}, nil},
+		{"not a list", map[string]any{"trustedProxies": "10.0.0.0/8"}, BadTrustedProxiesError},
+		{"bad cidr", map[string]any{"trustedProxies": []any{"10.0.0.0/99"}}, BadTrustedProxiesError},
+		{"bad ip", map[string]any{"trustedProxies": []any{"nada"}}, BadTrustedProxiesError},
+		{"ok", map[string]any{"trustedProxies": []any{"10.0.0.0/8", "192.168.0.1", "fd00::/8"}}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseTrustedProxies(test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad err %v", err)
+			}
+		})
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	tp, _ := parseTrustedProxies(map[string]any{
+		"trustedProxies": []any{"10.0.0.0/8", "192.168.0.1", "fd00::/8"}})
+
+	var tests = []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		clientIP   string
+		trusted    bool
+		proto      string
+	}{
+		{
+			"untrusted peer ignores headers",
+			"1.2.3.4:5678",
+			map[string]string{"X-Forwarded-For": "6.6.6.6", "X-Forwarded-Proto": "https"},
+			"1.2.3.4",
+			false,
+			"http",
+		},
+		{
+			"trusted peer without headers",
+			"10.0.0.1:5678",
+			map[string]string{},
+			"10.0.0.1",
+			true,
+			"http",
+		},
+		{
+			"rightmost untrusted hop",
+			"10.0.0.1:5678",
+			map[string]string{
+				"X-Forwarded-For":   "6.6.6.6, 1.2.3.4, 192.168.0.1",
+				"X-Forwarded-Proto": "https",
+			},
+			"1.2.3.4",
+			true,
+			"https",
+		},
+		{
+			"all hops trusted",
+			"10.0.0.1:5678",
+			map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			"10.0.0.3",
+			true,
+			"http",
+		},
+		{
+			"garbage hop",
+			"10.0.0.1:5678",
+			map[string]string{"X-Forwarded-For": "1.2.3.4, nada, 10.0.0.2"},
+			"10.0.0.2",
+			true,
+			"http",
+		},
+		{
+			"forwarded header",
+			"[fd00::1]:5678",
+			map[string]string{"Forwarded": `for="[2001:db8::1]:80";proto=https, for=10.0.0.2`},
+			"2001:db8::1",
+			true,
+			"http",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://the.site/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+			info := tp.resolve(r)
+			if info.clientIP != test.clientIP {
+				t.Fatalf("bad client ip %s", info.clientIP)
+			}
+			if info.trustedPeer != test.trusted {
+				t.Fatalf("bad trusted %t", info.trustedPeer)
+			}
+			if info.proto != test.proto {
+				t.Fatalf("bad proto %s", info.proto)
+			}
+		})
+	}
+}
+
+func TestServeTrustedProxies(t *testing.T) {
+	defer func() {
+		testProxy = nil
+	}()
+	var p *myProxy
+	testProxy = func(rt *route, host string) httpProxy {
+		p = &myProxy{route: rt, host: host}
+		return p
+	}
+
+	conf := map[string]any{
+		"host":             "http://v1.bla",
+		"forwardedHeaders": "both",
+		"trustedProxies":   []any{"10.0.0.0/8"},
+	}
+
+	var tests = []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   map[string]string
+	}{
+		{
+			"trusted",
+			"10.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "1.2.3.4", "Forwarded": "for=1.2.3.4"},
+			map[string]string{
+				"X-Forwarded-For":   "1.2.3.4, 10.0.0.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.site",
+				"Forwarded":         "for=1.2.3.4, for=10.0.0.1;host=public.site;proto=https",
+			},
+		},
+		{
+			"spoofed",
+			"1.2.3.4:1234",
+			map[string]string{"X-Forwarded-For": "6.6.6.6", "Forwarded": "for=6.6.6.6"},
+			map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "the.site",
+				"Forwarded":         "for=1.2.3.4;host=the.site;proto=http",
+			},
+		},
+		{
+			"x-forwarded-for only",
+			"10.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "1.2.3.4, 2001:db8::1"},
+			map[string]string{
+				"X-Forwarded-For":   "1.2.3.4, 2001:db8::1, 10.0.0.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.site",
+				"Forwarded": `for=1.2.3.4, for="[2001:db8::1]", ` +
+					"for=10.0.0.1;host=public.site;proto=https",
+			},
+		},
+		{
+			"forwarded only",
+			"10.0.0.1:1234",
+			map[string]string{"Forwarded": `for=1.2.3.4;proto=https, for="[2001:db8::1]:80"`},
+			map[string]string{
+				"X-Forwarded-For":   "1.2.3.4, 2001:db8::1, 10.0.0.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.site",
+				"Forwarded": `for=1.2.3.4;proto=https, for="[2001:db8::1]:80", ` +
+					"for=10.0.0.1;host=public.site;proto=https",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "http://the.site/", nil)
+			r.RemoteAddr = test.remoteAddr
+			r.Header.Set("X-Forwarded-Proto", "https")
+			r.Header.Set("X-Forwarded-Host", "public.site")
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+			Serve(w, r, &conf)
+			got := map[string]string{}
+			for k := range test.expected {
+				got[k] = p.pr.Out.Header.Get(k)
+			}
+			if !reflect.DeepEqual(got, test.expected) {
+				t.Fatalf("bad headers %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// responseWriter records the status and the size of the response
+// written to the client. A recording writer also keeps the headers
+// sent and the start of the body.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	// set only in recording writers
+	header http.Header
+	body   *prefixBuffer
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{ResponseWriter: w}
+}
+
+// newRecordingWriter returns a writer that keeps the headers and the
+// first maxBody bytes of the body.
+func newRecordingWriter(w http.ResponseWriter, maxBody int64) *responseWriter {
+	return &responseWriter{ResponseWriter: w, body: &prefixBuffer{limit: maxBody}}
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	// informational responses are not the final response
+	if rw.status == 0 && code >= 200 {
+		rw.status = code
+		if rw.body != nil {
+			rw.header = rw.Header().Clone()
+		}
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	if rw.body != nil {
+		rw.body.Write(b[:n])
+	}
+	return n, err
+}
+
+// response returns the status and the headers of the response. If
+// nothing was written yet they are the ones that would be sent.
+func (rw *responseWriter) response() (int, http.Header) {
+	if rw.status == 0 {
+		return http.StatusOK, rw.Header()
+	}
+	return rw.status, rw.header
+}
+
+func (rw *responseWriter) Flush() {
+	http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Unwrap is used by http.ResponseController, ie. to hijack the
+// connection in websocket requests.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// prefixBuffer keeps the first limit bytes written to it. The request
+// body is written by the transport so the buffer has its own lock.
+type prefixBuffer struct {
+	mu        sync.Mutex
+	buf       []byte
+	limit     int64
+	size      int64
+	truncated bool
+}
+
+func (pb *prefixBuffer) Write(b []byte) (int, error) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.size += int64(len(b))
+	room := pb.limit - int64(len(pb.buf))
+	if int64(len(b)) > room {
+		pb.buf = append(pb.buf, b[:max(room, 0)]...)
+		pb.truncated = true
+	} else {
+		pb.buf = append(pb.buf, b...)
+	}
+	return len(b), nil
+}
+
+// content returns the kept bytes, the total size written and if the
+// content was truncated.
+func (pb *prefixBuffer) content() ([]byte, int64, bool) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	return pb.buf, pb.size, pb.truncated
+}
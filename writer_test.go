@@ -0,0 +1,91 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-proxy.
+
+// tupi-proxy is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-proxy is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-proxy. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestResponseWriter(t *testing.T) {
+	h := newHijacker(false)
+	rw := newResponseWriter(h)
+	rw.WriteHeader(http.StatusEarlyHints)
+	if rw.status != 0 {
+		t.Fatalf("informational status recorded %d", rw.status)
+	}
+
+	h = newHijacker(false)
+	rw = newResponseWriter(h)
+	rw.WriteHeader(http.StatusNotFound)
+	rw.Write([]byte("not found"))
+	rw.Flush()
+	if rw.status != http.StatusNotFound {
+		t.Fatalf("bad status %d", rw.status)
+	}
+	if rw.bytes != 9 {
+		t.Fatalf("bad bytes %d", rw.bytes)
+	}
+
+	conn, _, err := http.NewResponseController(rw).Hijack()
+	if err != nil || conn != h.inConn {
+		t.Fatalf("bad hijack %v", err)
+	}
+
+	rw = newResponseWriter(h)
+	rw.Write([]byte("x"))
+	if rw.status != http.StatusOK {
+		t.Fatalf("bad default status %d", rw.status)
+	}
+}
+
+func TestRecordingWriter(t *testing.T) {
+	h := newHijacker(false)
+	rw := newRecordingWriter(h, 5)
+	if status, _ := rw.response(); status != http.StatusOK {
+		t.Fatalf("bad default status %d", status)
+	}
+	rw.Header().Set("X-Sent", "1")
+	rw.WriteHeader(http.StatusCreated)
+	// not sent
+	rw.Header().Set("X-Late", "1")
+	rw.Write([]byte("abcdefg"))
+
+	status, header := rw.response()
+	if status != http.StatusCreated {
+		t.Fatalf("bad status %d", status)
+	}
+	if header.Get("X-Sent") != "1" || header.Get("X-Late") != "" {
+		t.Fatalf("bad header %v", header)
+	}
+	b, size, truncated := rw.body.content()
+	if string(b) != "abcde" || size != 7 || !truncated || rw.bytes != 7 {
+		t.Fatalf("bad body %s %d %v", string(b), size, truncated)
+	}
+}
+
+func TestPrefixBuffer(t *testing.T) {
+	pb := &prefixBuffer{limit: 5}
+	pb.Write([]byte("abc"))
+	pb.Write([]byte("defg"))
+	pb.Write([]byte("h"))
+	b, size, truncated := pb.content()
+	if string(b) != "abcde" || size != 8 || !truncated {
+		t.Fatalf("bad content %s %d %v", string(b), size, truncated)
+	}
+}